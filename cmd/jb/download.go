@@ -0,0 +1,55 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+func downloadCommand(ctx context.Context, dir string, uris []string) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	var list []deps.Dependency
+	for _, u := range uris {
+		d := deps.Parse(dir, u)
+		if d == nil {
+			kingpin.Fatalf("Unable to parse package URI `%s`", u)
+		}
+		list = append(list, *d)
+	}
+
+	// no uris: all locked packages of the project
+	if len(uris) == 0 {
+		lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+		kingpin.FatalIfError(err, "failed to load lockfile")
+
+		for _, k := range lockFile.Dependencies.Keys() {
+			d, _ := lockFile.Dependencies.Get(k)
+			list = append(list, d)
+		}
+	}
+
+	kingpin.FatalIfError(pkg.Prefetch(ctx, list), "downloading packages")
+	return 0
+}
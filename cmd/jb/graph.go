@@ -0,0 +1,63 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+)
+
+const (
+	graphFormatDOT     = "dot"
+	graphFormatJSON    = "json"
+	graphFormatMermaid = "mermaid"
+)
+
+var graphFormats = []string{graphFormatDOT, graphFormatJSON, graphFormatMermaid}
+
+func graphCommand(w io.Writer, dir, jsonnetHome, format string) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	jsonnetFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.File))
+	kingpin.FatalIfError(err, "failed to load jsonnetfile")
+
+	lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+	kingpin.FatalIfError(err, "failed to load lockfile")
+
+	graph, err := pkg.LoadGraph(jsonnetFile, filepath.Join(dir, jsonnetHome), lockFile.Dependencies)
+	kingpin.FatalIfError(err, "reading vendored jsonnetfiles")
+
+	switch format {
+	case graphFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(graph)
+	case graphFormatMermaid:
+		err = graph.WriteMermaid(w)
+	default:
+		err = graph.WriteDOT(w)
+	}
+	kingpin.FatalIfError(err, "writing graph")
+
+	return 0
+}
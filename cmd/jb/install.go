@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -31,7 +32,7 @@ import (
 	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
 )
 
-func installCommand(dir, jsonnetHome string, uris []string, single bool, legacyName string) int {
+func installCommand(ctx context.Context, dir, jsonnetHome string, uris []string, single bool, legacyName string) int {
 	if dir == "" {
 		dir = "."
 	}
@@ -83,9 +84,10 @@ func installCommand(dir, jsonnetHome string, uris []string, single bool, legacyN
 	}
 
 	jsonnetPkgHomeDir := filepath.Join(dir, jsonnetHome)
-	locked, err := pkg.Ensure(jsonnetFile, jsonnetPkgHomeDir, lockFile.Dependencies)
+	locked, err := pkg.Ensure(ctx, jsonnetFile, jsonnetPkgHomeDir, lockFile.Dependencies)
 	kingpin.FatalIfError(err, "failed to install packages")
 
+	pinArchives(jsonnetFile.Dependencies, locked)
 	pkg.CleanLegacyName(jsonnetFile.Dependencies)
 
 	kingpin.FatalIfError(
@@ -99,6 +101,27 @@ func installCommand(dir, jsonnetHome string, uris []string, single bool, legacyN
 	return 0
 }
 
+// pinArchives records the checksum of archives installed without one, so that
+// later installs are verified against it
+func pinArchives(direct, locked *deps.Ordered) {
+	for _, k := range direct.Keys() {
+		d, _ := direct.Get(k)
+		a := d.Source.ArchiveSource
+		if a == nil || a.SHA256 != "" {
+			continue
+		}
+
+		l, ok := locked.Get(k)
+		if !ok || l.Replace != nil {
+			continue
+		}
+		pinned := *a
+		pinned.SHA256 = l.Version
+		d.Source.ArchiveSource = &pinned
+		direct.Set(k, d)
+	}
+}
+
 func depEqual(d1, d2 deps.Dependency) bool {
 	name := d1.Name() == d2.Name()
 	version := d1.Version == d2.Version
@@ -18,15 +18,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
 	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
 	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
 	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
@@ -65,7 +68,7 @@ func testInstallCommandWithJsonnetHome(t *testing.T, jsonnetHome string) {
 			URIs:                    []string{"github.com/jsonnet-bundler/jsonnet-bundler@v0.1.0"},
 			ExpectedCode:            0,
 			ExpectedJsonnetFile:     []byte(`{"version": 1, "dependencies": [{"source": {"git": {"remote": "https://github.com/jsonnet-bundler/jsonnet-bundler.git", "subdir": ""}}, "version": "v0.1.0"}], "legacyImports": true}`),
-			ExpectedJsonnetLockFile: []byte(`{"version": 1, "dependencies": [{"source": {"git": {"remote": "https://github.com/jsonnet-bundler/jsonnet-bundler.git", "subdir": ""}}, "version": "080f157c7fb85ad0281ea78f6c641eaa570a582f", "sum": "W1uI550rQ66axRpPXA2EZDquyPg/5PHZlvUz1NEzefg="}], "legacyImports": false}`),
+			ExpectedJsonnetLockFile: []byte(`{"version": 1, "dependencies": [{"source": {"git": {"remote": "https://github.com/jsonnet-bundler/jsonnet-bundler.git", "subdir": ""}}, "version": "080f157c7fb85ad0281ea78f6c641eaa570a582f", "tag": "v0.1.0"}], "legacyImports": false}`),
 		},
 		{
 			Name:                    "Local",
@@ -79,7 +82,7 @@ func testInstallCommandWithJsonnetHome(t *testing.T, jsonnetHome string) {
 			URIs:                    []string{"github.com/grafana/loki/production/ksonnet/loki@bd4d516262c107a0bde7a962fa2b1e567a2c21e5"},
 			ExpectedCode:            0,
 			ExpectedJsonnetFile:     []byte(`{"version":1,"dependencies":[{"source":{"git":{"remote":"https://github.com/grafana/loki.git","subdir":"production/ksonnet/loki"}},"version":"bd4d516262c107a0bde7a962fa2b1e567a2c21e5","single":true}],"legacyImports":true}`),
-			ExpectedJsonnetLockFile: []byte(`{"version":1,"dependencies":[{"source":{"git":{"remote":"https://github.com/grafana/loki.git","subdir":"production/ksonnet/loki"}},"version":"bd4d516262c107a0bde7a962fa2b1e567a2c21e5","sum":"ExovUKXmZ4KwJAv/q8ZwNW9BdIZlrxmoGrne7aR64wo=","single":true}],"legacyImports":false}`),
+			ExpectedJsonnetLockFile: []byte(`{"version":1,"dependencies":[{"source":{"git":{"remote":"https://github.com/grafana/loki.git","subdir":"production/ksonnet/loki"}},"version":"bd4d516262c107a0bde7a962fa2b1e567a2c21e5","single":true}],"legacyImports":false}`),
 			single:                  true,
 		},
 	}
@@ -105,10 +108,10 @@ func testInstallCommandWithJsonnetHome(t *testing.T, jsonnetHome string) {
 			jsonnetFileContent(t, jsonnetfile.File, []byte(initContents))
 
 			// install something, check it writes only if required, etc.
-			installCommand("", jsonnetHome, tc.URIs, tc.single, "")
+			installCommand(context.TODO(), "", jsonnetHome, tc.URIs, tc.single, "")
 			jsonnetFileContent(t, jsonnetfile.File, tc.ExpectedJsonnetFile)
 			if tc.ExpectedJsonnetLockFile != nil {
-				jsonnetFileContent(t, jsonnetfile.LockFile, tc.ExpectedJsonnetLockFile)
+				lockFileContent(t, jsonnetfile.LockFile, jsonnetHome, tc.ExpectedJsonnetLockFile)
 			}
 		})
 	}
@@ -126,6 +129,34 @@ func jsonnetFileContent(t *testing.T, filename string, content []byte) {
 	}
 }
 
+// lockFileContent compares the lockfile to content, which leaves out the sums
+// and git trees of the packages. They change with the way they are computed,
+// so they are checked against the packages in vendorDir instead.
+func lockFileContent(t *testing.T, filename, vendorDir string, content []byte) {
+	t.Helper()
+
+	lock, err := jsonnetfile.Load(filename)
+	require.NoError(t, err)
+
+	problems, err := pkg.Verify(vendorDir, lock.Dependencies)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	for _, k := range lock.Dependencies.Keys() {
+		d, _ := lock.Dependencies.Get(k)
+		if d.Source.GitSource != nil {
+			assert.True(t, strings.HasPrefix(d.Sum, "h1:"), "sum of %s: %s", k, d.Sum)
+			assert.Len(t, d.Tree, 40, "tree of %s", k)
+		}
+		d.Sum, d.Tree = "", ""
+		lock.Dependencies.Set(k, d)
+	}
+
+	data, err := json.Marshal(lock)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(content), string(data))
+}
+
 func TestWriteChangedJsonnetFile(t *testing.T) {
 	testcases := []struct {
 		Name             string
@@ -226,7 +257,7 @@ func TestInstallTransitive(t *testing.T) {
 		subDirB: jsonnetFileWithFrozenLib(frozenLibSecondCommit, ""),
 	})
 
-	require.Equal(t, 0, installCommand(baseDir, "vendor", nil, false, ""))
+	require.Equal(t, 0, installCommand(context.TODO(), baseDir, "vendor", nil, false, ""))
 
 	lockCheckFrozenLibVersion(t, filepath.Join(baseDir, "jsonnetfile.lock.json"), frozenLibFirstCommit)
 	require.NoError(t, os.RemoveAll(filepath.Join(baseDir, "jsonnetfile.lock.json")))
@@ -237,7 +268,7 @@ func TestInstallTransitive(t *testing.T) {
 		subDirB: jsonnetFileWithFrozenLib(frozenLibFirstCommit, ""),
 	})
 
-	require.Equal(t, 0, installCommand(baseDir, "vendor", nil, false, ""))
+	require.Equal(t, 0, installCommand(context.TODO(), baseDir, "vendor", nil, false, ""))
 
 	lockCheckFrozenLibVersion(t, filepath.Join(baseDir, "jsonnetfile.lock.json"), frozenLibSecondCommit)
 }
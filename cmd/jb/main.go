@@ -15,9 +15,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
@@ -27,10 +33,17 @@ import (
 )
 
 const (
-	installActionName = "install"
-	updateActionName  = "update"
-	initActionName    = "init"
-	rewriteActionName = "rewrite"
+	installActionName  = "install"
+	updateActionName   = "update"
+	initActionName     = "init"
+	rewriteActionName  = "rewrite"
+	whyActionName      = "why"
+	graphActionName    = "graph"
+	outdatedActionName = "outdated"
+	tidyActionName     = "tidy"
+	verifyActionName   = "verify"
+	serveActionName    = "serve"
+	downloadActionName = "download"
 )
 
 var Version = "dev"
@@ -41,7 +54,9 @@ func main() {
 
 func Main() int {
 	cfg := struct {
-		JsonnetHome string
+		JsonnetHome  string
+		Timeout      time.Duration
+		ArchiveHosts []string
 	}{}
 
 	color.Output = color.Error
@@ -54,18 +69,77 @@ func Main() int {
 	a.Flag("quiet", "Suppress any output from git command.").
 		Short('q').BoolVar(&pkg.GitQuiet)
 
+	a.Flag("cache-dir", "Package cache shared by all projects, defaults to jb/ in the user's cache directory. Set to an empty string to disable.").
+		Envar("JB_CACHE_DIR").StringVar(&pkg.CacheDir)
+
+	a.Flag("proxy", "Comma separated list of package proxies to fetch git packages from. \"direct\" fetches from the upstream repository, \"off\" disables fetching.").
+		Envar("JB_PROXY").StringVar(&pkg.Proxy)
+
+	a.Flag("jobs", "Number of packages to install concurrently.").
+		Short('j').Default(strconv.Itoa(pkg.Jobs)).IntVar(&pkg.Jobs)
+
+	a.Flag("timeout", "Abort if the whole command takes longer than this, e.g. 5m. Zero means no limit.").
+		DurationVar(&cfg.Timeout)
+	a.Flag("fetch-timeout", "Abort if fetching a single package takes longer than this, e.g. 30s. Zero means no limit.").
+		DurationVar(&pkg.FetchTimeout)
+
+	a.Flag("retries", "How often to retry downloads and git fetches that failed temporarily, e.g. with 502 or a reset connection.").
+		Default(strconv.Itoa(pkg.Retries)).IntVar(&pkg.Retries)
+	a.Flag("retry-delay", "Delay before the first retry. It doubles with every further attempt.").
+		Default(pkg.RetryDelay.String()).DurationVar(&pkg.RetryDelay)
+
+	a.Flag("archive-host", "Download packages of a host as tarballs instead of using git, given as host=kind. kind is one of github, gitlab, gitea, bitbucket, none or a URL pattern like https://{host}/{path}/archive/{commit}.tar.gz. Can be repeated.").
+		PlaceHolder("HOST=KIND").StringsVar(&cfg.ArchiveHosts)
+
+	a.Flag("interactive", "Allow git to prompt for credentials. Defaults to true on a terminal, unless $CI is set.").
+		Default(strconv.FormatBool(pkg.Interactive)).BoolVar(&pkg.Interactive)
+
+	a.Flag("git-backend", "How to fetch git packages: exec runs the git binary and honors its configuration, go needs no git binary but only supports https remotes.").
+		Envar("JB_GIT_BACKEND").Default(pkg.GitBackendName).EnumVar(&pkg.GitBackendName, pkg.GitBackendNames()...)
+
+	policies := make([]string, 0, len(pkg.ConflictPolicies))
+	for _, p := range pkg.ConflictPolicies {
+		policies = append(policies, string(p))
+	}
+	a.Flag("conflicts", "How to handle packages that are required at different versions: "+strings.Join(policies, ", ")).
+		Default(string(pkg.ConflictFirst)).EnumVar((*string)(&pkg.Conflicts), policies...)
+
 	initCmd := a.Command(initActionName, "Initialize a new empty jsonnetfile")
 
 	installCmd := a.Command(installActionName, "Install new dependencies. Existing ones are silently skipped")
 	installCmdURIs := installCmd.Arg("uris", "URIs to packages to install, URLs or file paths").Strings()
 	installCmdSingle := installCmd.Flag("single", "install package without dependencies").Short('1').Bool()
 	installCmdLegacyName := installCmd.Flag("legacy-name", "set legacy name").String()
+	installCmd.Flag("offline", "Don't access the network, only use vendored or cached packages").BoolVar(&pkg.Offline)
 
 	updateCmd := a.Command(updateActionName, "Update all or specific dependencies.")
 	updateCmdURIs := updateCmd.Arg("uris", "URIs to packages to update, URLs or file paths").Strings()
+	updateCmd.Flag("offline", "Don't access the network, only use vendored or cached packages").BoolVar(&pkg.Offline)
 
 	rewriteCmd := a.Command(rewriteActionName, "Automatically rewrite legacy imports to absolute ones")
 
+	whyCmd := a.Command(whyActionName, "Show the chains of dependencies that require a package")
+	whyCmdName := whyCmd.Arg("package", "Name of the package, e.g. github.com/grafana/grafonnet-lib/grafonnet").Required().String()
+
+	graphCmd := a.Command(graphActionName, "Print the dependency graph of the installed packages")
+	graphCmdFormat := graphCmd.Flag("format", "Output format: "+strings.Join(graphFormats, ", ")).
+		Short('o').Default(graphFormatDOT).Enum(graphFormats...)
+
+	outdatedCmd := a.Command(outdatedActionName, "List dependencies with newer upstream versions")
+	outdatedCmdJSON := outdatedCmd.Flag("json", "Print the report as JSON").Bool()
+
+	tidyCmd := a.Command(tidyActionName, "Remove dependencies nothing imports and add transitive ones imported directly")
+	tidyCmdDryRun := tidyCmd.Flag("dry-run", "Only report the changes, don't apply them").Bool()
+
+	verifyCmd := a.Command(verifyActionName, "Check that the vendored packages match the lockfile, without network access")
+
+	serveCmd := a.Command(serveActionName, "Serve the package cache to other jb instances, see --proxy")
+	serveCmdListen := serveCmd.Flag("listen", "Address to listen on").Default(":8080").String()
+	serveCmd.Flag("offline", "Only serve cached packages, don't fetch missing ones from upstream").BoolVar(&pkg.Offline)
+
+	downloadCmd := a.Command(downloadActionName, "Download packages into the package cache, without installing them")
+	downloadCmdURIs := downloadCmd.Arg("uris", "URIs to packages to download. Defaults to all locked packages of the project").Strings()
+
 	command, err := a.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
@@ -73,6 +147,13 @@ func Main() int {
 		return 2
 	}
 
+	for _, h := range cfg.ArchiveHosts {
+		if err := pkg.SetArchiveHost(h); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
+			return 2
+		}
+	}
+
 	workdir, err := os.Getwd()
 	if err != nil {
 		return 1
@@ -80,17 +161,47 @@ func Main() int {
 
 	cfg.JsonnetHome = filepath.Clean(cfg.JsonnetHome)
 
+	// cancel git and HTTP operations on the first interrupt, so temporary
+	// files are cleaned up. Another one kills jb right away.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		stop()
+	}()
+
+	ctx := sigCtx
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
 	switch command {
 	case initCmd.FullCommand():
 		return initCommand(workdir)
 	case installCmd.FullCommand():
-		return installCommand(workdir, cfg.JsonnetHome, *installCmdURIs, *installCmdSingle, *installCmdLegacyName)
+		return installCommand(ctx, workdir, cfg.JsonnetHome, *installCmdURIs, *installCmdSingle, *installCmdLegacyName)
 	case updateCmd.FullCommand():
-		return updateCommand(workdir, cfg.JsonnetHome, *updateCmdURIs)
+		return updateCommand(ctx, workdir, cfg.JsonnetHome, *updateCmdURIs)
 	case rewriteCmd.FullCommand():
 		return rewriteCommand(workdir, cfg.JsonnetHome)
+	case whyCmd.FullCommand():
+		return whyCommand(os.Stdout, workdir, cfg.JsonnetHome, *whyCmdName)
+	case graphCmd.FullCommand():
+		return graphCommand(os.Stdout, workdir, cfg.JsonnetHome, *graphCmdFormat)
+	case outdatedCmd.FullCommand():
+		return outdatedCommand(ctx, os.Stdout, workdir, cfg.JsonnetHome, *outdatedCmdJSON)
+	case tidyCmd.FullCommand():
+		return tidyCommand(ctx, workdir, cfg.JsonnetHome, *tidyCmdDryRun)
+	case verifyCmd.FullCommand():
+		return verifyCommand(workdir, cfg.JsonnetHome)
+	case serveCmd.FullCommand():
+		return serveCommand(ctx, *serveCmdListen)
+	case downloadCmd.FullCommand():
+		return downloadCommand(ctx, workdir, *downloadCmdURIs)
 	default:
-		installCommand(workdir, cfg.JsonnetHome, []string{}, false, "")
+		installCommand(ctx, workdir, cfg.JsonnetHome, []string{}, false, "")
 	}
 
 	return 0
@@ -0,0 +1,91 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+)
+
+func outdatedCommand(ctx context.Context, w io.Writer, dir, jsonnetHome string, asJSON bool) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	jsonnetFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.File))
+	kingpin.FatalIfError(err, "failed to load jsonnetfile")
+
+	lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+	kingpin.FatalIfError(err, "failed to load lockfile")
+
+	outdated, err := pkg.Outdated(ctx, jsonnetFile, filepath.Join(dir, jsonnetHome), lockFile.Dependencies)
+	kingpin.FatalIfError(err, "checking for updates")
+
+	if asJSON {
+		if outdated == nil {
+			outdated = []pkg.OutdatedPackage{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		kingpin.FatalIfError(enc.Encode(outdated), "encoding json")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tLOCKED\tBRANCH\tHEAD\tLATEST\tUPDATE")
+	for _, o := range outdated {
+		if o.Error != "" {
+			color.Yellow("WARN: cannot query upstream of %s: %s", o.Name, o.Error)
+		}
+
+		locked := short(o.Locked)
+		if o.LockedTag != "" {
+			locked = o.LockedTag
+		}
+
+		update := ""
+		if o.Update {
+			update = "yes"
+		}
+
+		name := o.Name
+		if !o.Direct {
+			name += " (indirect)"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, o.Version, locked, o.Branch, short(o.Head), o.Latest, update)
+	}
+	kingpin.FatalIfError(tw.Flush(), "")
+
+	return 0
+}
+
+// short abbreviates a commit hash
+func short(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
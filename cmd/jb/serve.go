@@ -0,0 +1,45 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/fatih/color"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+)
+
+func serveCommand(ctx context.Context, listen string) int {
+	handler, err := pkg.NewProxyServer()
+	kingpin.FatalIfError(err, "")
+
+	srv := &http.Server{Addr: listen, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	color.Green("Serving packages of %s on %s", pkg.CacheDir, listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		kingpin.FatalIfError(err, "serving packages")
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+)
+
+func tidyCommand(ctx context.Context, dir, jsonnetHome string, dryRun bool) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	jbfilebytes, err := ioutil.ReadFile(filepath.Join(dir, jsonnetfile.File))
+	kingpin.FatalIfError(err, "failed to load jsonnetfile")
+
+	jsonnetFile, err := jsonnetfile.Unmarshal(jbfilebytes)
+	kingpin.FatalIfError(err, "")
+
+	jblockfilebytes, err := ioutil.ReadFile(filepath.Join(dir, jsonnetfile.LockFile))
+	if err != nil {
+		kingpin.Fatalf("Failed to load lockFile: %s.\nThe locks are required to map imports to packages. Make sure to run `jb install` first.", err)
+	}
+
+	lockFile, err := jsonnetfile.Unmarshal(jblockfilebytes)
+	kingpin.FatalIfError(err, "")
+
+	vendorDir := filepath.Join(dir, jsonnetHome)
+	report, err := pkg.Tidy(dir, jsonnetFile, vendorDir, lockFile.Dependencies)
+	kingpin.FatalIfError(err, "reading imports")
+
+	for _, u := range report.Unresolved {
+		name, err := filepath.Rel(dir, u.File)
+		if err != nil {
+			name = u.File
+		}
+		color.Yellow("WARN: %s:%d: %s '%s' does not belong to any dependency", name, u.Line, u.Keyword, u.Path)
+	}
+
+	for _, d := range report.Unused {
+		color.Magenta("REMOVE %s", d.Name())
+		jsonnetFile.Dependencies.Delete(d.Name())
+	}
+	for _, d := range report.Missing {
+		color.Green("ADD %s@%s", d.Name(), d.Version)
+		jsonnetFile.Dependencies.Set(d.Name(), d)
+	}
+
+	if dryRun || len(report.Unused)+len(report.Missing) == 0 {
+		return 0
+	}
+
+	locked, err := pkg.Ensure(ctx, jsonnetFile, vendorDir, lockFile.Dependencies)
+	kingpin.FatalIfError(err, "failed to install packages")
+
+	kingpin.FatalIfError(
+		writeChangedJsonnetFile(jbfilebytes, &jsonnetFile, filepath.Join(dir, jsonnetfile.File)),
+		"updating jsonnetfile.json")
+
+	kingpin.FatalIfError(
+		writeChangedJsonnetFile(jblockfilebytes, &v1.JsonnetFile{Dependencies: locked}, filepath.Join(dir, jsonnetfile.LockFile)),
+		"updating jsonnetfile.lock.json")
+
+	return 0
+}
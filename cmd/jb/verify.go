@@ -0,0 +1,55 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+)
+
+func verifyCommand(dir, jsonnetHome string) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+	kingpin.FatalIfError(err, "failed to load lockfile")
+
+	vendorDir := filepath.Join(dir, jsonnetHome)
+	problems, err := pkg.Verify(vendorDir, lockFile.Dependencies)
+	kingpin.FatalIfError(err, "verifying")
+
+	for _, p := range problems {
+		switch p.Kind {
+		case pkg.VerifyMissing:
+			color.Red("MISSING %s", p.Name)
+		case pkg.VerifyMismatch:
+			color.Red("MISMATCH %s: expected %s, got %s", p.Name, p.Expected, p.Actual)
+		case pkg.VerifyUnknown:
+			color.Red("UNKNOWN %s", filepath.Join(vendorDir, p.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		kingpin.Errorf("%s does not match %s", jsonnetHome, jsonnetfile.LockFile)
+		return 1
+	}
+	return 0
+}
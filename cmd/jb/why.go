@@ -0,0 +1,54 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+)
+
+func whyCommand(w io.Writer, dir, jsonnetHome, name string) int {
+	if dir == "" {
+		dir = "."
+	}
+
+	jsonnetFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.File))
+	kingpin.FatalIfError(err, "failed to load jsonnetfile")
+
+	lockFile, err := jsonnetfile.Load(filepath.Join(dir, jsonnetfile.LockFile))
+	kingpin.FatalIfError(err, "failed to load lockfile")
+
+	graph, err := pkg.LoadGraph(jsonnetFile, filepath.Join(dir, jsonnetHome), lockFile.Dependencies)
+	kingpin.FatalIfError(err, "reading vendored jsonnetfiles")
+
+	name = strings.TrimSuffix(filepath.ToSlash(name), "/")
+	paths := graph.Paths(name)
+	if len(paths) == 0 {
+		kingpin.Errorf("%s is not required by this project", name)
+		return 1
+	}
+
+	for _, p := range paths {
+		fmt.Fprintln(w, strings.Join(p, " -> "))
+	}
+	return 0
+}
@@ -0,0 +1,381 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+type ArchivePackage struct {
+	Source *deps.Archive
+}
+
+func NewArchivePackage(source *deps.Archive) Interface {
+	return &ArchivePackage{
+		Source: source,
+	}
+}
+
+// Install downloads the archive, verifies its checksum and extracts it to
+// dir/name. The sha256 of the archive is returned as the lock version.
+func (p *ArchivePackage) Install(ctx context.Context, name, dir, version string) (string, error) {
+	u, err := url.Parse(p.Source.URL)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing archive url")
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Join(dir, ".tmp"), "archive-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var file string
+	switch u.Scheme {
+	case "file":
+		file = filepath.FromSlash(u.Path)
+	case "http", "https":
+		if Offline {
+			return "", errOffline
+		}
+
+		file = tmpDir + ".archive"
+		defer os.Remove(file)
+		err := withRetry(ctx, func() error {
+			return downloadArchive(ctx, file, p.Source.URL)
+		})
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported archive url '%s', must be https://, http:// or file://", p.Source.URL)
+	}
+
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case p.Source.SHA256 == "":
+		printf(ctx, color.FgYellow, "WARN: archive %s is not pinned, its sha256 is %s", p.Source.URL, sum)
+	case !strings.EqualFold(p.Source.SHA256, sum):
+		return "", fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", p.Source.URL, p.Source.SHA256, sum)
+	}
+
+	extracted := filepath.Join(tmpDir, "pkg")
+	if err := extractArchive(file, extracted, p.Source.StripComponents, strings.Trim(p.Source.Subdir, "/")); err != nil {
+		return "", errors.Wrapf(err, "extracting %s", p.Source.URL)
+	}
+
+	if err := movePackage(extracted, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// movePackage moves the extracted package to destPath, replacing what was
+// there before
+func movePackage(extracted, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return errors.Wrap(err, "failed to create parent path")
+	}
+	if err := os.RemoveAll(destPath); err != nil {
+		return errors.Wrap(err, "failed to clean previous destination path")
+	}
+	if err := os.Rename(extracted, destPath); err != nil {
+		return errors.Wrap(err, "failed to move package")
+	}
+	return nil
+}
+
+// archiveResolve pins archives to their checksum, which is the lock version
+func archiveResolve(ctx context.Context, spec deps.Spec, version string) (Resolution, error) {
+	return Resolution{Version: version, Pinned: strings.ToLower(spec.(*deps.Archive).SHA256)}, nil
+}
+
+// archiveLockSatisfies requires the lock to be of the same archive. A checksum
+// given in the jsonnetfile must match the locked one.
+func archiveLockSatisfies(d, l deps.Dependency) bool {
+	a := d.Source.ArchiveSource
+	la := l.Upstream().Source.ArchiveSource
+	if la == nil {
+		return false
+	}
+
+	x, y := *a, *la
+	x.SHA256, y.SHA256 = "", ""
+	return x == y && (a.SHA256 == "" || strings.EqualFold(a.SHA256, l.Version))
+}
+
+// fileSHA256 returns the hex encoded sha256 of the file
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractArchive extracts the .tar.gz, .tar or .zip file to dst. The format is
+// detected from the contents. strip leading path components are removed from
+// all entries, then only the entries below subdir are extracted.
+func extractArchive(file, dst string, strip int, subdir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	x := &extractor{dst: dst, strip: strip, subdir: subdir}
+
+	magic, err := bufio.NewReader(f).Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		if err := x.tar(gzr); err != nil {
+			return err
+		}
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := x.zip(f, info.Size()); err != nil {
+			return err
+		}
+	default:
+		if err := x.tar(f); err != nil {
+			return err
+		}
+	}
+
+	if !x.found {
+		if subdir != "" {
+			return fmt.Errorf("subdir '%s' not found in archive", subdir)
+		}
+		return errors.New("archive is empty")
+	}
+	return nil
+}
+
+// extractor writes archive entries below dst
+type extractor struct {
+	dst    string
+	strip  int
+	subdir string
+	// found is set once an entry was extracted
+	found bool
+}
+
+// target returns the path of the archive entry below dst. ok is false for
+// entries to skip. Entries cannot escape dst, as the name is cleaned first.
+func (x *extractor) target(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "", false
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) <= x.strip {
+		return "", false
+	}
+	rel := path.Join(parts[x.strip:]...)
+
+	if x.subdir != "" {
+		if rel != x.subdir && !strings.HasPrefix(rel, x.subdir+"/") {
+			return "", false
+		}
+		rel = strings.TrimPrefix(strings.TrimPrefix(rel, x.subdir), "/")
+	}
+
+	x.found = true
+	return filepath.Join(x.dst, filepath.FromSlash(rel)), true
+}
+
+// through returns an error if writing to target would follow a symlink
+// extracted before, either at target itself or at one of its parents below
+// dst. Each link is checked on its own, so chains of them could otherwise
+// lead outside of dst.
+func (x *extractor) through(target string) error {
+	rel, err := filepath.Rel(x.dst, target)
+	if err != nil {
+		return err
+	}
+
+	p := x.dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("entry %s would be written through the symlink %s", target, p)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) dir(target string) error {
+	if err := x.through(target); err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+func (x *extractor) file(target string, mode os.FileMode, r io.Reader) error {
+	if err := x.through(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// symlink creates a symlink, unless it points outside of dst
+func (x *extractor) symlink(target, link string) error {
+	rel, err := filepath.Rel(x.dst, filepath.Join(filepath.Dir(target), link))
+	if filepath.IsAbs(link) || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symlink %s points outside of the package: %s", target, link)
+	}
+	if err := x.through(target); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(link, target)
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, ok := x.target(header.Name)
+		if !ok {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(target)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.file(target, os.FileMode(header.Mode), tr)
+		case tar.TypeSymlink:
+			err = x.symlink(target, header.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		target, ok := x.target(f.Name)
+		if !ok {
+			continue
+		}
+
+		err := func() error {
+			mode := f.Mode()
+			if mode.IsDir() {
+				return x.dir(target)
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			if mode&os.ModeSymlink != 0 {
+				link, err := ioutil.ReadAll(rc)
+				if err != nil {
+					return err
+				}
+				return x.symlink(target, string(link))
+			}
+			return x.file(target, mode, rc)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
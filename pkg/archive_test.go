@@ -0,0 +1,307 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// archiveEntry is a file of a test archive. Entries with a link are symlinks.
+type archiveEntry struct {
+	name, content, link string
+}
+
+var testArchiveEntries = []archiveEntry{
+	{name: "foo-1.0/README.md", content: "readme"},
+	{name: "foo-1.0/lib/foo/main.libsonnet", content: "{}"},
+	{name: "foo-1.0/lib/foo/alias.libsonnet", link: "main.libsonnet"},
+}
+
+func makeTar(t *testing.T, entries []archiveEntry, compress bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+
+	for _, e := range entries {
+		if e.link != "" {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.link, Mode: 0777}))
+			continue
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		content := e.content
+		if e.link != "" {
+			h.SetMode(os.ModeSymlink | 0777)
+			content = e.link
+		} else {
+			h.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(h)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func installArchive(t *testing.T, a *deps.Archive) (string, string, error) {
+	t.Helper()
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	sum, err := NewArchivePackage(a).Install(context.TODO(), "foo", vendorDir, "")
+	return filepath.Join(vendorDir, "foo"), sum, err
+}
+
+func writeArchive(t *testing.T, name string, data []byte) (url, sum string) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(file, data, 0644))
+	sum, err := fileSHA256(file)
+	require.NoError(t, err)
+	return "file://" + filepath.ToSlash(file), sum
+}
+
+func TestArchiveFormats(t *testing.T) {
+	archives := map[string][]byte{
+		"foo.tar.gz": makeTar(t, testArchiveEntries, true),
+		"foo.tar":    makeTar(t, testArchiveEntries, false),
+		"foo.zip":    makeZip(t, testArchiveEntries),
+	}
+
+	for name, data := range archives {
+		t.Run(name, func(t *testing.T) {
+			url, sum := writeArchive(t, name, data)
+
+			dir, got, err := installArchive(t, &deps.Archive{URL: url, SHA256: sum, StripComponents: 1, Subdir: "lib/foo"})
+			require.NoError(t, err)
+			assert.Equal(t, sum, got)
+
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, files, 2)
+
+			link, err := os.Readlink(filepath.Join(dir, "alias.libsonnet"))
+			require.NoError(t, err)
+			assert.Equal(t, "main.libsonnet", link)
+			assert.Equal(t, "{}", readMain(t, dir))
+		})
+	}
+}
+
+func TestArchiveStrip(t *testing.T) {
+	url, sum := writeArchive(t, "foo.tar.gz", makeTar(t, testArchiveEntries, true))
+
+	dir, _, err := installArchive(t, &deps.Archive{URL: url, SHA256: sum})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "foo-1.0", "README.md"))
+	assert.NoError(t, err)
+
+	_, _, err = installArchive(t, &deps.Archive{URL: url, SHA256: sum, StripComponents: 1, Subdir: "missing"})
+	assert.EqualError(t, err, "extracting "+url+": subdir 'missing' not found in archive")
+}
+
+func TestArchiveChecksum(t *testing.T) {
+	url, sum := writeArchive(t, "foo.tar.gz", makeTar(t, testArchiveEntries, true))
+
+	dir, _, err := installArchive(t, &deps.Archive{URL: url, SHA256: "0000000000000000000000000000000000000000000000000000000000000000"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// not pinned
+	_, got, err := installArchive(t, &deps.Archive{URL: url})
+	require.NoError(t, err)
+	assert.Equal(t, sum, got)
+}
+
+func TestArchiveHTTP(t *testing.T) {
+	data := makeTar(t, testArchiveEntries, true)
+	_, sum := writeArchive(t, "foo.tar.gz", data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir, _, err := installArchive(t, &deps.Archive{URL: srv.URL + "/foo.tar.gz", SHA256: sum, StripComponents: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "{}", readMain(t, dir))
+
+	Offline = true
+	defer func() { Offline = false }()
+	_, _, err = installArchive(t, &deps.Archive{URL: srv.URL + "/foo.tar.gz", SHA256: sum})
+	assert.Equal(t, errOffline, err)
+}
+
+func TestArchiveUnsafe(t *testing.T) {
+	// entries are kept inside of the package
+	url, sum := writeArchive(t, "evil.tar", makeTar(t, []archiveEntry{{name: "../../evil.libsonnet", content: "{}"}}, false))
+	dir, _, err := installArchive(t, &deps.Archive{URL: url, SHA256: sum})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "evil.libsonnet"))
+	assert.NoError(t, err)
+
+	// symlinks may not point outside
+	for _, link := range []string{"../../../etc/passwd", "/etc/passwd"} {
+		url, sum := writeArchive(t, "evil.tar", makeTar(t, []archiveEntry{{name: "pkg/passwd", link: link}}, false))
+		_, _, err := installArchive(t, &deps.Archive{URL: url, SHA256: sum})
+		assert.Error(t, err, link)
+	}
+
+	// nor may chains of symlinks, each pointing inside on its own
+	chained := []archiveEntry{
+		{name: "a", link: "."},
+		{name: "a/b", link: ".."},
+		{name: "b/evil.libsonnet", content: "{}"},
+	}
+	file := filepath.Join(t.TempDir(), "evil.tar")
+	require.NoError(t, ioutil.WriteFile(file, makeTar(t, chained, false), 0644))
+	parent := t.TempDir()
+	err = extractArchive(file, filepath.Join(parent, "pkg"), 0, "")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(parent, "evil.libsonnet"))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestProxyArchiveUnsafe(t *testing.T) {
+	var entries []archiveEntry
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeTar(t, entries, true))
+	}))
+	defer srv.Close()
+	withProxy(t, srv.URL)
+
+	d := deps.Parse("", "github.com/foo/bar@"+proxyCommit1)
+	require.NotNil(t, d)
+	install := func() (string, error) {
+		vendorDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+		_, err := NewGitPackage(d.Source.GitSource).Install(context.TODO(), d.Name(), vendorDir, proxyCommit1)
+		return vendorDir, err
+	}
+
+	// entries are kept inside of the package
+	entries = []archiveEntry{
+		{name: "../evil", content: "{}"},
+		{name: "bar/../../evil", content: "{}"},
+		{name: "bar/main.libsonnet", content: "{}"},
+	}
+	vendorDir, err := install()
+	require.NoError(t, err)
+	for _, p := range []string{filepath.Join(vendorDir, "evil"), filepath.Join(vendorDir, ".tmp", "evil")} {
+		_, err = os.Stat(p)
+		assert.True(t, os.IsNotExist(err), p)
+	}
+
+	// symlinks may not point outside
+	entries = []archiveEntry{{name: "bar/passwd", link: "../../../etc/passwd"}}
+	_, err = install()
+	assert.Error(t, err)
+
+	// not even chained
+	entries = []archiveEntry{
+		{name: "bar/a", link: "."},
+		{name: "bar/a/b", link: ".."},
+		{name: "bar/b/evil", content: "{}"},
+	}
+	_, err = install()
+	assert.Error(t, err)
+}
+
+func TestLockSatisfiesArchive(t *testing.T) {
+	a := &deps.Archive{URL: "https://example.com/foo.tar.gz", SHA256: "abc"}
+	d := deps.Dependency{Source: deps.Source{ArchiveSource: a}}
+	l := deps.Dependency{Source: deps.Source{ArchiveSource: a}, Version: "abc"}
+	assert.True(t, lockSatisfies(d, l))
+
+	// not pinned in the jsonnetfile
+	unpinned := deps.Dependency{Source: deps.Source{ArchiveSource: &deps.Archive{URL: a.URL}}}
+	assert.True(t, lockSatisfies(unpinned, l))
+
+	changed := deps.Dependency{Source: deps.Source{ArchiveSource: &deps.Archive{URL: a.URL, SHA256: "def"}}}
+	assert.False(t, lockSatisfies(changed, l))
+
+	moved := deps.Dependency{Source: deps.Source{ArchiveSource: &deps.Archive{URL: "https://example.com/bar.tar.gz", SHA256: "abc", PackageName: d.Name()}}}
+	assert.False(t, lockSatisfies(moved, l))
+}
+
+func TestEnsureArchive(t *testing.T) {
+	url, sum := writeArchive(t, "foo.tar.gz", makeTar(t, testArchiveEntries, true))
+	d := deps.Dependency{Source: deps.Source{ArchiveSource: &deps.Archive{URL: url, SHA256: sum, StripComponents: 1, PackageName: "example.com/foo"}}}
+
+	direct := v1.New()
+	direct.Dependencies.Set(d.Name(), d)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	locks, err := Ensure(context.TODO(), direct, vendorDir, deps.NewOrdered())
+	require.NoError(t, err)
+
+	l, ok := locks.Get("example.com/foo")
+	require.True(t, ok)
+	assert.Equal(t, sum, l.Version)
+	assert.Equal(t, hashDir(filepath.Join(vendorDir, "example.com/foo")), l.Sum)
+
+	// the archive is not needed again while vendor/ is intact
+	require.NoError(t, os.Remove(filepath.FromSlash(url[len("file://"):])))
+	_, err = Ensure(context.TODO(), direct, vendorDir, locks)
+	require.NoError(t, err)
+}
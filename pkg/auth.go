@@ -0,0 +1,356 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Interactive allows git to prompt for credentials. Otherwise, e.g. in CI,
+// git fails right away if it has none.
+var Interactive = os.Getenv("CI") == "" && isTerminal(os.Stdin)
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// authEnvPrefix is the prefix of the environment variables holding the
+// credentials of a host, e.g. JB_AUTH_github.com or JB_AUTH_GITHUB_COM
+const authEnvPrefix = "JB_AUTH_"
+
+// authHint tells how to provide credentials
+const authHint = "set " + authEnvPrefix + "<host> to a token or user:password, add the host to ~/.netrc or configure a git credential helper"
+
+// credentials authenticate requests to a host. A token is a password without
+// a username.
+type credentials struct {
+	username string
+	password string
+	// source tells where the credentials were found, for error messages
+	source string
+}
+
+// header returns the value of the Authorization header. Tokens are sent as
+// bearer tokens.
+func (c credentials) header() string {
+	if c.username == "" {
+		return "Bearer " + c.password
+	}
+	return c.basic()
+}
+
+// gitHeader returns the value of the Authorization header for git, which
+// only uses basic authentication. GitHub, GitLab and Gitea accept tokens with
+// any username.
+func (c credentials) gitHeader() string {
+	if c.username == "" {
+		return credentials{username: "x-access-token", password: c.password}.basic()
+	}
+	return c.basic()
+}
+
+func (c credentials) basic() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+}
+
+var (
+	credentialsMu sync.Mutex
+	// credentialsCache holds the credentials of hosts looked up before, nil
+	// if there are none
+	credentialsCache = make(map[string]*credentials)
+)
+
+// lookupCredentials returns the credentials for the host, which may include
+// a port. They are taken from the environment (see authEnvPrefix), the netrc
+// file or git credential helpers, in this order.
+func lookupCredentials(ctx context.Context, host string) *credentials {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if c, ok := credentialsCache[host]; ok {
+		return c
+	}
+
+	c := envCredentials(host)
+	if c == nil {
+		c = netrcCredentials(host)
+	}
+	if c == nil {
+		c = helperCredentials(ctx, host)
+	}
+	if ctx.Err() == nil {
+		credentialsCache[host] = c
+	}
+	return c
+}
+
+// envCredentials reads the credentials of the host from the environment
+func envCredentials(host string) *credentials {
+	names := []string{authEnvPrefix + host, authEnvPrefix + envName(host)}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		names = append(names, authEnvPrefix+h, authEnvPrefix+envName(h))
+	}
+
+	for _, name := range names {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		c := &credentials{password: value, source: name}
+		if i := strings.Index(value, ":"); i >= 0 {
+			c.username, c.password = value[:i], value[i+1:]
+		}
+		return c
+	}
+	return nil
+}
+
+var envNameExp = regexp.MustCompile(`[^A-Z0-9]`)
+
+// envName turns the host into a valid name of a shell variable, e.g.
+// GITHUB_COM
+func envName(host string) string {
+	return envNameExp.ReplaceAllString(strings.ToUpper(host), "_")
+}
+
+// netrcCredentials reads the credentials of the host from $NETRC or ~/.netrc
+func netrcCredentials(host string) *credentials {
+	file := os.Getenv("NETRC")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		file = filepath.Join(home, ".netrc")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	c := parseNetrc(string(data), host)
+	if c == nil {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			c = parseNetrc(string(data), h)
+		}
+	}
+	if c != nil {
+		c.source = file
+	}
+	return c
+}
+
+// parseNetrc returns the login of the machine, falling back to the default
+func parseNetrc(data, machine string) *credentials {
+	type entry struct {
+		machine  string
+		def      bool
+		login    string
+		password string
+	}
+	var entries []*entry
+
+	macdef := false
+	for _, line := range strings.Split(data, "\n") {
+		// macro definitions end at an empty line
+		if macdef {
+			macdef = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			value := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+
+			switch fields[i] {
+			case "machine":
+				entries = append(entries, &entry{machine: value()})
+			case "default":
+				entries = append(entries, &entry{def: true})
+			case "login", "password", "account":
+				key := fields[i]
+				v := value()
+				if len(entries) == 0 {
+					continue
+				}
+				e := entries[len(entries)-1]
+				switch key {
+				case "login":
+					e.login = v
+				case "password":
+					e.password = v
+				}
+			case "macdef":
+				macdef = true
+				i = len(fields)
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if e.machine == machine {
+			return &credentials{username: e.login, password: e.password}
+		}
+	}
+	for _, e := range entries {
+		if e.def {
+			return &credentials{username: e.login, password: e.password}
+		}
+	}
+	return nil
+}
+
+// helperCredentials asks the git credential helpers of the user for
+// credentials of the host, without ever prompting
+func helperCredentials(ctx context.Context, host string) *credentials {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-c", "core.askPass=", "credential", "fill")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	c := &credentials{source: "git credential helper"}
+	s := bufio.NewScanner(strings.NewReader(string(out)))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "username":
+			c.username = parts[1]
+		case "password":
+			c.password = parts[1]
+		}
+	}
+	if c.password == "" {
+		return nil
+	}
+	return c
+}
+
+// authorize adds the credentials of the host to the request, if any (see
+// sendCredentials). git selects basic authentication.
+func authorize(ctx context.Context, req *http.Request, git bool) *credentials {
+	if !sendCredentials(req.URL) {
+		return nil
+	}
+
+	c := lookupCredentials(ctx, req.URL.Host)
+	if c == nil {
+		return nil
+	}
+
+	if git {
+		req.Header.Set("Authorization", c.gitHeader())
+	} else {
+		req.Header.Set("Authorization", c.header())
+	}
+	return c
+}
+
+// sendCredentials reports whether credentials may be sent to the URL, i.e.
+// it uses https or points to the local machine
+func sendCredentials(u *url.URL) bool {
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		ip := net.ParseIP(u.Hostname())
+		return u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return false
+}
+
+// authFailed explains 401 and 403 responses to requests authorized using c
+func authFailed(err error, host string, c *credentials) error {
+	var he *HTTPError
+	if !errors.As(err, &he) || (he.StatusCode != http.StatusUnauthorized && he.StatusCode != http.StatusForbidden) {
+		return err
+	}
+
+	if c == nil {
+		return fmt.Errorf("%w: authentication required for %s: %s", err, host, authHint)
+	}
+	return fmt.Errorf("%w: the credentials for %s from %s were rejected", err, host, c.source)
+}
+
+// gitEnv returns the environment to run git with for the remote. Unless
+// Interactive, git never prompts for credentials. Credentials from the
+// environment are passed on, git itself reads netrc and its credential
+// helpers.
+func gitEnv(remote string) []string {
+	env := os.Environ()
+	if !Interactive {
+		env = append(env, "GIT_TERMINAL_PROMPT=0")
+	}
+
+	u, err := url.Parse(remote)
+	if err != nil || !sendCredentials(u) {
+		return env
+	}
+	c := envCredentials(u.Host)
+	if c == nil {
+		return env
+	}
+
+	// appended to the configuration given by the user, see git-config(1)
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	return append(env,
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.%s.extraHeader", n, remote),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: %s", n, c.gitHeader()),
+	)
+}
+
+// gitStdin is the stdin of git, which it may prompt on if Interactive
+func gitStdin() io.Reader {
+	if Interactive {
+		return os.Stdin
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withCredentials isolates the test from the credentials of the user
+func withCredentials(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	old := Interactive
+	Interactive = false
+	credentialsCache = make(map[string]*credentials)
+	t.Cleanup(func() {
+		Interactive = old
+		credentialsCache = make(map[string]*credentials)
+	})
+}
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `
+machine example.com login foo password bar
+macdef init
+machine fake.example.com login nope
+
+machine git.example.com
+	login user
+	password secret
+default login anonymous password guest
+`
+
+	assert.Equal(t, &credentials{username: "foo", password: "bar"}, parseNetrc(netrc, "example.com"))
+	assert.Equal(t, &credentials{username: "user", password: "secret"}, parseNetrc(netrc, "git.example.com"))
+	assert.Equal(t, &credentials{username: "anonymous", password: "guest"}, parseNetrc(netrc, "fake.example.com"))
+	assert.Nil(t, parseNetrc("machine example.com login foo", "example.org"))
+}
+
+func TestLookupCredentials(t *testing.T) {
+	withCredentials(t)
+	ctx := context.TODO()
+
+	t.Setenv("JB_AUTH_github.com", "token")
+	t.Setenv("JB_AUTH_GIT_EXAMPLE_COM", "user:pass")
+	netrc := os.Getenv("NETRC")
+	require.NoError(t, ioutil.WriteFile(netrc, []byte("machine netrc.example.com login foo password bar"), 0600))
+
+	// git credential helpers are asked last
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "credential.helper")
+	t.Setenv("GIT_CONFIG_VALUE_0", `!f() { test "$1" = get && echo username=helper && echo password=secret; }; f`)
+
+	tests := []struct {
+		host string
+		want *credentials
+	}{
+		{host: "github.com", want: &credentials{password: "token", source: "JB_AUTH_github.com"}},
+		{host: "git.example.com:8443", want: &credentials{username: "user", password: "pass", source: "JB_AUTH_GIT_EXAMPLE_COM"}},
+		{host: "netrc.example.com", want: &credentials{username: "foo", password: "bar", source: netrc}},
+		{host: "other.example.com", want: &credentials{username: "helper", password: "secret", source: "git credential helper"}},
+	}
+	for _, c := range tests {
+		assert.Equal(t, c.want, lookupCredentials(ctx, c.host), c.host)
+	}
+
+	assert.Equal(t, "Bearer token", tests[0].want.header())
+	assert.Equal(t, "Basic eC1hY2Nlc3MtdG9rZW46dG9rZW4=", tests[0].want.gitHeader())
+	assert.Equal(t, "Basic dXNlcjpwYXNz", tests[1].want.header())
+}
+
+func TestDownloadArchiveAuth(t *testing.T) {
+	withCredentials(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("archive"))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "archive.tar.gz")
+	err := downloadArchive(context.TODO(), file, srv.URL+"/foo.tar.gz")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "authentication required for "+strings.TrimPrefix(srv.URL, "http://"))
+
+	// credentials of the host apply to all ports
+	t.Setenv("JB_AUTH_127_0_0_1", "token")
+	credentialsCache = make(map[string]*credentials)
+	require.NoError(t, downloadArchive(context.TODO(), file, srv.URL+"/foo.tar.gz"))
+}
+
+func TestGitAuth(t *testing.T) {
+	withCredentials(t)
+	root, repo := testBareRepo(t, true, "v1.0.0")
+	backend := testGitServer(t, root, false).Config.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || pass != "token" || user == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	remote := srv.URL + "/foo/bar.git"
+
+	for _, name := range GitBackendNames() {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("JB_AUTH_127_0_0_1", "")
+			credentialsCache = make(map[string]*credentials)
+			_, err := GitBackends[name].ListRefs(context.TODO(), remote)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), authHint)
+
+			t.Setenv("JB_AUTH_127_0_0_1", "token")
+			credentialsCache = make(map[string]*credentials)
+			refs, err := GitBackends[name].ListRefs(context.TODO(), remote)
+			require.NoError(t, err)
+			assert.Equal(t, revParse(t, repo, "v1.0.0"), refs["refs/tags/v1.0.0"])
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// CacheDir is the package cache shared by all projects. Packages are stored by
+// their content sum and indexed by their source and pinned version, such as
+// the remote, subdir and commit of git packages, so vendor/ can be populated
+// without network access whenever a locked version was fetched before. An
+// empty CacheDir disables the cache.
+var CacheDir = defaultCacheDir()
+
+// defaultCacheDir returns jb/ in the user's cache directory, which is
+// $XDG_CACHE_HOME or ~/.cache on Linux
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "jb")
+}
+
+var commitPattern = regexp.MustCompile("^[0-9a-f]{40,}$")
+
+// isCommit returns whether the version is a full commit hash
+func isCommit(version string) bool {
+	return commitPattern.MatchString(version)
+}
+
+// cacheSumDir returns the directory holding the package contents of the sum
+func cacheSumDir(sum string) string {
+	key := hex.EncodeToString([]byte(sum))
+	if b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sum, sumPrefix)); err == nil {
+		key = hex.EncodeToString(b)
+	}
+	return filepath.Join(CacheDir, "sum", key)
+}
+
+// cacheRepoKey identifies the repository of the remote. Remotes of the same
+// repository using different protocols share their cache entries.
+func cacheRepoKey(remote string) string {
+	if p, ok := ProxyRepoPath(remote); ok {
+		return p
+	}
+	return remote
+}
+
+// cacheCommitFile returns the index file that records the sum of the pinned
+// version of the spec, e.g. a git commit
+func cacheCommitFile(spec deps.Spec, pinned string) string {
+	var key string
+	switch s := spec.(type) {
+	case *deps.Git:
+		key = cacheRepoKey(s.Remote()) + "\x00" + strings.Trim(s.Subdir, "/")
+	default:
+		data, _ := json.Marshal(spec)
+		key = fmt.Sprintf("%T\x00%s", spec, data)
+	}
+
+	h := sha256.Sum256([]byte(key + "\x00" + pinned))
+	return filepath.Join(CacheDir, "commit", hex.EncodeToString(h[:]))
+}
+
+// cacheRefsFile returns the file holding the last known refs of the remote
+func cacheRefsFile(remote string) string {
+	h := sha256.Sum256([]byte(cacheRepoKey(remote)))
+	return filepath.Join(CacheDir, "refs", hex.EncodeToString(h[:]))
+}
+
+// cacheStoreRefs records the refs of the remote, so they can be served by a
+// proxy without network access
+func cacheStoreRefs(remote string, refs map[string]string) error {
+	if CacheDir == "" {
+		return nil
+	}
+
+	file := cacheRefsFile(remote)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(formatRefs(refs)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// cacheLoadRefs returns the refs of the remote recorded by cacheStoreRefs
+func cacheLoadRefs(remote string) (map[string]string, bool) {
+	if CacheDir == "" {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(cacheRefsFile(remote))
+	if err != nil {
+		return nil, false
+	}
+	return parseRefs(data), true
+}
+
+// cacheLookup returns the sum of the pinned version of the spec, such as a
+// commit of a git source, if cached
+func cacheLookup(spec deps.Spec, pinned string) (sum string, ok bool) {
+	if CacheDir == "" || pinned == "" {
+		return "", false
+	}
+
+	data, err := ioutil.ReadFile(cacheCommitFile(spec, pinned))
+	if err != nil {
+		return "", false
+	}
+	sum = strings.TrimSpace(string(data))
+	return sum, sum != ""
+}
+
+// cacheRestore copies the package of the sum from the cache to dest. Entries
+// whose contents no longer match their sum are evicted.
+func cacheRestore(sum, dest string) bool {
+	if CacheDir == "" || sum == "" {
+		return false
+	}
+
+	src := cacheSumDir(sum)
+	if _, err := os.Stat(src); err != nil {
+		return false
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return false
+	}
+	if err := copyDir(src, dest); err != nil {
+		os.RemoveAll(dest)
+		return false
+	}
+
+	if sumLike(dest, sum) != sum {
+		os.RemoveAll(dest)
+		os.RemoveAll(src)
+		return false
+	}
+	return true
+}
+
+// cacheStore adds the package in dir to the cache, under its sum and the
+// pinned version of the spec
+func cacheStore(spec deps.Spec, pinned, sum, dir string) error {
+	if CacheDir == "" || sum == "" {
+		return nil
+	}
+
+	dest := cacheSumDir(sum)
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+
+		// copy to a temporary location first, so concurrent readers never see
+		// partial contents
+		tmp, err := ioutil.TempDir(filepath.Dir(dest), ".tmp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := copyDir(dir, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			// fine if someone else was faster
+			if _, statErr := os.Stat(dest); statErr != nil {
+				return err
+			}
+		}
+	}
+
+	if spec == nil || pinned == "" {
+		return nil
+	}
+
+	index := cacheCommitFile(spec, pinned)
+	if err := os.MkdirAll(filepath.Dir(index), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(index, []byte(sum+"\n"), 0644)
+}
+
+// copyDir recursively copies src to dst, keeping file modes and symlinks
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// withCache points CacheDir to a temporary directory for the test
+func TestMain(m *testing.M) {
+	// keep the cache of the user out of tests, unless they ask for one
+	CacheDir = ""
+	os.Exit(m.Run())
+}
+
+func withCache(t *testing.T) string {
+	t.Helper()
+
+	old := CacheDir
+	CacheDir = t.TempDir()
+	t.Cleanup(func() { CacheDir = old })
+	return CacheDir
+}
+
+func TestCache(t *testing.T) {
+	withCache(t)
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "main.libsonnet"), []byte(`{}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "run.sh"), []byte(`#!/bin/sh`), 0755))
+	require.NoError(t, os.Symlink("main.libsonnet", filepath.Join(src, "link.libsonnet")))
+	sum := hashDir(src)
+
+	source := gitDep("grafonnet-lib", "").Source.GitSource
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+
+	_, ok := cacheLookup(source, commit)
+	assert.False(t, ok)
+
+	require.NoError(t, cacheStore(source, commit, sum, src))
+	// storing twice is fine
+	require.NoError(t, cacheStore(source, commit, sum, src))
+
+	got, ok := cacheLookup(source, commit)
+	require.True(t, ok)
+	assert.Equal(t, sum, got)
+
+	// only full commits are looked up
+	_, ok = cacheLookup(source, "master")
+	assert.False(t, ok)
+
+	dest := filepath.Join(t.TempDir(), "vendor", "github.com", "grafana", "grafonnet-lib")
+	require.True(t, cacheRestore(sum, dest))
+	assert.Equal(t, sum, hashDir(dest))
+
+	info, err := os.Stat(filepath.Join(dest, "sub", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	link, err := os.Readlink(filepath.Join(dest, "link.libsonnet"))
+	require.NoError(t, err)
+	assert.Equal(t, "main.libsonnet", link)
+
+	// corrupted entries are evicted
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cacheSumDir(sum), "main.libsonnet"), []byte(`"corrupt"`), 0644))
+	assert.False(t, cacheRestore(sum, dest))
+	_, err = os.Stat(cacheSumDir(sum))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dest)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheDisabled(t *testing.T) {
+	old := CacheDir
+	CacheDir = ""
+	defer func() { CacheDir = old }()
+
+	src := t.TempDir()
+	require.NoError(t, cacheStore(nil, "", hashDir(src), src))
+	assert.False(t, cacheRestore(hashDir(src), filepath.Join(t.TempDir(), "pkg")))
+}
+
+// TestResolverCache checks that a locked package missing from vendor/ is
+// restored from the cache, without downloading it
+func TestResolverCache(t *testing.T) {
+	withCache(t)
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	l := vendorPackage(t, vendorDir, grafonnet, "v1.0.0")
+	dir := filepath.Join(vendorDir, grafonnet.Name())
+	require.NoError(t, cacheStore(grafonnet.Source.GitSource, l.Version, l.Sum, dir))
+	require.NoError(t, os.RemoveAll(dir))
+
+	locks := deps.NewOrdered()
+	locks.Set(grafonnet.Name(), l)
+
+	direct := deps.NewOrdered()
+	direct.Set(grafonnet.Name(), grafonnet)
+
+	got, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+
+	gl, _ := got.Get(grafonnet.Name())
+	assert.Equal(t, l, gl)
+	assert.True(t, check(gl, vendorDir))
+}
+
+func TestResolverOffline(t *testing.T) {
+	withCache(t)
+	Offline = true
+	defer func() { Offline = false }()
+
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "main")
+	tempo := gitDep("tempo", "^1.0.0")
+
+	// vendored
+	locks := deps.NewOrdered()
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.0.0"))
+
+	// cached only
+	l := vendorPackage(t, vendorDir, builder, "v1.0.0")
+	require.NoError(t, cacheStore(builder.Source.GitSource, l.Version, l.Sum, filepath.Join(vendorDir, builder.Name())))
+	require.NoError(t, os.RemoveAll(filepath.Join(vendorDir, builder.Name())))
+	locks.Set(builder.Name(), l)
+
+	direct := deps.NewOrdered()
+	for _, d := range []deps.Dependency{grafonnet, builder, loki, tempo} {
+		direct.Set(d.Name(), d)
+	}
+
+	_, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	var offline *OfflineError
+	require.True(t, errors.As(err, &offline), err)
+	assert.Equal(t, []Request{
+		{Requester: RootRequester, Version: "main", dep: loki},
+		{Requester: RootRequester, Version: "^1.0.0", dep: tempo},
+	}, offline.Missing)
+	assert.Contains(t, err.Error(), "github.com/grafana/loki@main, required by root")
+
+	assert.True(t, check(l, vendorDir))
+
+	// all present
+	direct.Delete(loki.Name())
+	direct.Delete(tempo.Name())
+	_, err = newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	assert.NoError(t, err)
+
+	// constraints are resolved against the cached refs
+	lt := vendorPackage(t, vendorDir, tempo, "v1.2.0")
+	require.NoError(t, cacheStore(tempo.Source.GitSource, lt.Version, lt.Sum, filepath.Join(vendorDir, tempo.Name())))
+	require.NoError(t, os.RemoveAll(filepath.Join(vendorDir, tempo.Name())))
+	require.NoError(t, cacheStoreRefs(tempo.Source.GitSource.Remote(), map[string]string{
+		"refs/tags/v1.2.0": lt.Version,
+		"refs/tags/v2.0.0": "fedcba9876543210fedcba9876543210fedcba98",
+	}))
+	direct.Set(tempo.Name(), tempo)
+	got, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	l, _ = got.Get(tempo.Name())
+	assert.Equal(t, "v1.2.0", l.Tag)
+	assert.Equal(t, lt.Version, l.Version)
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// RootRequester is used as the requester of dependencies declared in the
+// jsonnetfile.json of the project itself
+const RootRequester = "root"
+
+// ConflictPolicy decides what happens if multiple jsonnetfiles request
+// different versions of the same package, and these are not all semver tags
+type ConflictPolicy string
+
+const (
+	// ConflictFirst keeps the version that was requested closest to the root
+	// of the tree and prints a warning. Among requests of the same depth, the
+	// requester with the lowest name wins.
+	ConflictFirst ConflictPolicy = "first"
+	// ConflictFail returns a *MismatchError
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictRoot picks the version of the project's jsonnetfile.json. If
+	// it does not declare the package, the conflict is an error.
+	ConflictRoot ConflictPolicy = "root"
+)
+
+// ConflictPolicies lists all known policies
+var ConflictPolicies = []ConflictPolicy{ConflictFirst, ConflictFail, ConflictRoot}
+
+// Conflicts is the policy used by Ensure
+var Conflicts = ConflictFirst
+
+// Request is a single requirement of a package
+type Request struct {
+	// Requester is the name of the package whose jsonnetfile declares the
+	// requirement, or RootRequester
+	Requester string
+	// Version is the requested version
+	Version string
+
+	dep deps.Dependency
+	// absolute path of the requester, empty for the root
+	parent string
+}
+
+// Conflict lists all requests of a package that disagree on the version
+type Conflict struct {
+	Name     string
+	Requests []Request
+}
+
+func (c Conflict) String() string {
+	s := c.Name + ":"
+	for _, r := range c.Requests {
+		s += fmt.Sprintf("\n  - %s requires %s", r.Requester, r.Version)
+	}
+	return s
+}
+
+// MismatchError is returned if a conflict could not be resolved using the
+// configured ConflictPolicy. It matches VersionMismatch using errors.Is.
+type MismatchError struct {
+	Conflicts []Conflict
+}
+
+func (e *MismatchError) Error() string {
+	s := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		s = append(s, c.String())
+	}
+	return fmt.Sprintf("%s:\n%s", VersionMismatch, strings.Join(s, "\n"))
+}
+
+func (e *MismatchError) Is(target error) bool {
+	return target == VersionMismatch
+}
+
+// conflicting returns whether the requests disagree on the version
+func (c Conflict) conflicting() bool {
+	for _, r := range c.Requests[1:] {
+		if r.Version != c.Requests[0].Version {
+			return true
+		}
+	}
+	return false
+}
+
+// requests records every version requested for a package, in order of
+// discovery
+type requests map[string][]Request
+
+func (rs requests) add(requester, parent string, d deps.Dependency) {
+	for _, r := range rs[d.Name()] {
+		if r.Requester == requester && r.Version == d.Version {
+			return
+		}
+	}
+	rs[d.Name()] = append(rs[d.Name()], Request{Requester: requester, Version: d.Version, dep: d, parent: parent})
+}
+
+// resolve picks one of the conflicting requests according to the policy. ok
+// is false if the policy cannot decide.
+func (p ConflictPolicy) resolve(c Conflict) (chosen Request, ok bool) {
+	switch p {
+	case ConflictFirst:
+		return c.Requests[0], true
+	case ConflictRoot:
+		for _, r := range c.Requests {
+			if r.Requester == RootRequester {
+				return r, true
+			}
+		}
+	}
+
+	return Request{}, false
+}
+
+// isHigher reports whether a is a higher semantic version than b
+func isHigher(a, b string) bool {
+	va, err := semver.Parse(a)
+	if err != nil {
+		return false
+	}
+	vb, err := semver.Parse(b)
+	if err != nil {
+		return false
+	}
+	return vb.LessThan(va)
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+func gitDep(repo, version string) deps.Dependency {
+	return deps.Dependency{
+		Version: version,
+		Source: deps.Source{
+			GitSource: &deps.Git{
+				Scheme: deps.GitSchemeHTTPS,
+				Host:   "github.com",
+				User:   "grafana",
+				Repo:   repo,
+			},
+		},
+	}
+}
+
+func TestRequestsAdd(t *testing.T) {
+	rs := make(requests)
+	rs.add(RootRequester, "", gitDep("grafonnet-lib", "v1.0.0"))
+	rs.add(RootRequester, "", gitDep("jsonnet-libs", "master"))
+	rs.add("github.com/grafana/jsonnet-libs", "/vendor/github.com/grafana/jsonnet-libs", gitDep("grafonnet-lib", "v2.0.0"))
+	rs.add("github.com/grafana/jsonnet-libs", "/vendor/github.com/grafana/jsonnet-libs", gitDep("grafonnet-lib", "v2.0.0"))
+	rs.add("github.com/grafana/loki", "/vendor/github.com/grafana/loki", gitDep("jsonnet-libs", "master"))
+
+	grafonnet := Conflict{Name: "github.com/grafana/grafonnet-lib", Requests: rs["github.com/grafana/grafonnet-lib"]}
+	assert.True(t, grafonnet.conflicting())
+	assert.Equal(t, []Request{
+		{Requester: RootRequester, Version: "v1.0.0", dep: gitDep("grafonnet-lib", "v1.0.0")},
+		{Requester: "github.com/grafana/jsonnet-libs", Version: "v2.0.0", dep: gitDep("grafonnet-lib", "v2.0.0"), parent: "/vendor/github.com/grafana/jsonnet-libs"},
+	}, grafonnet.Requests)
+
+	libs := Conflict{Name: "github.com/grafana/jsonnet-libs", Requests: rs["github.com/grafana/jsonnet-libs"]}
+	assert.False(t, libs.conflicting())
+	assert.Len(t, libs.Requests, 2)
+}
+
+func TestConflictPolicyResolve(t *testing.T) {
+	conflict := func(versions ...string) Conflict {
+		c := Conflict{Name: "github.com/grafana/grafonnet-lib"}
+		for i, v := range versions {
+			requester := "github.com/grafana/jsonnet-libs"
+			if i == 0 {
+				requester = RootRequester
+			}
+			c.Requests = append(c.Requests, Request{Requester: requester, Version: v})
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		conflict Conflict
+		want     string
+		ok       bool
+	}{
+		{name: "first", policy: ConflictFirst, conflict: conflict("v1.0.0", "v2.0.0"), want: "v1.0.0", ok: true},
+		{name: "fail", policy: ConflictFail, conflict: conflict("v1.0.0", "v2.0.0"), ok: false},
+		{name: "root", policy: ConflictRoot, conflict: conflict("v2.0.0", "v1.0.0"), want: "v2.0.0", ok: true},
+	}
+
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := c.policy.resolve(c.conflict)
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.want, got.Version)
+		})
+	}
+
+	// root policy without a root requirement
+	c := conflict("v1.0.0", "v2.0.0")
+	c.Requests[0].Requester = "github.com/grafana/loki"
+	_, ok := ConflictRoot.resolve(c)
+	assert.False(t, ok)
+}
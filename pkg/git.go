@@ -15,9 +15,6 @@
 package pkg
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -26,7 +23,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -35,11 +31,16 @@ import (
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
 
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
 	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
 )
 
 type GitPackage struct {
 	Source *deps.Git
+	// Tree is the expected git tree of the package, e.g. from the lock. Host
+	// archives are checked against it instead of fetching the tree of the
+	// remote.
+	Tree string
 }
 
 func NewGitPackage(source *deps.Git) Interface {
@@ -50,21 +51,26 @@ func NewGitPackage(source *deps.Git) Interface {
 
 var GitQuiet = false
 
-func downloadGitHubArchive(filepath string, url string) error {
+func downloadArchive(ctx context.Context, filepath string, url string) error {
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
+	creds := authorize(ctx, req, false)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return networkError(ctx, err)
+	}
+	defer resp.Body.Close()
+
 	if !GitQuiet {
-		color.Cyan("GET %s %d", url, resp.StatusCode)
+		printf(ctx, color.FgCyan, "GET %s %d", url, resp.StatusCode)
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return authFailed(httpStatusError(resp), req.URL.Host, creds)
 	}
 
-	defer resp.Body.Close()
-
 	// Create the file
 	out, err := os.Create(filepath)
 	if err != nil {
@@ -75,111 +81,151 @@ func downloadGitHubArchive(filepath string, url string) error {
 	// Write the body to file
 	_, err = io.Copy(out, resp.Body)
 	if err != nil {
-		return err
+		return networkError(ctx, err)
 	}
 
 	return nil
 }
 
-func gzipUntar(dst string, r io.Reader, subDir string) error {
-	gzr, err := gzip.NewReader(r)
-	if err != nil {
-		return err
+// remoteListRefs returns the refs of the remote, such as HEAD, refs/heads/main
+// or refs/tags/v1.0.0, mapped to the commit they point to. Annotated tags are
+// peeled to their commit. The refs are taken from the first Proxy that knows
+// the remote, or from the cache when Offline.
+func remoteListRefs(ctx context.Context, remote string) (map[string]string, error) {
+	// offline, only the refs listed before are known
+	if Offline {
+		if refs, ok := cacheLoadRefs(remote); ok {
+			return refs, nil
+		}
+		return nil, errOffline
 	}
-	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	var refs map[string]string
+	err := viaProxies(ctx, func() (err error) {
+		refs, err = gitBackend().ListRefs(ctx, remote)
+		return err
+	}, func(c proxyClient) (err error) {
+		refs, err = c.listRefs(ctx, remote)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		header, err := tr.Next()
-		switch {
-		case err == io.EOF:
-			return nil
+	if err := cacheStoreRefs(remote, refs); err != nil {
+		printf(ctx, color.FgYellow, "WARN: failed to cache refs of %s: %s", remote, err)
+	}
+	return refs, nil
+}
 
-		case err != nil:
-			return err
+// remoteListTags returns all tags of the remote, mapped to the commit they
+// point to. Annotated tags are peeled to their commit.
+func remoteListTags(ctx context.Context, remote string) (map[string]string, error) {
+	refs, err := remoteListRefs(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
 
-		case header == nil:
-			continue
+	tags := make(map[string]string, len(refs))
+	for ref, sha := range refs {
+		if tag := strings.TrimPrefix(ref, "refs/tags/"); tag != ref {
+			tags[tag] = sha
 		}
+	}
+	return tags, nil
+}
 
-		// strip the two first components of the path
-		parts := strings.SplitAfterN(header.Name, "/", 2)
-		if len(parts) < 2 {
-			continue
-		}
-		suffix := parts[1]
-		prefix := dst
+// remoteResolveConstraint returns the highest tag of the remote that satisfies
+// the semver constraint, along with the commit it points to.
+func remoteResolveConstraint(ctx context.Context, remote string, constraint string) (tag string, commit string, err error) {
+	c, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		return "", "", err
+	}
 
-		// reconstruct the target parh for the archive entry
-		target := filepath.Join(prefix, suffix)
+	tags, err := remoteListTags(ctx, remote)
+	if err != nil {
+		return "", "", errors.Wrap(err, "listing tags")
+	}
 
-		// if subdir is provided and target is not under it, skip it
-		subDirPath := filepath.Join(prefix, subDir)
-		if subDir != "" && !strings.HasPrefix(target, subDirPath) {
-			continue
-		}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+
+	tag, ok := c.Highest(names)
+	if !ok {
+		return "", "", fmt.Errorf("no tag of %s satisfies `%s`", remote, constraint)
+	}
+
+	return tag, tags[tag], nil
+}
 
-		// check the file type
-		switch header.Typeflag {
-
-		// create directories as needed
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
-				return err
-			}
-
-			err := func() error {
-				f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-
-				// copy over contents
-				if _, err := io.Copy(f, tr); err != nil {
-					return err
-				}
-				return nil
-			}()
-
-			if err != nil {
-				return err
-			}
-
-		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
-				return err
-			}
-
-			if err := os.Symlink(header.Linkname, target); err != nil {
-				return err
-			}
+// gitResolve resolves semver constraints to the highest matching tag. The
+// commit of a tag is only known after fetching it.
+func gitResolve(ctx context.Context, spec deps.Spec, version string) (Resolution, error) {
+	switch {
+	case semver.IsConstraint(version):
+		tag, commit, err := remoteResolveConstraint(ctx, spec.(*deps.Git).Remote(), version)
+		if err != nil {
+			return Resolution{}, err
 		}
+		return Resolution{Version: tag, Tag: tag, Pinned: commit}, nil
+	case isTag(version):
+		return Resolution{Version: version, Tag: version}, nil
+	case isCommit(version):
+		return Resolution{Version: version, Pinned: version}, nil
 	}
+	return Resolution{Version: version}, nil
 }
 
-func remoteResolveRef(ctx context.Context, remote string, ref string) (string, error) {
-	b := &bytes.Buffer{}
-	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "--tags", "--refs", "--quiet", remote, ref)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = b
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return "", err
+// gitLockSatisfies requires the tag recorded in the lock to match a requested
+// semver tag or constraint. Any other version is pinned by the lock, as is
+// every version by locks written before tags were recorded.
+func gitLockSatisfies(d, l deps.Dependency) bool {
+	if l.Tag == "" {
+		return true
 	}
-	commitShaPattern := regexp.MustCompile("^([0-9a-f]{40,})\\b")
-	commitSha := commitShaPattern.FindString(b.String())
-	return commitSha, nil
+
+	if semver.IsConstraint(d.Version) {
+		c, err := semver.ParseConstraint(d.Version)
+		if err != nil {
+			return true
+		}
+		v, err := semver.Parse(l.Tag)
+		if err != nil {
+			return false
+		}
+		return c.Check(v)
+	}
+
+	if isTag(d.Version) {
+		return l.Tag == d.Version
+	}
+
+	return true
 }
 
+// Install fetches the package from the first Proxy that has it, or from its
+// upstream repository
 func (p *GitPackage) Install(ctx context.Context, name, dir, version string) (string, error) {
+	if Offline {
+		return "", errOffline
+	}
+
+	var commit string
+	err := viaProxies(ctx, func() (err error) {
+		commit, err = p.installDirect(ctx, name, dir, version)
+		return err
+	}, func(c proxyClient) (err error) {
+		commit, err = c.install(ctx, p.Source, dir, name, version)
+		return err
+	})
+	return commit, err
+}
+
+// installDirect fetches the package from its upstream repository
+func (p *GitPackage) installDirect(ctx context.Context, name, dir, version string) (string, error) {
 	destPath := path.Join(dir, name)
 
 	pkgh := sha256.Sum256([]byte(fmt.Sprintf("jsonnetpkg-%s-%s", strings.Replace(name, "/", "-", -1), strings.Replace(version, "/", "-", -1))))
@@ -190,13 +236,13 @@ func (p *GitPackage) Install(ctx context.Context, name, dir, version string) (st
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// Optimization for GitHub sources: download a tarball archive of the requested
-	// version instead of cloning the entire
-	isGitHubRemote, err := regexp.MatchString(`^(https|ssh)://github\.com/.+$`, p.Source.Remote())
-	if isGitHubRemote {
-		// Let git ls-remote decide if "version" is a ref or a commit SHA in the unlikely
+	// Optimization for known hosts (see ArchiveHosts): download a tarball
+	// archive of the requested version instead of cloning the entire
+	// repository
+	if _, ok := hostArchiveURL(p.Source, version); ok {
+		// Let the remote decide if "version" is a ref or a commit SHA in the unlikely
 		// but possible event that a ref is comprised of 40 or more hex characters
-		commitSha, err := remoteResolveRef(ctx, p.Source.Remote(), version)
+		commitSha, err := gitBackend().ResolveRef(ctx, p.Source.Remote(), version)
 
 		// If the ref resolution failed and "version" looks like a SHA,
 		// assume it is one and proceed.
@@ -205,114 +251,46 @@ func (p *GitPackage) Install(ctx context.Context, name, dir, version string) (st
 			commitSha = version
 		}
 
-		archiveUrl := fmt.Sprintf("%s/archive/%s.tar.gz", strings.TrimSuffix(p.Source.Remote(), ".git"), commitSha)
+		archiveUrl, _ := hostArchiveURL(p.Source, commitSha)
 		archiveFilepath := fmt.Sprintf("%s.tar.gz", tmpDir)
 
 		defer os.Remove(archiveFilepath)
-		err = downloadGitHubArchive(archiveFilepath, archiveUrl)
+		err = withRetry(ctx, func() error {
+			return downloadArchive(ctx, archiveFilepath, archiveUrl)
+		})
+		// Extract the sub-directory (if any) from the archive, whose entries
+		// are below a single directory. If none specified, the entire
+		// archive is unpacked.
+		extracted := tmpDir + ".archive"
+		defer os.RemoveAll(extracted)
 		if err == nil {
-			var ar *os.File
-			ar, err = os.Open(archiveFilepath)
-			defer ar.Close()
-			if err == nil {
-				// Extract the sub-directory (if any) from the archive
-				// If none specified, the entire archive is unpacked
-				err = gzipUntar(tmpDir, ar, p.Source.Subdir)
-
-				// Move the extracted directory to its final destination
-				if err == nil {
-					if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
-						panic(err)
-					}
-					if err := os.Rename(path.Join(tmpDir, p.Source.Subdir), destPath); err != nil {
-						panic(err)
-					}
-				}
-			}
+			err = extractArchive(archiveFilepath, extracted, 1, strings.Trim(p.Source.Subdir, "/"))
 		}
 
+		// Archives may differ from the repository, e.g. because of
+		// export-ignore attributes. Only use them if a checkout would produce
+		// the same files.
 		if err == nil {
-			return commitSha, nil
-		}
-
-		// The repository may be private or the archive download may not work
-		// for other reasons. In any case, fall back to the slower git-based installation.
-		color.Yellow("archive install failed: %s", err)
-		color.Yellow("retrying with git...")
-	}
-
-	gitCmd := func(args ...string) *exec.Cmd {
-		cmd := exec.CommandContext(ctx, "git", args...)
-		cmd.Stdin = os.Stdin
-		if GitQuiet {
-			cmd.Stdout = nil
-			cmd.Stderr = nil
-		} else {
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+			err = p.verifyTree(ctx, commitSha, extracted)
 		}
-		cmd.Dir = tmpDir
-		return cmd
-	}
-
-	cmd := gitCmd("init")
-	err = cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	cmd = gitCmd("remote", "add", "origin", p.Source.Remote())
-	err = cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	// Attempt shallow fetch at specific revision
-	cmd = gitCmd("fetch", "--tags", "--depth", "1", "origin", version)
-	err = cmd.Run()
-	if err != nil {
-		// Fall back to normal fetch (all revisions)
-		cmd = gitCmd("fetch", "origin")
-		err = cmd.Run()
-		if err != nil {
-			return "", err
+		if err == nil {
+			err = movePackage(extracted, destPath)
 		}
-	}
 
-	// Sparse checkout optimization: if a Subdir is specified,
-	// there is no need to do a full checkout
-	if p.Source.Subdir != "" {
-		cmd = gitCmd("config", "core.sparsecheckout", "true")
-		err = cmd.Run()
-		if err != nil {
-			return "", err
+		if err == nil {
+			return commitSha, nil
 		}
-
-		glob := []byte(p.Source.Subdir + "/*\n")
-		err = ioutil.WriteFile(filepath.Join(tmpDir, ".git", "info", "sparse-checkout"), glob, 0644)
-		if err != nil {
-			return "", err
+		if ctx.Err() != nil {
+			return "", ctx.Err()
 		}
-	}
 
-	cmd = gitCmd("-c", "advice.detachedHead=false", "checkout", version)
-	err = cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	b := bytes.NewBuffer(nil)
-	cmd = exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
-	cmd.Stdout = b
-	cmd.Dir = tmpDir
-	err = cmd.Run()
-	if err != nil {
-		return "", err
+		// The repository may be private or the archive download may not work
+		// for other reasons. In any case, fall back to the slower git-based installation.
+		printf(ctx, color.FgYellow, "archive install failed: %s", err)
+		printf(ctx, color.FgYellow, "retrying with git...")
 	}
 
-	commitHash := strings.TrimSpace(b.String())
-
-	err = os.RemoveAll(path.Join(tmpDir, ".git"))
+	commitHash, err := gitBackend().Checkout(ctx, p.Source.Remote(), version, p.Source.Subdir, tmpDir)
 	if err != nil {
 		return "", err
 	}
@@ -334,3 +312,23 @@ func (p *GitPackage) Install(ctx context.Context, name, dir, version string) (st
 
 	return commitHash, nil
 }
+
+// verifyTree checks that the files at dir have the git tree of the subdir at
+// the commit. Unless the expected Tree is known, it is fetched from the remote.
+func (p *GitPackage) verifyTree(ctx context.Context, commit, dir string) error {
+	want := p.Tree
+	if want == "" {
+		var err error
+		if want, err = gitBackend().Tree(ctx, p.Source.Remote(), commit, p.Source.Subdir); err != nil {
+			return errors.Wrap(err, "looking up git tree")
+		}
+	}
+	got, err := gitTreeHash(dir)
+	if err != nil {
+		return errors.Wrap(err, "computing git tree")
+	}
+	if got != want {
+		return fmt.Errorf("the files of the archive (tree %s) differ from the repository (tree %s)", got, want)
+	}
+	return nil
+}
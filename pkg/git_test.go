@@ -0,0 +1,112 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepo creates a git repository in a temporary directory with one commit
+// per tag. Tags starting with `a:` are created as annotated tags.
+func testRepo(t *testing.T, tags ...string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		args = append([]string{"-c", "user.name=jb", "-c", "user.email=jb@example.com", "-c", "commit.gpgsign=false", "-c", "tag.gpgsign=false"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "--quiet")
+	for _, tag := range tags {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.libsonnet"), []byte(`"`+tag+`"`), 0644))
+		git("add", ".")
+		git("commit", "--quiet", "-m", tag)
+
+		if strings.HasPrefix(tag, "a:") {
+			git("tag", "-a", "-m", tag, strings.TrimPrefix(tag, "a:"))
+		} else {
+			git("tag", tag)
+		}
+	}
+
+	return dir
+}
+
+func revParse(t *testing.T, dir, ref string) string {
+	t.Helper()
+	cmd := exec.Command("git", "rev-parse", ref+"^{commit}")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func TestRemoteListTags(t *testing.T) {
+	repo := testRepo(t, "v1.0.0", "a:v1.1.0")
+
+	tags, err := remoteListTags(context.TODO(), repo)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"v1.0.0": revParse(t, repo, "v1.0.0"),
+		"v1.1.0": revParse(t, repo, "v1.1.0"),
+	}, tags)
+}
+
+func TestRemoteResolveConstraint(t *testing.T) {
+	repo := testRepo(t, "v1.3.0", "v1.4.0", "a:v1.4.2", "v1.5.0-rc.1", "v2.0.0")
+
+	tests := []struct {
+		constraint string
+		want       string
+		err        bool
+	}{
+		{constraint: "^1.4.0", want: "v1.4.2"},
+		{constraint: "~1.3", want: "v1.3.0"},
+		{constraint: ">=1.0 <3.0", want: "v2.0.0"},
+		{constraint: "^3", err: true},
+	}
+
+	for _, c := range tests {
+		t.Run(c.constraint, func(t *testing.T) {
+			tag, commit, err := remoteResolveConstraint(context.TODO(), repo, c.constraint)
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, tag)
+			assert.Equal(t, revParse(t, repo, c.want), commit)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// GitBackend talks to git repositories
+type GitBackend interface {
+	// ListRefs returns the refs of the remote, such as HEAD, refs/heads/main
+	// or refs/tags/v1.0.0, mapped to the commit they point to. Annotated tags
+	// are peeled to their commit.
+	ListRefs(ctx context.Context, remote string) (map[string]string, error)
+
+	// ResolveRef returns the commit of the branch or tag called ref, or ""
+	// if the remote has no such ref
+	ResolveRef(ctx context.Context, remote, ref string) (string, error)
+
+	// Checkout writes the subdir of version, which is a ref or a commit, to
+	// the same path below dir and returns the commit it was taken from. dir
+	// exists and is empty.
+	Checkout(ctx context.Context, remote, version, subdir, dir string) (string, error)
+
+	// Tree returns the sha of the tree at subdir of the commit, fetching as
+	// little of the files as the remote allows. Like Checkout, it leaves out
+	// submodules.
+	Tree(ctx context.Context, remote, commit, subdir string) (string, error)
+}
+
+// GitBackends are the available implementations of GitBackend, by name
+var GitBackends = map[string]GitBackend{
+	"exec": execGit{},
+	"go":   goGit{},
+}
+
+// GitBackendName is the name of the GitBackends entry used for git packages.
+// "exec" runs the git binary, which honors the user's git configuration, e.g.
+// url.<base>.insteadOf and ssh. "go" needs no git binary, but only supports
+// http(s) and file remotes.
+var GitBackendName = "exec"
+
+// GitBackendNames returns the names of GitBackends, sorted
+func GitBackendNames() []string {
+	names := make([]string, 0, len(GitBackends))
+	for name := range GitBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func gitBackend() GitBackend {
+	if b, ok := GitBackends[GitBackendName]; ok {
+		return b
+	}
+	return execGit{}
+}
+
+// execGit is the GitBackend running the git binary
+type execGit struct{}
+
+// gitCommand returns the command running git with args against the remote
+func gitCommand(ctx context.Context, remote string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdin = gitStdin()
+	cmd.Env = gitEnv(remote)
+	return cmd
+}
+
+func (execGit) ListRefs(ctx context.Context, remote string) (map[string]string, error) {
+	b := &bytes.Buffer{}
+	err := runGit(ctx, func() *exec.Cmd {
+		b.Reset()
+		cmd := gitCommand(ctx, remote, "ls-remote", "--quiet", remote)
+		cmd.Stdout = b
+		cmd.Stderr = output(ctx)
+		return cmd
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRefs(b.Bytes()), nil
+}
+
+func (execGit) ResolveRef(ctx context.Context, remote, ref string) (string, error) {
+	b := &bytes.Buffer{}
+	err := runGit(ctx, func() *exec.Cmd {
+		b.Reset()
+		cmd := gitCommand(ctx, remote, "ls-remote", "--heads", "--tags", "--refs", "--quiet", remote, ref)
+		cmd.Stdout = b
+		cmd.Stderr = output(ctx)
+		return cmd
+	})
+	if err != nil {
+		return "", err
+	}
+	commitShaPattern := regexp.MustCompile("^([0-9a-f]{40,})\\b")
+	commitSha := commitShaPattern.FindString(b.String())
+	return commitSha, nil
+}
+
+func (execGit) Checkout(ctx context.Context, remote, version, subdir, dir string) (string, error) {
+	gitCmd := func(args ...string) *exec.Cmd {
+		cmd := gitCommand(ctx, remote, args...)
+		if GitQuiet {
+			cmd.Stdout = nil
+			cmd.Stderr = nil
+		} else {
+			cmd.Stdout = output(ctx)
+			cmd.Stderr = output(ctx)
+		}
+		cmd.Dir = dir
+		return cmd
+	}
+
+	cmd := gitCmd("init")
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	cmd = gitCmd("remote", "add", "origin", remote)
+	err = cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	// Attempt shallow fetch at specific revision
+	err = runGit(ctx, func() *exec.Cmd {
+		return gitCmd("fetch", "--tags", "--depth", "1", "origin", version)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		// Fall back to normal fetch (all revisions)
+		err = runGit(ctx, func() *exec.Cmd {
+			return gitCmd("fetch", "origin")
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Sparse checkout optimization: if a Subdir is specified,
+	// there is no need to do a full checkout
+	if subdir != "" {
+		cmd = gitCmd("config", "core.sparsecheckout", "true")
+		err = cmd.Run()
+		if err != nil {
+			return "", err
+		}
+
+		glob := []byte(subdir + "/*\n")
+		err = ioutil.WriteFile(filepath.Join(dir, ".git", "info", "sparse-checkout"), glob, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	cmd = gitCmd("-c", "advice.detachedHead=false", "checkout", version)
+	err = cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	b := bytes.NewBuffer(nil)
+	cmd = exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Stdout = b
+	cmd.Dir = dir
+	err = cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), os.RemoveAll(filepath.Join(dir, ".git"))
+}
+
+func (execGit) Tree(ctx context.Context, remote, commit, subdir string) (string, error) {
+	dir, err := ioutil.TempDir("", "jsonnetpkg-tree")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	gitCmd := func(args ...string) *exec.Cmd {
+		cmd := gitCommand(ctx, remote, args...)
+		cmd.Dir = dir
+		return cmd
+	}
+
+	for _, args := range [][]string{{"init", "--quiet"}, {"remote", "add", "origin", remote}} {
+		if out, err := gitCmd(args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("%w: %s", err, lastLine(string(out)))
+		}
+	}
+
+	// remotes that do not support filters send the blobs as well
+	err = runGit(ctx, func() *exec.Cmd {
+		return gitCmd("fetch", "--quiet", "--depth", "1", "--filter=blob:none", "origin", commit)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b := &bytes.Buffer{}
+	cmd := gitCmd("ls-tree", "-r", "-z", "FETCH_HEAD:"+strings.Trim(subdir, "/"))
+	cmd.Stdout = b
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("directory %s not found at %s", subdir, commit)
+	}
+
+	// <mode> <type> <sha>\t<path>, submodules are left out
+	var files []treeFile
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\x00"), "\x00") {
+		fields := strings.SplitN(line, "\t", 2)
+		meta := strings.Fields(fields[0])
+		if len(fields) != 2 || len(meta) != 3 {
+			continue
+		}
+		if meta[1] != "blob" {
+			continue
+		}
+		files = append(files, treeFile{path: fields[1], mode: meta[0], sha: meta[2]})
+	}
+	return hashFiles(files), nil
+}
@@ -0,0 +1,627 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+// goGit is the GitBackend implemented in Go. It speaks the smart HTTP
+// protocol, preferring version 2, and reads local repositories directly.
+type goGit struct{}
+
+// gitTransport is a connection to a remote repository
+type gitTransport interface {
+	// listRefs returns the refs of the remote, peeled like ListRefs
+	listRefs(ctx context.Context) (map[string]string, error)
+	// fetch returns the objects of the commit, at least of its tree.
+	// Without blobs, the contents of files may be left out.
+	fetch(ctx context.Context, commit string, blobs bool) (objectStore, error)
+	io.Closer
+}
+
+func newGitTransport(remote string) (gitTransport, error) {
+	switch {
+	case strings.HasPrefix(remote, "http://"), strings.HasPrefix(remote, "https://"):
+		return &httpTransport{url: strings.TrimSuffix(remote, "/")}, nil
+	case strings.HasPrefix(remote, "file://"):
+		u, err := url.Parse(remote)
+		if err != nil {
+			return nil, err
+		}
+		return newFileTransport(u.Path)
+	case filepath.IsAbs(remote):
+		return newFileTransport(remote)
+	}
+	return nil, fmt.Errorf("the go git backend only supports http(s) and file remotes, not %s. Use the exec backend instead", remote)
+}
+
+func (goGit) ListRefs(ctx context.Context, remote string) (map[string]string, error) {
+	t, err := newGitTransport(remote)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	return t.listRefs(ctx)
+}
+
+func (goGit) ResolveRef(ctx context.Context, remote, ref string) (string, error) {
+	refs, err := goGit{}.ListRefs(ctx, remote)
+	if err != nil {
+		return "", err
+	}
+	return lookupRef(refs, ref), nil
+}
+
+func (goGit) Checkout(ctx context.Context, remote, version, subdir, dir string) (string, error) {
+	t, err := newGitTransport(remote)
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	commit := version
+	if !isCommit(version) {
+		refs, err := t.listRefs(ctx)
+		if err != nil {
+			return "", err
+		}
+		if commit = lookupRef(refs, version); commit == "" {
+			if abbrevPattern.MatchString(version) {
+				return "", fmt.Errorf("%s: abbreviated commits are not supported by the go git backend, use the full commit", version)
+			}
+			return "", fmt.Errorf("%s has no branch or tag %s", remote, version)
+		}
+	}
+
+	if !GitQuiet {
+		printf(ctx, color.FgCyan, "fetching %s of %s", commit, remote)
+	}
+	store, err := t.fetch(ctx, commit, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "fetching %s", version)
+	}
+
+	commit, err = peelCommit(store, commit)
+	if err != nil {
+		return "", err
+	}
+	return commit, checkoutCommit(ctx, store, commit, subdir, dir)
+}
+
+func (goGit) Tree(ctx context.Context, remote, commit, subdir string) (string, error) {
+	t, err := newGitTransport(remote)
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	store, err := t.fetch(ctx, commit, false)
+	if err != nil {
+		return "", errors.Wrapf(err, "fetching %s", commit)
+	}
+
+	commit, err = peelCommit(store, commit)
+	if err != nil {
+		return "", err
+	}
+	tree, err := subtree(store, commit, subdir)
+	if err != nil {
+		return "", err
+	}
+	files, err := treeFiles(store, tree, "")
+	if err != nil {
+		return "", err
+	}
+	return hashFiles(files), nil
+}
+
+var abbrevPattern = regexp.MustCompile("^[0-9a-f]{4,39}$")
+
+// lookupRef returns the commit of the ref, which is either a full refname or
+// the name of a tag or branch. Tags take precedence, as with git fetch.
+func lookupRef(refs map[string]string, ref string) string {
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		if sha, ok := refs[name]; ok {
+			return sha
+		}
+	}
+	return ""
+}
+
+// httpTransport speaks the smart HTTP protocol
+type httpTransport struct {
+	url string
+
+	// discovered is set once the capabilities of the server are known
+	discovered bool
+	// v2 is whether the server speaks protocol version 2
+	v2   bool
+	caps map[string]string
+	// refs advertised by a version 0 server
+	refs map[string]string
+}
+
+// gitUserAgent must start with git/ for some servers to speak the smart
+// protocol
+const gitUserAgent = "git/jsonnet-bundler"
+
+// request sends a request to the service at path and returns the body of the
+// response
+func (t *httpTransport) request(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	var data []byte
+	err := withRetry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, t.url+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", gitUserAgent)
+		req.Header.Set("Git-Protocol", "version=2")
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+			req.Header.Set("Accept", "application/x-git-upload-pack-result")
+		}
+
+		creds := authorize(ctx, req, true)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return networkError(ctx, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return authFailed(httpStatusError(resp), req.URL.Host, creds)
+		}
+
+		// the repository may have moved, e.g. when its name lacked .git
+		if method == http.MethodGet && resp.Request.URL.String() != req.URL.String() {
+			u := *resp.Request.URL
+			u.RawQuery = ""
+			t.url = strings.TrimSuffix(u.String(), path[:strings.Index(path+"?", "?")])
+		}
+
+		data, err = ioutil.ReadAll(resp.Body)
+		return networkError(ctx, err)
+	})
+	return data, err
+}
+
+// discover reads the capabilities of the server, and the refs of version 0
+func (t *httpTransport) discover(ctx context.Context) error {
+	if t.discovered {
+		return nil
+	}
+
+	data, err := t.request(ctx, http.MethodGet, "/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return err
+	}
+
+	r := &pktReader{data: data}
+	kind, line, err := r.next()
+	if err != nil {
+		return errors.Wrap(err, "the server does not speak the smart git protocol")
+	}
+	if kind == pktData && strings.HasPrefix(string(line), "# service=") {
+		// the smart HTTP header, followed by a flush
+		if kind, _, err = r.next(); err != nil || kind != pktFlush {
+			return errors.New("malformed ref advertisement")
+		}
+		if kind, line, err = r.next(); err != nil {
+			return err
+		}
+	}
+
+	t.caps = make(map[string]string)
+	if kind == pktData && strings.TrimSpace(string(line)) == "version 2" {
+		t.v2 = true
+		if err := r.each(func(line string) error {
+			parts := strings.SplitN(line, "=", 2)
+			t.caps[parts[0]] = ""
+			if len(parts) == 2 {
+				t.caps[parts[0]] = parts[1]
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		t.discovered = true
+		return nil
+	}
+
+	// version 0: refs, the first carrying the capabilities
+	var refs bytes.Buffer
+	for ; err == nil && kind == pktData; kind, line, err = r.next() {
+		s := string(line)
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			for _, c := range strings.Fields(s[i+1:]) {
+				parts := strings.SplitN(c, "=", 2)
+				t.caps[parts[0]] = ""
+				if len(parts) == 2 {
+					t.caps[parts[0]] = parts[1]
+				}
+			}
+			s = s[:i] + "\n"
+		}
+		if strings.HasPrefix(s, "ERR ") {
+			return errors.New(strings.TrimSpace(s[4:]))
+		}
+		refs.WriteString(s)
+	}
+	if err != nil {
+		return err
+	}
+	t.refs = parseRefs(refs.Bytes())
+	// advertised by empty repositories
+	delete(t.refs, "capabilities")
+	t.discovered = true
+	return nil
+}
+
+func (t *httpTransport) listRefs(ctx context.Context) (map[string]string, error) {
+	if err := t.discover(ctx); err != nil {
+		return nil, err
+	}
+	if !t.v2 {
+		return t.refs, nil
+	}
+
+	var req bytes.Buffer
+	pktLine(&req, "command=ls-refs\n")
+	req.WriteString(pktDelimString)
+	pktLine(&req, "peel\n")
+	req.WriteString(pktFlushString)
+
+	data, err := t.request(ctx, http.MethodPost, "/git-upload-pack", req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]string)
+	err = (&pktReader{data: data}).each(func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] == "unborn" {
+			return nil
+		}
+		refs[fields[1]] = fields[0]
+		for _, attr := range fields[2:] {
+			if peeled := strings.TrimPrefix(attr, "peeled:"); peeled != attr {
+				refs[fields[1]] = peeled
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (t *httpTransport) fetch(ctx context.Context, commit string, blobs bool) (objectStore, error) {
+	if err := t.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	var req bytes.Buffer
+	if t.v2 {
+		pktLine(&req, "command=fetch\n")
+		req.WriteString(pktDelimString)
+		pktLine(&req, "no-progress\n")
+		pktLine(&req, "ofs-delta\n")
+		if hasWord(t.caps["fetch"], "shallow") {
+			pktLine(&req, "deepen 1\n")
+		}
+		if !blobs && hasWord(t.caps["fetch"], "filter") {
+			pktLine(&req, "filter blob:none\n")
+		}
+		pktLine(&req, "want %s\n", commit)
+		pktLine(&req, "done\n")
+		req.WriteString(pktFlushString)
+	} else {
+		var caps []string
+		for _, c := range []string{"ofs-delta", "side-band-64k", "no-progress", "shallow"} {
+			if _, ok := t.caps[c]; ok {
+				caps = append(caps, c)
+			}
+		}
+		_, filter := t.caps["filter"]
+		if filter = filter && !blobs; filter {
+			caps = append(caps, "filter")
+		}
+		pktLine(&req, "want %s %s\n", commit, strings.Join(caps, " "))
+		if _, ok := t.caps["shallow"]; ok {
+			pktLine(&req, "deepen 1\n")
+		}
+		if filter {
+			pktLine(&req, "filter blob:none\n")
+		}
+		req.WriteString(pktFlushString)
+		pktLine(&req, "done\n")
+	}
+
+	data, err := t.request(ctx, http.MethodPost, "/git-upload-pack", req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var pack []byte
+	if t.v2 {
+		pack, err = readPackfileSection(data)
+	} else {
+		_, sideband := t.caps["side-band-64k"]
+		pack, err = readV0Pack(data, sideband)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPackStore(pack)
+}
+
+func (t *httpTransport) Close() error {
+	return nil
+}
+
+// readPackfileSection returns the pack of a version 2 fetch response, which
+// follows the acknowledgments and shallow-info sections
+func readPackfileSection(data []byte) ([]byte, error) {
+	r := &pktReader{data: data}
+	for {
+		kind, line, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if kind == pktFlush {
+			return nil, errors.New("the server sent no packfile")
+		}
+		if kind != pktData {
+			continue
+		}
+
+		s := string(line)
+		if strings.HasPrefix(s, "ERR ") {
+			return nil, errors.New(strings.TrimSpace(s[4:]))
+		}
+		if s == "packfile\n" {
+			return r.sideband()
+		}
+	}
+}
+
+// readV0Pack returns the pack of a version 0 fetch response, which follows
+// the shallow updates and the final NAK
+func readV0Pack(data []byte, sideband bool) ([]byte, error) {
+	r := &pktReader{data: data}
+	for {
+		kind, line, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if kind != pktData {
+			continue
+		}
+
+		s := string(line)
+		switch {
+		case strings.HasPrefix(s, "ERR "):
+			return nil, errors.New(strings.TrimSpace(s[4:]))
+		case strings.HasPrefix(s, "NAK"), strings.HasPrefix(s, "ACK "):
+			if sideband {
+				return r.sideband()
+			}
+			return r.data, nil
+		}
+	}
+}
+
+func hasWord(s, word string) bool {
+	for _, w := range strings.Fields(s) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// kinds of pkt-lines
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+const (
+	pktFlushString = "0000"
+	pktDelimString = "0001"
+)
+
+// pktLine writes a pkt-line, i.e. the data prefixed by its length
+func pktLine(w *bytes.Buffer, format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	fmt.Fprintf(w, "%04x%s", len(s)+4, s)
+}
+
+// pktReader reads pkt-lines
+type pktReader struct {
+	data []byte
+}
+
+func (r *pktReader) next() (int, []byte, error) {
+	if len(r.data) < 4 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	n, err := strconv.ParseUint(string(r.data[:4]), 16, 16)
+	if err != nil {
+		return 0, nil, errors.New("malformed pkt-line")
+	}
+	switch n {
+	case 0, 1, 2:
+		r.data = r.data[4:]
+		return []int{pktFlush, pktDelim, pktResponseEnd}[n], nil, nil
+	}
+	if n < 4 || int(n) > len(r.data) {
+		return 0, nil, errors.New("malformed pkt-line")
+	}
+
+	line := r.data[4:n]
+	r.data = r.data[n:]
+	return pktData, line, nil
+}
+
+// each calls fn with every line up to the next flush, without the trailing
+// newline
+func (r *pktReader) each(fn func(line string) error) error {
+	for {
+		kind, line, err := r.next()
+		if err != nil {
+			return err
+		}
+		if kind == pktFlush {
+			return nil
+		}
+		if kind != pktData {
+			continue
+		}
+
+		s := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(s, "ERR ") {
+			return errors.New(s[4:])
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+}
+
+// sideband returns the data sent on band 1 up to the next flush. Progress
+// messages on band 2 are dropped, band 3 carries errors.
+func (r *pktReader) sideband() ([]byte, error) {
+	var data bytes.Buffer
+	for {
+		kind, line, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if kind == pktFlush || kind == pktResponseEnd {
+			return data.Bytes(), nil
+		}
+		if kind != pktData || len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case 1:
+			data.Write(line[1:])
+		case 3:
+			return nil, fmt.Errorf("remote: %s", strings.TrimSpace(string(line[1:])))
+		}
+	}
+}
+
+// fileTransport reads a repository on the local filesystem
+type fileTransport struct {
+	repo *repoStore
+}
+
+func newFileTransport(dir string) (*fileTransport, error) {
+	repo, err := openRepo(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTransport{repo: repo}, nil
+}
+
+func (t *fileTransport) listRefs(ctx context.Context) (map[string]string, error) {
+	refs := make(map[string]string)
+	symrefs := make(map[string]string)
+
+	// packed refs are overridden by loose ones
+	data, err := ioutil.ReadFile(filepath.Join(t.repo.dir, "packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && !strings.HasPrefix(line, "#") {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	read := func(name string) error {
+		data, err := ioutil.ReadFile(filepath.Join(t.repo.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		value := strings.TrimSpace(string(data))
+		if target := strings.TrimPrefix(value, "ref: "); target != value {
+			symrefs[name] = target
+		} else {
+			refs[name] = value
+		}
+		return nil
+	}
+
+	refsDir := filepath.Join(t.repo.dir, "refs")
+	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(t.repo.dir, path)
+		if err != nil {
+			return err
+		}
+		return read(filepath.ToSlash(rel))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := read("HEAD"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for name, target := range symrefs {
+		if sha, ok := refs[target]; ok {
+			refs[name] = sha
+		}
+	}
+
+	// tags may also point to trees or blobs, which are kept
+	for name, sha := range refs {
+		if peeled, err := peelCommit(t.repo, sha); err == nil {
+			refs[name] = peeled
+		}
+	}
+	return refs, nil
+}
+
+func (t *fileTransport) fetch(ctx context.Context, commit string, blobs bool) (objectStore, error) {
+	return t.repo, nil
+}
+
+func (t *fileTransport) Close() error {
+	return t.repo.Close()
+}
@@ -0,0 +1,390 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// testBareRepo returns a bare repository at root/foo/bar.git holding the tags
+// of testRepo, followed by v1.9.0 adding lib/ and v2.0.0 adding an executable,
+// a symlink to it and a submodule. packed repacks all objects and refs.
+func testBareRepo(t *testing.T, packed bool, tags ...string) (root, repo string) {
+	t.Helper()
+
+	repo = testRepo(t, tags...)
+	git := func(dir string, args ...string) {
+		t.Helper()
+		args = append([]string{"-c", "user.name=jb", "-c", "user.email=jb@example.com", "-c", "commit.gpgsign=false"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	// a file large enough for deltas between its versions
+	large := strings.Repeat("local x = 1;\n", 200)
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "lib"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "lib", "large.libsonnet"), []byte(large), 0644))
+	git(repo, "add", ".")
+	git(repo, "commit", "--quiet", "-m", "v1.9.0")
+	git(repo, "tag", "v1.9.0")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "lib", "large.libsonnet"), []byte(large+"x\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "lib", "gen.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Symlink("large.libsonnet", filepath.Join(repo, "lib", "main.libsonnet")))
+	git(repo, "add", ".")
+	git(repo, "update-index", "--add", "--cacheinfo", "160000,"+revParse(t, repo, "HEAD")+",lib/sub")
+	git(repo, "commit", "--quiet", "-m", "v2.0.0")
+	git(repo, "tag", "-a", "-m", "v2.0.0", "v2.0.0")
+
+	root = t.TempDir()
+	bare := filepath.Join(root, "foo", "bar.git")
+	// local clones link the loose objects of repo
+	git(root, "clone", "--quiet", "--bare", repo, bare)
+	if packed {
+		git(bare, "repack", "-a", "-d", "-f", "--depth=10")
+		git(bare, "pack-refs", "--all")
+	}
+	return root, repo
+}
+
+// testGitServer serves the repositories below root using git-http-backend.
+// v0 hides the Git-Protocol header, so the server falls back to version 0.
+func testGitServer(t *testing.T, root string, v0 bool) *httptest.Server {
+	t.Helper()
+
+	out, err := exec.Command("git", "--exec-path").Output()
+	require.NoError(t, err)
+	backend := filepath.Join(strings.TrimSpace(string(out)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git-http-backend not available")
+	}
+
+	h := &cgi.Handler{
+		Path: backend,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=uploadpack.allowFilter",
+			"GIT_CONFIG_VALUE_0=true",
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v0 {
+			r.Header.Del("Git-Protocol")
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGoGit(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote func(t *testing.T) (remote, repo string)
+	}{
+		{
+			name: "file",
+			remote: func(t *testing.T) (string, string) {
+				root, repo := testBareRepo(t, false, "v1.0.0", "a:v1.1.0")
+				return "file://" + filepath.Join(root, "foo", "bar.git"), repo
+			},
+		},
+		{
+			name: "file packed",
+			remote: func(t *testing.T) (string, string) {
+				root, repo := testBareRepo(t, true, "v1.0.0", "a:v1.1.0")
+				return filepath.Join(root, "foo", "bar.git"), repo
+			},
+		},
+		{
+			name: "http",
+			remote: func(t *testing.T) (string, string) {
+				root, repo := testBareRepo(t, true, "v1.0.0", "a:v1.1.0")
+				return testGitServer(t, root, false).URL + "/foo/bar.git", repo
+			},
+		},
+		{
+			name: "http v0",
+			remote: func(t *testing.T) (string, string) {
+				root, repo := testBareRepo(t, true, "v1.0.0", "a:v1.1.0")
+				return testGitServer(t, root, true).URL + "/foo/bar.git", repo
+			},
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			remote, repo := c.remote(t)
+			ctx := context.TODO()
+			g := GitBackends["go"]
+
+			refs, err := g.ListRefs(ctx, remote)
+			require.NoError(t, err)
+			want, err := GitBackends["exec"].ListRefs(ctx, remote)
+			require.NoError(t, err)
+			assert.Equal(t, want, refs)
+			assert.Equal(t, revParse(t, repo, "v1.1.0"), refs["refs/tags/v1.1.0"])
+
+			sha, err := g.ResolveRef(ctx, remote, "v2.0.0")
+			require.NoError(t, err)
+			assert.Equal(t, revParse(t, repo, "v2.0.0"), sha)
+
+			// annotated tag, subdir with an executable and a symlink
+			dir := t.TempDir()
+			commit, err := g.Checkout(ctx, remote, "v2.0.0", "/lib", dir)
+			require.NoError(t, err)
+			assert.Equal(t, revParse(t, repo, "v2.0.0"), commit)
+			assert.Equal(t, strings.Repeat("local x = 1;\n", 200)+"x\n", readMain(t, filepath.Join(dir, "lib")))
+			link, err := os.Readlink(filepath.Join(dir, "lib", "main.libsonnet"))
+			require.NoError(t, err)
+			assert.Equal(t, "large.libsonnet", link)
+			fi, err := os.Stat(filepath.Join(dir, "lib", "gen.sh"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+			_, err = os.Stat(filepath.Join(dir, "main.libsonnet"))
+			assert.True(t, os.IsNotExist(err), "files outside of the subdir are skipped")
+
+			// lightweight tag
+			dir = t.TempDir()
+			commit, err = g.Checkout(ctx, remote, "v1.0.0", "", dir)
+			require.NoError(t, err)
+			assert.Equal(t, revParse(t, repo, "v1.0.0"), commit)
+			assert.Equal(t, `"v1.0.0"`, readMain(t, dir))
+
+			// the other version of lib/large.libsonnet, one of them is a delta
+			dir = t.TempDir()
+			_, err = g.Checkout(ctx, remote, "v1.9.0", "/lib", dir)
+			require.NoError(t, err)
+			data, err := ioutil.ReadFile(filepath.Join(dir, "lib", "large.libsonnet"))
+			require.NoError(t, err)
+			assert.Equal(t, strings.Repeat("local x = 1;\n", 200), string(data))
+
+			_, err = g.Checkout(ctx, remote, "v3.0.0", "", t.TempDir())
+			assert.Error(t, err)
+			_, err = g.Checkout(ctx, remote, commit[:7], "", t.TempDir())
+			assert.Error(t, err)
+			_, err = g.Checkout(ctx, remote, "v2.0.0", "/missing", t.TempDir())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGoGitCommit(t *testing.T) {
+	root, repo := testBareRepo(t, true, "v1.0.0", "v1.1.0")
+	ctx := context.TODO()
+	commit := revParse(t, repo, "v1.0.0")
+
+	for _, remote := range []string{
+		filepath.Join(root, "foo", "bar.git"),
+		// version 2 allows fetching any commit, not only those of refs
+		testGitServer(t, root, false).URL + "/foo/bar.git",
+	} {
+		dir := t.TempDir()
+		got, err := GitBackends["go"].Checkout(ctx, remote, commit, "", dir)
+		require.NoError(t, err, remote)
+		assert.Equal(t, commit, got)
+		assert.Equal(t, `"v1.0.0"`, readMain(t, dir))
+	}
+}
+
+// memStore is an objectStore holding crafted objects
+type memStore map[string][]byte
+
+func (s memStore) add(typ int, data []byte) string {
+	sha := hashObject(typ, data)
+	s[sha] = append([]byte{byte(typ)}, data...)
+	return sha
+}
+
+// tree adds a tree of the entries, in the given order
+func (s memStore) tree(entries ...treeEntry) string {
+	var data []byte
+	for _, e := range entries {
+		sha, _ := hex.DecodeString(e.sha)
+		data = append(data, e.mode+" "+e.name+"\x00"...)
+		data = append(data, sha...)
+	}
+	return s.add(objTree, data)
+}
+
+func (s memStore) object(sha string) (int, []byte, error) {
+	o, ok := s[sha]
+	if !ok {
+		return 0, nil, errObjectMissing(sha)
+	}
+	return int(o[0]), o[1:], nil
+}
+
+func TestCheckoutTreeUnsafe(t *testing.T) {
+	outside := t.TempDir()
+
+	store := memStore{}
+	blob := store.add(objBlob, []byte("{}"))
+	link := store.add(objBlob, []byte(outside))
+	evil := store.tree(treeEntry{mode: "100644", name: "evil.libsonnet", sha: blob})
+
+	tests := map[string]string{
+		// the directory would be written through the symlink
+		"symlink, then directory": store.tree(
+			treeEntry{mode: "120000", name: "a", sha: link},
+			treeEntry{mode: "40000", name: "a", sha: evil},
+		),
+		"duplicate file": store.tree(
+			treeEntry{mode: "100644", name: "a", sha: blob},
+			treeEntry{mode: "100644", name: "a", sha: blob},
+		),
+		"dot":    store.tree(treeEntry{mode: "40000", name: ".", sha: evil}),
+		"dotdot": store.tree(treeEntry{mode: "40000", name: "..", sha: evil}),
+		".git":   store.tree(treeEntry{mode: "40000", name: ".git", sha: evil}),
+		".GIT":   store.tree(treeEntry{mode: "40000", name: ".GIT", sha: evil}),
+		"slash":  store.tree(treeEntry{mode: "100644", name: "../evil.libsonnet", sha: blob}),
+	}
+
+	for name, tree := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "pkg")
+			assert.Error(t, checkoutTree(context.TODO(), store, tree, dir))
+			_, err := os.Stat(filepath.Join(outside, "evil.libsonnet"))
+			assert.True(t, os.IsNotExist(err), err)
+		})
+	}
+}
+
+func TestGitTree(t *testing.T) {
+	root, repo := testBareRepo(t, true, "v1.0.0")
+	ctx := context.TODO()
+	commit := revParse(t, repo, "v2.0.0")
+	treeOf := func(t *testing.T, rev string) string {
+		out, err := exec.Command("git", "-C", repo, "rev-parse", rev).Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+
+	remotes := map[string]string{
+		"file":    filepath.Join(root, "foo", "bar.git"),
+		"http":    testGitServer(t, root, false).URL + "/foo/bar.git",
+		"http v0": testGitServer(t, root, true).URL + "/foo/bar.git",
+	}
+
+	// the tree of the files that are checked out, without the submodule
+	checkout := t.TempDir()
+	_, err := GitBackends["exec"].Checkout(ctx, remotes["file"], commit, "", checkout)
+	require.NoError(t, err)
+	want, err := gitTreeHash(checkout)
+	require.NoError(t, err)
+	wantLib, err := gitTreeHash(filepath.Join(checkout, "lib"))
+	require.NoError(t, err)
+	assert.NotEqual(t, treeOf(t, commit+":lib"), wantLib)
+
+	for _, name := range GitBackendNames() {
+		for kind, remote := range remotes {
+			t.Run(name+" "+kind, func(t *testing.T) {
+				g := GitBackends[name]
+				tree, err := g.Tree(ctx, remote, commit, "")
+				require.NoError(t, err)
+				assert.Equal(t, want, tree)
+
+				tree, err = g.Tree(ctx, remote, commit, "/lib")
+				require.NoError(t, err)
+				assert.Equal(t, wantLib, tree)
+
+				// without submodules, it is the tree of the commit
+				tree, err = g.Tree(ctx, remote, revParse(t, repo, "v1.9.0"), "")
+				require.NoError(t, err)
+				assert.Equal(t, treeOf(t, "v1.9.0^{tree}"), tree)
+
+				_, err = g.Tree(ctx, remote, commit, "/missing")
+				assert.Error(t, err)
+			})
+		}
+	}
+
+	// the files are left out, as the server supports filters
+	for _, kind := range []string{"http", "http v0"} {
+		tr, err := newGitTransport(remotes[kind])
+		require.NoError(t, err)
+		store, err := tr.fetch(ctx, commit, false)
+		require.NoError(t, err)
+		_, _, err = store.object(treeOf(t, commit+":main.libsonnet"))
+		assert.IsType(t, errObjectMissing(""), err, kind)
+	}
+
+	// only the executable bit of files counts, empty directories are left out
+	dir := t.TempDir()
+	_, err = GitBackends["go"].Checkout(ctx, remotes["file"], "v1.9.0", "", dir)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib", "empty"), os.ModePerm))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "main.libsonnet"), 0600))
+	tree, err := gitTreeHash(dir)
+	require.NoError(t, err)
+	assert.Equal(t, treeOf(t, "v1.9.0^{tree}"), tree)
+
+	require.NoError(t, os.Chmod(filepath.Join(dir, "main.libsonnet"), 0700))
+	tree, err = gitTreeHash(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, treeOf(t, "v1.9.0^{tree}"), tree)
+}
+
+func TestInstallGoGit(t *testing.T) {
+	root, repo := testBareRepo(t, true, "v1.0.0")
+	commit := revParse(t, repo, "v2.0.0")
+	srv := httptest.NewTLSServer(testGitServer(t, root, false).Config.Handler)
+	defer srv.Close()
+
+	old := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	defer func() { http.DefaultClient = old }()
+
+	oldBackend := GitBackendName
+	GitBackendName = "go"
+	defer func() { GitBackendName = oldBackend }()
+
+	// fail if the git binary is used
+	t.Setenv("PATH", "")
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	source := &deps.Git{
+		Scheme: deps.GitSchemeHTTPS,
+		Host:   strings.TrimPrefix(srv.URL, "https://"),
+		User:   "foo",
+		Repo:   "bar",
+		Subdir: "/lib",
+	}
+	got, err := NewGitPackage(source).Install(context.TODO(), "lib", vendorDir, "v2.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, commit, got)
+	assert.Equal(t, strings.Repeat("local x = 1;\n", 200)+"x\n", readMain(t, filepath.Join(vendorDir, "lib")))
+}
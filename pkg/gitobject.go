@@ -0,0 +1,835 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// types of git objects, as numbered in packfiles
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var objTypeNames = map[int]string{
+	objCommit: "commit",
+	objTree:   "tree",
+	objBlob:   "blob",
+	objTag:    "tag",
+}
+
+// objectStore reads git objects by their hex sha
+type objectStore interface {
+	object(sha string) (typ int, data []byte, err error)
+}
+
+// errObjectMissing is returned for objects not in a store
+type errObjectMissing string
+
+func (e errObjectMissing) Error() string {
+	return fmt.Sprintf("object %s not found", string(e))
+}
+
+// hashObject returns the sha of the object, which covers its type and size
+func hashObject(typ int, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", objTypeNames[typ], len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readObject returns the object of the type, or an error if it is of another
+func readObject(store objectStore, sha string, want int) ([]byte, error) {
+	typ, data, err := store.object(sha)
+	if err != nil {
+		return nil, err
+	}
+	if typ != want {
+		return nil, fmt.Errorf("object %s is a %s, not a %s", sha, objTypeNames[typ], objTypeNames[want])
+	}
+	return data, nil
+}
+
+// peelCommit follows tags to the commit they point to
+func peelCommit(store objectStore, sha string) (string, error) {
+	for i := 0; i < 10; i++ {
+		typ, data, err := store.object(sha)
+		if err != nil {
+			return "", err
+		}
+		switch typ {
+		case objCommit:
+			return sha, nil
+		case objTag:
+			sha = objectHeader(data, "object")
+		default:
+			return "", fmt.Errorf("object %s is a %s, not a commit", sha, objTypeNames[typ])
+		}
+	}
+	return "", fmt.Errorf("too many nested tags at %s", sha)
+}
+
+// objectHeader returns the value of a header of a commit or tag object, e.g.
+// its tree
+func objectHeader(data []byte, name string) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, name+" ") {
+			return strings.TrimPrefix(line, name+" ")
+		}
+	}
+	return ""
+}
+
+type treeEntry struct {
+	mode string
+	name string
+	sha  string
+}
+
+func parseTree(data []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, errors.New("malformed tree object")
+		}
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			sha:  hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// checkoutCommit writes the subdir of the commit to the same path below dir
+func checkoutCommit(ctx context.Context, store objectStore, commit, subdir, dir string) error {
+	tree, err := subtree(store, commit, subdir)
+	if err != nil {
+		return err
+	}
+	return checkoutTree(ctx, store, tree, filepath.Join(dir, subdir))
+}
+
+// subtree returns the sha of the tree at subdir of the commit
+func subtree(store objectStore, commit, subdir string) (string, error) {
+	data, err := readObject(store, commit, objCommit)
+	if err != nil {
+		return "", err
+	}
+	tree := objectHeader(data, "tree")
+
+	for _, name := range strings.Split(strings.Trim(subdir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		data, err := readObject(store, tree, objTree)
+		if err != nil {
+			return "", err
+		}
+		entries, err := parseTree(data)
+		if err != nil {
+			return "", err
+		}
+
+		tree = ""
+		for _, e := range entries {
+			if e.name == name && e.mode == "40000" {
+				tree = e.sha
+			}
+		}
+		if tree == "" {
+			return "", fmt.Errorf("directory %s not found at %s", subdir, commit)
+		}
+	}
+	return tree, nil
+}
+
+// checkoutTree writes the files of the tree to dir. Submodules are skipped.
+// Crafted trees cannot write outside of dir: names are checked and nothing is
+// written to an existing path, which could be a symlink of the same checkout.
+func checkoutTree(ctx context.Context, store objectStore, sha, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write tree %s through the symlink %s", sha, dir)
+	}
+
+	data, err := readObject(store, sha, objTree)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if e.name == "" || e.name == "." || e.name == ".." || strings.EqualFold(e.name, ".git") || strings.ContainsAny(e.name, `/\`) {
+			return fmt.Errorf("invalid file name '%s' in tree %s", e.name, sha)
+		}
+		if seen[e.name] {
+			return fmt.Errorf("duplicate file name '%s' in tree %s", e.name, sha)
+		}
+		seen[e.name] = true
+
+		target := filepath.Join(dir, e.name)
+		// e.g. names differing in case only on case-insensitive file systems
+		if _, err := os.Lstat(target); !os.IsNotExist(err) {
+			return fmt.Errorf("file name '%s' in tree %s collides with an existing file", e.name, sha)
+		}
+
+		switch e.mode {
+		case "40000":
+			err = checkoutTree(ctx, store, e.sha, target)
+		case "160000":
+			// submodule
+			continue
+		case "120000":
+			var link []byte
+			link, err = readObject(store, e.sha, objBlob)
+			if err == nil {
+				err = os.Symlink(string(link), target)
+			}
+		default:
+			perm := os.FileMode(0644)
+			if e.mode == "100755" {
+				perm = 0755
+			}
+
+			var content []byte
+			content, err = readObject(store, e.sha, objBlob)
+			if err == nil {
+				err = ioutil.WriteFile(target, content, perm)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFile is a file or symlink of a tree, by its slash separated path
+type treeFile struct {
+	path string
+	mode string
+	sha  string
+}
+
+// gitTreeHash returns the sha git computes for the tree of the files below
+// dir when committing them. Like git, it keeps only the executable bit of
+// files and leaves out empty directories.
+func gitTreeHash(dir string) (string, error) {
+	var files []treeFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f := treeFile{path: filepath.ToSlash(rel)}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			f.mode, f.sha = "120000", hashObject(objBlob, []byte(filepath.ToSlash(target)))
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			f.mode = "100644"
+			if info.Mode()&0111 != 0 {
+				f.mode = "100755"
+			}
+			f.sha = hashObject(objBlob, data)
+		default:
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hashFiles(files), nil
+}
+
+// treeFiles lists the files of the tree, recursively. Submodules are left
+// out, as they are not checked out either.
+func treeFiles(store objectStore, sha, prefix string) ([]treeFile, error) {
+	data, err := readObject(store, sha, objTree)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseTree(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []treeFile
+	for _, e := range entries {
+		switch e.mode {
+		case "160000":
+			continue
+		case "40000":
+			sub, err := treeFiles(store, e.sha, prefix+e.name+"/")
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		default:
+			files = append(files, treeFile{path: prefix + e.name, mode: e.mode, sha: e.sha})
+		}
+	}
+	return files, nil
+}
+
+// hashFiles returns the sha of the tree holding the files. Directories
+// without files are left out, like git does.
+func hashFiles(files []treeFile) string {
+	type dir struct {
+		files []treeEntry
+		dirs  map[string][]treeFile
+	}
+	d := dir{dirs: make(map[string][]treeFile)}
+	for _, f := range files {
+		if i := strings.Index(f.path, "/"); i >= 0 {
+			d.dirs[f.path[:i]] = append(d.dirs[f.path[:i]], treeFile{path: f.path[i+1:], mode: f.mode, sha: f.sha})
+			continue
+		}
+		d.files = append(d.files, treeEntry{mode: f.mode, name: f.path, sha: f.sha})
+	}
+
+	entries := d.files
+	for name, sub := range d.dirs {
+		entries = append(entries, treeEntry{mode: "40000", name: name, sha: hashFiles(sub)})
+	}
+
+	// git sorts trees as if their names ended with a slash
+	key := func(e treeEntry) string {
+		if e.mode == "40000" {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+
+	var data bytes.Buffer
+	for _, e := range entries {
+		sha, _ := hex.DecodeString(e.sha)
+		fmt.Fprintf(&data, "%s %s\x00", e.mode, e.name)
+		data.Write(sha)
+	}
+	return hashObject(objTree, data.Bytes())
+}
+
+// packfile reads objects from a git packfile
+type packfile struct {
+	r    io.ReaderAt
+	size int64
+
+	// offset returns the offset of the object in the pack, used for deltas
+	// referring to their base by sha
+	offset func(sha string) (int64, bool)
+
+	// bases caches the objects deltas were applied to, by offset
+	bases map[int64]packObject
+}
+
+type packObject struct {
+	typ  int
+	data []byte
+}
+
+// at returns the object at the offset, with any deltas applied
+func (p *packfile) at(off int64) (int, []byte, error) {
+	if o, ok := p.bases[off]; ok {
+		return o.typ, o.data, nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(p.r, off, p.size-off))
+	typ, size, err := readPackHeader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var base int64
+	switch typ {
+	case objOfsDelta:
+		rel, err := readDeltaOffset(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if rel <= 0 || rel > off {
+			return 0, nil, fmt.Errorf("invalid delta base offset at %d", off)
+		}
+		base = off - rel
+	case objRefDelta:
+		sha := make([]byte, 20)
+		if _, err := io.ReadFull(r, sha); err != nil {
+			return 0, nil, err
+		}
+		var ok bool
+		if base, ok = p.offset(hex.EncodeToString(sha)); !ok {
+			return 0, nil, errObjectMissing(hex.EncodeToString(sha))
+		}
+	}
+
+	data, err := inflate(r, size)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "reading object at %d", off)
+	}
+	if typ != objOfsDelta && typ != objRefDelta {
+		return typ, data, nil
+	}
+
+	btyp, bdata, err := p.at(base)
+	if err != nil {
+		return 0, nil, err
+	}
+	if p.bases == nil {
+		p.bases = make(map[int64]packObject)
+	}
+	p.bases[base] = packObject{typ: btyp, data: bdata}
+
+	data, err = applyDelta(bdata, data)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "applying delta at %d", off)
+	}
+	return btyp, data, nil
+}
+
+// readPackHeader reads the type and inflated size of a packed object
+func readPackHeader(r io.ByteReader) (typ int, size int64, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ = int(b>>4) & 7
+	size = int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// readDeltaOffset reads the distance of an OFS_DELTA to its base
+func readDeltaOffset(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	off := int64(b & 0x7f)
+	for b&0x80 != 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		off = ((off + 1) << 7) | int64(b&0x7f)
+	}
+	return off, nil
+}
+
+// inflate reads a zlib stream of size bytes. r must be an io.ByteReader, so
+// it is read no further than the end of the stream.
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	// read up to the end of the stream, including its checksum
+	if n, err := io.Copy(ioutil.Discard, zr); err != nil || n != 0 {
+		return nil, errors.New("object larger than its size")
+	}
+	return data, nil
+}
+
+// applyDelta returns the object described by the delta against base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	errMalformed := errors.New("malformed delta")
+
+	varint := func() (int, bool) {
+		n, shift := 0, uint(0)
+		for len(delta) > 0 {
+			b := delta[0]
+			delta = delta[1:]
+			n |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+
+	srcSize, ok := varint()
+	if !ok || srcSize != len(base) {
+		return nil, errMalformed
+	}
+	dstSize, ok := varint()
+	if !ok {
+		return nil, errMalformed
+	}
+
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			// copy from base, with the offset and size encoded in the bytes
+			// flagged by op
+			var off, n int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errMalformed
+				}
+				if i < 4 {
+					off |= int(delta[0]) << (8 * i)
+				} else {
+					n |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if off+n > len(base) {
+				return nil, errMalformed
+			}
+			out = append(out, base[off:off+n]...)
+		case op != 0:
+			// insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, errMalformed
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errMalformed
+		}
+	}
+
+	if len(out) != dstSize {
+		return nil, errMalformed
+	}
+	return out, nil
+}
+
+// packStore holds the objects of a packfile received from a remote
+type packStore struct {
+	pack    *packfile
+	offsets map[string]int64
+}
+
+// newPackStore checks the packfile and indexes its objects
+func newPackStore(data []byte) (*packStore, error) {
+	if len(data) < 32 || string(data[:4]) != "PACK" {
+		return nil, errors.New("invalid packfile")
+	}
+	if v := binary.BigEndian.Uint32(data[4:]); v != 2 && v != 3 {
+		return nil, fmt.Errorf("unsupported packfile version %d", v)
+	}
+	sum := sha1.Sum(data[:len(data)-20])
+	if !bytes.Equal(sum[:], data[len(data)-20:]) {
+		return nil, errors.New("packfile checksum mismatch")
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+
+	s := &packStore{offsets: make(map[string]int64, count)}
+	s.pack = &packfile{
+		r:    bytes.NewReader(data),
+		size: int64(len(data)),
+		offset: func(sha string) (int64, bool) {
+			off, ok := s.offsets[sha]
+			return off, ok
+		},
+	}
+
+	// find the offsets of all objects
+	r := bytes.NewReader(data[:len(data)-20])
+	r.Seek(12, io.SeekStart)
+	pending := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		off := r.Size() - int64(r.Len())
+		typ, size, err := readPackHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case objOfsDelta:
+			_, err = readDeltaOffset(r)
+		case objRefDelta:
+			_, err = r.Seek(20, io.SeekCurrent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := inflate(r, size); err != nil {
+			return nil, errors.Wrapf(err, "reading object at %d", off)
+		}
+		pending = append(pending, off)
+	}
+
+	// hash them. Deltas whose base is referred to by sha may come before it,
+	// so they are retried until no more are resolved.
+	for len(pending) > 0 {
+		var missing []int64
+		var err error
+		for _, off := range pending {
+			var typ int
+			var data []byte
+			typ, data, err = s.pack.at(off)
+			if _, ok := err.(errObjectMissing); ok {
+				missing = append(missing, off)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.offsets[hashObject(typ, data)] = off
+		}
+		if len(missing) == len(pending) {
+			return nil, errors.Wrap(err, "thin packs are not supported")
+		}
+		pending = missing
+	}
+
+	// the cached bases are no longer needed
+	s.pack.bases = nil
+	return s, nil
+}
+
+func (s *packStore) object(sha string) (int, []byte, error) {
+	off, ok := s.offsets[sha]
+	if !ok {
+		return 0, nil, errObjectMissing(sha)
+	}
+	return s.pack.at(off)
+}
+
+// repoStore reads the objects of a local repository
+type repoStore struct {
+	dir   string
+	packs []*indexedPack
+}
+
+type indexedPack struct {
+	*packfile
+	idx  []byte
+	file *os.File
+}
+
+// openRepo opens the git directory at dir, which is either a bare repository
+// or holds a .git directory
+func openRepo(dir string) (*repoStore, error) {
+	if fi, err := os.Stat(filepath.Join(dir, ".git")); err == nil && fi.IsDir() {
+		dir = filepath.Join(dir, ".git")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "objects")); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a git repository", dir)
+	}
+
+	s := &repoStore{dir: dir}
+	idxs, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range idxs {
+		p, err := openPack(name)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "opening %s", name)
+		}
+		s.packs = append(s.packs, p)
+	}
+	return s, nil
+}
+
+// openPack reads the version 2 index of a packfile. The pack itself is read
+// on demand.
+func openPack(idxFile string) (*indexedPack, error) {
+	idx, err := ioutil.ReadFile(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx) < 8+1024 || !bytes.Equal(idx[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return nil, errors.New("unsupported pack index")
+	}
+
+	f, err := os.Open(strings.TrimSuffix(idxFile, ".idx") + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p := &indexedPack{idx: idx, file: f}
+	p.packfile = &packfile{r: f, size: fi.Size(), offset: p.find}
+	return p, nil
+}
+
+// find looks up the offset of the object in the index
+func (p *indexedPack) find(sha string) (int64, bool) {
+	key, err := hex.DecodeString(sha)
+	if err != nil || len(key) != 20 {
+		return 0, false
+	}
+
+	fanout := func(i int) int {
+		if i < 0 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint32(p.idx[8+4*i:]))
+	}
+	count := fanout(255)
+	shas := p.idx[8+1024:]
+	lo, hi := fanout(int(key[0])-1), fanout(int(key[0]))
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(shas[(lo+i)*20:(lo+i+1)*20], key) >= 0
+	})
+	if i >= hi || !bytes.Equal(shas[i*20:(i+1)*20], key) {
+		return 0, false
+	}
+
+	offsets := 8 + 1024 + count*24
+	off := binary.BigEndian.Uint32(p.idx[offsets+4*i:])
+	if off&0x80000000 == 0 {
+		return int64(off), true
+	}
+	large := offsets + count*4 + 8*int(off&0x7fffffff)
+	return int64(binary.BigEndian.Uint64(p.idx[large:])), true
+}
+
+// Close closes the packfiles of the repository
+func (s *repoStore) Close() error {
+	for _, p := range s.packs {
+		p.file.Close()
+	}
+	return nil
+}
+
+func (s *repoStore) object(sha string) (int, []byte, error) {
+	if len(sha) != 40 {
+		return 0, nil, errObjectMissing(sha)
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, "objects", sha[:2], sha[2:]))
+	if err == nil {
+		defer f.Close()
+		return readLooseObject(f)
+	}
+	if !os.IsNotExist(err) {
+		return 0, nil, err
+	}
+
+	for _, p := range s.packs {
+		if off, ok := p.find(sha); ok {
+			return p.at(off)
+		}
+	}
+	return 0, nil, errObjectMissing(sha)
+}
+
+// readLooseObject reads an object stored in a file of its own
+func readLooseObject(r io.Reader) (int, []byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return 0, nil, errors.New("malformed object")
+	}
+	header := strings.Fields(string(data[:nul]))
+	if len(header) != 2 {
+		return 0, nil, errors.New("malformed object")
+	}
+	size, err := strconv.Atoi(header[1])
+	if err != nil || size != len(data)-nul-1 {
+		return 0, nil, errors.New("malformed object")
+	}
+
+	for typ, name := range objTypeNames {
+		if name == header[0] {
+			return typ, data[nul+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("unknown object type %s", header[0])
+}
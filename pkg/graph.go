@@ -0,0 +1,298 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// Edge is the requirement of one package on another
+type Edge struct {
+	// From is the name of the requiring package, or RootRequester
+	From string `json:"from"`
+	// To is the name of the required package
+	To string `json:"to"`
+	// Version is the requested version
+	Version string `json:"version"`
+}
+
+// Node is a package of the graph, along with its lock
+type Node struct {
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Sum      string `json:"sum,omitempty"`
+	Excluded bool   `json:"excluded,omitempty"`
+}
+
+// Graph records which package requires which
+type Graph struct {
+	nodes map[string]Node
+	edges map[string][]Edge
+}
+
+// NewGraph returns a Graph that only consists of the RootRequester
+func NewGraph() *Graph {
+	return &Graph{
+		nodes: map[string]Node{RootRequester: {Name: RootRequester}},
+		edges: make(map[string][]Edge),
+	}
+}
+
+// SetNode adds or replaces a node
+func (g *Graph) SetNode(n Node) {
+	g.nodes[n.Name] = n
+}
+
+// Nodes returns all nodes, sorted by name. The RootRequester comes first.
+// Packages that are required but have no node of their own are included
+// without a version.
+func (g *Graph) Nodes() []Node {
+	nodes := make(map[string]Node, len(g.nodes))
+	for name, n := range g.nodes {
+		nodes[name] = n
+	}
+	for _, edges := range g.edges {
+		for _, e := range edges {
+			if _, ok := nodes[e.To]; !ok {
+				nodes[e.To] = Node{Name: e.To}
+			}
+		}
+	}
+
+	list := make([]Node, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == RootRequester || list[j].Name == RootRequester {
+			return list[i].Name == RootRequester
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Edges returns all edges, sorted by requiring and required package
+func (g *Graph) Edges() []Edge {
+	var edges []Edge
+	for _, n := range g.Nodes() {
+		edges = append(edges, g.Requires(n.Name)...)
+	}
+	return edges
+}
+
+// Add records the requirement, unless it is already known
+func (g *Graph) Add(e Edge) {
+	for _, x := range g.edges[e.From] {
+		if x == e {
+			return
+		}
+	}
+	g.edges[e.From] = append(g.edges[e.From], e)
+}
+
+// Requires returns the requirements of the package, sorted by name
+func (g *Graph) Requires(name string) []Edge {
+	edges := append([]Edge{}, g.edges[name]...)
+	sort.SliceStable(edges, func(i, j int) bool {
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// Paths returns every chain of package names leading from RootRequester to the
+// package. Cycles are not followed.
+func (g *Graph) Paths(name string) [][]string {
+	var paths [][]string
+	onPath := make(map[string]bool)
+
+	var visit func(path []string)
+	visit = func(path []string) {
+		current := path[len(path)-1]
+		if current == name {
+			paths = append(paths, append([]string{}, path...))
+			return
+		}
+
+		onPath[current] = true
+		defer delete(onPath, current)
+
+		for _, e := range g.Requires(current) {
+			if onPath[e.To] {
+				continue
+			}
+			visit(append(path, e.To))
+		}
+	}
+	visit([]string{RootRequester})
+
+	return paths
+}
+
+// LoadGraph builds the graph of a project offline, from its jsonnetfile and
+// the jsonnetfiles of the vendored packages listed in locks
+func LoadGraph(direct v1.JsonnetFile, vendorDir string, locks *deps.Ordered) (*Graph, error) {
+	g := NewGraph()
+	for _, l := range sorted(locks) {
+		g.SetNode(Node{Name: l.Name(), Version: l.Version, Tag: l.Tag, Sum: l.Sum, Excluded: l.Excluded})
+	}
+
+	for _, d := range sorted(direct.Dependencies) {
+		g.Add(Edge{From: RootRequester, To: d.Name(), Version: d.Version})
+	}
+
+	for _, l := range sorted(locks) {
+		// neither installed nor were nested ones
+		if l.Excluded || l.Single {
+			continue
+		}
+
+		f, err := jsonnetfile.Load(filepath.Join(vendorDir, l.Name(), jsonnetfile.File))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, d := range sorted(f.Dependencies) {
+			g.Add(Edge{From: l.Name(), To: d.Name(), Version: d.Version})
+		}
+	}
+
+	return g, nil
+}
+
+// MarshalJSON encodes the graph as lists of nodes and edges
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	edges := g.Edges()
+	if edges == nil {
+		edges = []Edge{}
+	}
+
+	return json.Marshal(struct {
+		Nodes []Node `json:"nodes"`
+		Edges []Edge `json:"edges"`
+	}{
+		Nodes: g.Nodes(),
+		Edges: edges,
+	})
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language. Excluded packages
+// are drawn dashed.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph dependencies {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+
+	for _, n := range g.Nodes() {
+		label := make([]string, 0, 3)
+		for _, l := range n.label() {
+			label = append(label, dotEscape(l))
+		}
+
+		attrs := fmt.Sprintf(`label="%s"`, strings.Join(label, `\n`))
+		if n.Excluded {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  \"%s\" [%s];\n", dotEscape(n.Name), attrs)
+	}
+
+	for _, e := range g.Edges() {
+		fmt.Fprintf(&b, "  \"%s\" -> \"%s\" [label=\"%s\"];\n", dotEscape(e.From), dotEscape(e.To), dotEscape(e.Version))
+	}
+
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart. Excluded packages are
+// drawn dashed.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("graph LR\n")
+
+	// Mermaid ids may not contain most characters of package names
+	ids := make(map[string]string)
+	var excluded []string
+	for i, n := range g.Nodes() {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.Name] = id
+
+		label := make([]string, 0, 3)
+		for _, l := range n.label() {
+			label = append(label, mermaidEscape(l))
+		}
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", id, strings.Join(label, "<br/>"))
+
+		if n.Excluded {
+			excluded = append(excluded, id)
+		}
+	}
+
+	for _, e := range g.Edges() {
+		fmt.Fprintf(&b, "  %s -->|\"%s\"| %s\n", ids[e.From], mermaidEscape(e.Version), ids[e.To])
+	}
+
+	if len(excluded) > 0 {
+		b.WriteString("  classDef excluded stroke-dasharray: 5 5\n")
+		fmt.Fprintf(&b, "  class %s excluded\n", strings.Join(excluded, ","))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// label returns the lines describing the node: its name, the locked version
+// and the sum
+func (n Node) label() []string {
+	label := []string{n.Name}
+
+	switch {
+	case n.Excluded:
+		label = append(label, "excluded")
+	case n.Tag != "":
+		label = append(label, fmt.Sprintf("%s (%s)", n.Tag, n.Version))
+	case n.Version != "":
+		label = append(label, n.Version)
+	}
+
+	if n.Sum != "" {
+		label = append(label, n.Sum)
+	}
+	return label
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
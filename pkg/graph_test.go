@@ -0,0 +1,150 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+func TestLoadGraph(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "v2.0.0")
+	tempo := gitDep("tempo", "main")
+
+	locks := deps.NewOrdered()
+	locks.Set(loki.Name(), vendorPackage(t, vendorDir, loki, "v2.0.0", gitDep("grafonnet-lib", "v1.1.0"), builder))
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "v1.2.0")))
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.2.0"))
+
+	// nested dependencies of single packages are not installed
+	single := vendorPackage(t, vendorDir, tempo, "", grafonnet)
+	single.Single = true
+	locks.Set(tempo.Name(), single)
+
+	direct := v1.New()
+	direct.Dependencies.Set(loki.Name(), loki)
+	direct.Dependencies.Set(grafonnet.Name(), grafonnet)
+	direct.Dependencies.Set(tempo.Name(), tempo)
+
+	g, err := LoadGraph(direct, vendorDir, locks)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Edge{
+		{From: loki.Name(), To: grafonnet.Name(), Version: "v1.1.0"},
+		{From: loki.Name(), To: builder.Name(), Version: "v1.0.0"},
+	}, g.Requires(loki.Name()))
+	assert.Empty(t, g.Requires(tempo.Name()))
+
+	nodes := g.Nodes()
+	require.Len(t, nodes, 5)
+	assert.Equal(t, Node{Name: RootRequester}, nodes[0])
+	l, _ := locks.Get(grafonnet.Name())
+	assert.Equal(t, Node{Name: grafonnet.Name(), Version: l.Version, Tag: "v1.2.0", Sum: l.Sum}, nodes[1])
+
+	assert.Equal(t, [][]string{
+		{RootRequester, grafonnet.Name()},
+		{RootRequester, loki.Name(), grafonnet.Name()},
+		{RootRequester, loki.Name(), builder.Name(), grafonnet.Name()},
+	}, g.Paths(grafonnet.Name()))
+	assert.Empty(t, g.Paths("github.com/grafana/unknown"))
+}
+
+func TestGraphPathsCycle(t *testing.T) {
+	g := NewGraph()
+	g.Add(Edge{From: RootRequester, To: "a"})
+	g.Add(Edge{From: "a", To: "b"})
+	g.Add(Edge{From: "b", To: "a"})
+	g.Add(Edge{From: "b", To: "c"})
+	g.Add(Edge{From: "b", To: "c"})
+
+	assert.Equal(t, [][]string{{RootRequester, "a", "b", "c"}}, g.Paths("c"))
+	assert.Len(t, g.Requires("b"), 2)
+}
+
+func testGraph() *Graph {
+	g := NewGraph()
+	g.SetNode(Node{Name: "github.com/grafana/loki", Version: "0123abc", Tag: "v2.0.0", Sum: "c3Vt"})
+	g.SetNode(Node{Name: "github.com/grafana/tempo", Version: "v1.0.0", Excluded: true})
+	g.Add(Edge{From: RootRequester, To: "github.com/grafana/loki", Version: "^2.0.0"})
+	g.Add(Edge{From: "github.com/grafana/loki", To: "github.com/grafana/tempo", Version: "v1.0.0"})
+	g.Add(Edge{From: "github.com/grafana/loki", To: "github.com/grafana/ha\"ck", Version: "master"})
+	return g
+}
+
+func TestGraphDOT(t *testing.T) {
+	var b strings.Builder
+	require.NoError(t, testGraph().WriteDOT(&b))
+	assert.Equal(t, `digraph dependencies {
+  rankdir=LR;
+  node [shape=box];
+  "root" [label="root"];
+  "github.com/grafana/ha\"ck" [label="github.com/grafana/ha\"ck"];
+  "github.com/grafana/loki" [label="github.com/grafana/loki\nv2.0.0 (0123abc)\nc3Vt"];
+  "github.com/grafana/tempo" [label="github.com/grafana/tempo\nexcluded", style=dashed];
+  "root" -> "github.com/grafana/loki" [label="^2.0.0"];
+  "github.com/grafana/loki" -> "github.com/grafana/ha\"ck" [label="master"];
+  "github.com/grafana/loki" -> "github.com/grafana/tempo" [label="v1.0.0"];
+}
+`, b.String())
+}
+
+func TestGraphMermaid(t *testing.T) {
+	var b strings.Builder
+	require.NoError(t, testGraph().WriteMermaid(&b))
+	assert.Equal(t, `graph LR
+  n0["root"]
+  n1["github.com/grafana/ha#quot;ck"]
+  n2["github.com/grafana/loki<br/>v2.0.0 (0123abc)<br/>c3Vt"]
+  n3["github.com/grafana/tempo<br/>excluded"]
+  n0 -->|"^2.0.0"| n2
+  n2 -->|"master"| n1
+  n2 -->|"v1.0.0"| n3
+  classDef excluded stroke-dasharray: 5 5
+  class n3 excluded
+`, b.String())
+}
+
+func TestGraphJSON(t *testing.T) {
+	data, err := json.Marshal(testGraph())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "nodes": [
+    {"name": "root"},
+    {"name": "github.com/grafana/ha\"ck"},
+    {"name": "github.com/grafana/loki", "version": "0123abc", "tag": "v2.0.0", "sum": "c3Vt"},
+    {"name": "github.com/grafana/tempo", "version": "v1.0.0", "excluded": true}
+  ],
+  "edges": [
+    {"from": "root", "to": "github.com/grafana/loki", "version": "^2.0.0"},
+    {"from": "github.com/grafana/loki", "to": "github.com/grafana/ha\"ck", "version": "master"},
+    {"from": "github.com/grafana/loki", "to": "github.com/grafana/tempo", "version": "v1.0.0"}
+  ]
+}`, string(data))
+
+	data, err = json.Marshal(NewGraph())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"nodes": [{"name": "root"}], "edges": []}`, string(data))
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// ArchiveURLFunc returns the URL of a .tar.gz archive of the commit of the
+// repository. The archive must hold a single top-level directory.
+type ArchiveURLFunc func(source *deps.Git, commit string) string
+
+// ArchiveBuilders are the known kinds of code hosting platforms, by name
+var ArchiveBuilders = map[string]ArchiveURLFunc{
+	"github": func(g *deps.Git, commit string) string {
+		return fmt.Sprintf("https://%s/%s/archive/%s.tar.gz", g.Host, repoPath(g), commit)
+	},
+	"gitlab": func(g *deps.Git, commit string) string {
+		return fmt.Sprintf("https://%s/%s/-/archive/%s/%s-%s.tar.gz", g.Host, repoPath(g), commit, repoName(g), commit)
+	},
+	// Forgejo is a fork of Gitea and serves archives the same way
+	"gitea": func(g *deps.Git, commit string) string {
+		return fmt.Sprintf("https://%s/%s/archive/%s.tar.gz", g.Host, repoPath(g), commit)
+	},
+	"bitbucket": func(g *deps.Git, commit string) string {
+		return fmt.Sprintf("https://%s/%s/get/%s.tar.gz", g.Host, repoPath(g), commit)
+	},
+}
+
+// ArchiveHosts maps hosts to the kind of platform they run, which is either
+// the name of one of ArchiveBuilders or a custom URL pattern (see
+// SetArchiveHost). Packages on these hosts are downloaded as a tarball of the
+// requested commit, instead of being fetched using git.
+var ArchiveHosts = map[string]string{
+	"github.com":    "github",
+	"gitlab.com":    "gitlab",
+	"codeberg.org":  "gitea",
+	"gitea.com":     "gitea",
+	"bitbucket.org": "bitbucket",
+}
+
+// SetArchiveHost adds a host to ArchiveHosts, given as host=kind. kind is the
+// name of one of ArchiveBuilders, a URL pattern or "none" to disable archive
+// downloads for the host. Patterns may use the placeholders {host}, {path}
+// (the repository including user or group, without .git), {repo} and
+// {commit}, e.g.
+//
+//	git.example.com=https://{host}/{path}/-/archive/{commit}/{repo}-{commit}.tar.gz
+func SetArchiveHost(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected host=kind, got '%s'", spec)
+	}
+	host, kind := parts[0], parts[1]
+
+	_, known := ArchiveBuilders[kind]
+	if !known && kind != "none" && !strings.Contains(kind, "{commit}") {
+		return fmt.Errorf("unknown archive kind '%s' for %s, must be one of %s, none or a URL pattern including {commit}", kind, host, strings.Join(archiveKinds(), ", "))
+	}
+
+	ArchiveHosts[host] = kind
+	return nil
+}
+
+func archiveKinds() []string {
+	kinds := make([]string, 0, len(ArchiveBuilders))
+	for k := range ArchiveBuilders {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// hostArchiveURL returns the URL of the archive of the commit, if the host of
+// the source is one of ArchiveHosts
+func hostArchiveURL(g *deps.Git, commit string) (string, bool) {
+	kind, ok := ArchiveHosts[g.Host]
+	if !ok || kind == "none" {
+		return "", false
+	}
+
+	if build, ok := ArchiveBuilders[kind]; ok {
+		return build(g, commit), true
+	}
+
+	return strings.NewReplacer(
+		"{host}", g.Host,
+		"{path}", repoPath(g),
+		"{repo}", repoName(g),
+		"{commit}", commit,
+	).Replace(kind), true
+}
+
+// repoPath returns the path of the repository on its host, e.g.
+// grafana/jsonnet-libs
+func repoPath(g *deps.Git) string {
+	return g.User + "/" + repoName(g)
+}
+
+func repoName(g *deps.Git) string {
+	return strings.TrimSuffix(g.Repo, ".git")
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// withArchiveHosts restores ArchiveHosts after the test
+func withArchiveHosts(t *testing.T) {
+	t.Helper()
+
+	old := ArchiveHosts
+	ArchiveHosts = make(map[string]string)
+	for k, v := range old {
+		ArchiveHosts[k] = v
+	}
+	t.Cleanup(func() { ArchiveHosts = old })
+}
+
+func TestHostArchiveURL(t *testing.T) {
+	withArchiveHosts(t)
+	require.NoError(t, SetArchiveHost("git.example.com=gitlab"))
+	require.NoError(t, SetArchiveHost("src.example.com=https://{host}/archives/{path}@{commit}.tgz"))
+	require.NoError(t, SetArchiveHost("github.com=none"))
+
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{
+			uri:  "gitlab.com/foo/bar",
+			want: "https://gitlab.com/foo/bar/-/archive/abc/bar-abc.tar.gz",
+		},
+		{
+			uri:  "https://gitlab.com/group/subgroup/bar.git/lib",
+			want: "https://gitlab.com/group/subgroup/bar/-/archive/abc/bar-abc.tar.gz",
+		},
+		{
+			uri:  "git@git.example.com:group/bar.git",
+			want: "https://git.example.com/group/bar/-/archive/abc/bar-abc.tar.gz",
+		},
+		{
+			uri:  "codeberg.org/foo/bar",
+			want: "https://codeberg.org/foo/bar/archive/abc.tar.gz",
+		},
+		{
+			uri:  "bitbucket.org/foo/bar",
+			want: "https://bitbucket.org/foo/bar/get/abc.tar.gz",
+		},
+		{
+			uri:  "src.example.com/foo/bar",
+			want: "https://src.example.com/archives/foo/bar@abc.tgz",
+		},
+		{
+			// disabled
+			uri: "github.com/foo/bar",
+		},
+		{
+			// unknown
+			uri: "example.org/foo/bar",
+		},
+	}
+
+	for _, c := range tests {
+		d := deps.Parse("", c.uri)
+		require.NotNil(t, d, c.uri)
+
+		got, ok := hostArchiveURL(d.Source.GitSource, "abc")
+		assert.Equal(t, c.want != "", ok, c.uri)
+		assert.Equal(t, c.want, got, c.uri)
+	}
+}
+
+func TestSetArchiveHost(t *testing.T) {
+	withArchiveHosts(t)
+
+	assert.NoError(t, SetArchiveHost("git.example.com:8443=gitea"))
+	assert.Equal(t, "gitea", ArchiveHosts["git.example.com:8443"])
+
+	assert.Error(t, SetArchiveHost("git.example.com"))
+	assert.Error(t, SetArchiveHost("git.example.com=sourcehut"))
+	assert.Error(t, SetArchiveHost("git.example.com=https://{host}/{path}.tar.gz"))
+}
+
+func TestInstallHostArchive(t *testing.T) {
+	remote, repo := testUpstream(t, "v1.0.0")
+	commit := revParse(t, repo, "v1.0.0")
+	main := archiveEntry{name: "bar-" + commit + "/main.libsonnet", content: `"v1.0.0"`}
+
+	var requested string
+	var entries []archiveEntry
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Write(makeTar(t, entries, true))
+	}))
+	defer srv.Close()
+
+	withArchiveHosts(t)
+	require.NoError(t, SetArchiveHost("example.com="+srv.URL+"/{path}/{commit}.tar.gz"))
+
+	source := deps.Parse("", remote).Source.GitSource
+	tests := []struct {
+		name     string
+		entries  []archiveEntry
+		fallback bool
+	}{
+		{name: "archive", entries: []archiveEntry{main}},
+		{
+			// e.g. because of export-ignore attributes
+			name:     "differs from the repository",
+			entries:  []archiveEntry{{name: main.name, content: `"archive"`}},
+			fallback: true,
+		},
+		{
+			name:    "entries outside of the package",
+			entries: []archiveEntry{{name: "../evil", content: "{}"}, {name: "bar-" + commit + "/../../evil", content: "{}"}, main},
+		},
+		{
+			name:     "symlink outside of the package",
+			entries:  []archiveEntry{main, {name: "bar-" + commit + "/passwd", link: "../../../etc/passwd"}},
+			fallback: true,
+		},
+	}
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			vendorDir := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+			entries = c.entries
+			out := &bufferedOutput{}
+			got, err := NewGitPackage(source).Install(withOutput(context.TODO(), out), "bar", vendorDir, "v1.0.0")
+			require.NoError(t, err)
+			assert.Equal(t, commit, got)
+			assert.Equal(t, "/foo/bar/"+commit+".tar.gz", requested)
+			assert.Equal(t, `"v1.0.0"`, readMain(t, filepath.Join(vendorDir, "bar")))
+			assert.Equal(t, c.fallback, strings.Contains(out.buf.String(), "retrying with git"), out.buf.String())
+
+			for _, p := range []string{filepath.Join(vendorDir, "evil"), filepath.Join(vendorDir, ".tmp", "evil")} {
+				_, err = os.Stat(p)
+				assert.True(t, os.IsNotExist(err), p)
+			}
+		})
+	}
+
+	// the locked tree saves looking it up
+	trees := &treeCounter{GitBackend: gitBackend()}
+	GitBackends["counter"] = trees
+	oldBackend := GitBackendName
+	GitBackendName = "counter"
+	defer func() {
+		GitBackendName = oldBackend
+		delete(GitBackends, "counter")
+	}()
+
+	entries = []archiveEntry{main}
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	_, err := NewGitPackage(source).Install(context.TODO(), "bar", vendorDir, "v1.0.0")
+	require.NoError(t, err)
+	tree, err := gitTreeHash(filepath.Join(vendorDir, "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, trees.n)
+
+	out := &bufferedOutput{}
+	_, err = (&GitPackage{Source: source, Tree: tree}).Install(withOutput(context.TODO(), out), "bar", vendorDir, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, 1, trees.n)
+	assert.NotContains(t, out.buf.String(), "retrying with git")
+
+	// an archive of other files than locked is not used
+	entries = []archiveEntry{{name: main.name, content: `"archive"`}}
+	out = &bufferedOutput{}
+	_, err = (&GitPackage{Source: source, Tree: tree}).Install(withOutput(context.TODO(), out), "bar", vendorDir, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, 1, trees.n)
+	assert.Contains(t, out.buf.String(), "retrying with git")
+	assert.Equal(t, `"v1.0.0"`, readMain(t, filepath.Join(vendorDir, "bar")))
+}
+
+// treeCounter is a GitBackend counting the trees looked up
+type treeCounter struct {
+	GitBackend
+	n int
+}
+
+func (c *treeCounter) Tree(ctx context.Context, remote, commit, subdir string) (string, error) {
+	c.n++
+	return c.GitBackend.Tree(ctx, remote, commit, subdir)
+}
@@ -43,7 +43,9 @@ func (p *LocalPackage) Install(ctx context.Context, name, dir, version string) (
 
 	oldname := filepath.Join(wd, p.Source.Directory)
 	newname := filepath.Join(dir, name)
-	linkname, err := filepath.Rel(dir, oldname)
+	// names of replaced packages may contain slashes, so the link needs to be
+	// relative to its parent directory
+	linkname, err := filepath.Rel(filepath.Dir(newname), oldname)
 
 	if err != nil {
 		linkname = oldname
@@ -59,12 +61,19 @@ func (p *LocalPackage) Install(ctx context.Context, name, dir, version string) (
 		return "", errors.Wrap(err, "symlink destination path does not exist")
 	}
 
+	if parent := filepath.Dir(newname); parent != filepath.Clean(dir) {
+		err = os.MkdirAll(parent, os.ModePerm)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to create parent path")
+		}
+	}
+
 	err = os.Symlink(linkname, newname)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to create symlink for local dependency")
 	}
 
-	color.Magenta("LOCAL %s -> %s", name, oldname)
+	printf(ctx, color.FgMagenta, "LOCAL %s -> %s", name, oldname)
 
 	return "", nil
 }
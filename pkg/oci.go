@@ -0,0 +1,452 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// OCILayerMediaType is the media type of the layer holding the package, as a
+// gzipped tarball. Artifacts with a single layer may use any tar media type.
+const OCILayerMediaType = "application/vnd.jsonnet-bundler.package.v1.tar+gzip"
+
+const (
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// annotation of the manifests of an image layout holding their tag
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// maxManifestSize limits how much of a manifest is read
+const maxManifestSize = 4 << 20
+
+type OCIPackage struct {
+	Source *deps.OCI
+}
+
+func NewOCIPackage(source *deps.OCI) Interface {
+	return &OCIPackage{
+		Source: source,
+	}
+}
+
+// Install pulls the artifact at version, a tag or digest, from the registry or
+// the image layout and extracts its package layer to dir/name. The digest of
+// the manifest is returned as the lock version.
+func (p *OCIPackage) Install(ctx context.Context, name, dir, version string) (string, error) {
+	if version == "" {
+		version = "latest"
+	}
+
+	var store ociStore
+	switch {
+	case p.Source.Layout != "":
+		store = ociLayout{dir: p.Source.Layout}
+	case Offline:
+		return "", errOffline
+	default:
+		r, err := newOCIRegistry(p.Source.Repository)
+		if err != nil {
+			return "", err
+		}
+		store = r
+	}
+
+	data, digest, err := store.manifest(ctx, version)
+	if err != nil {
+		return "", errors.Wrapf(err, "fetching manifest of %s@%s", p.Source.Name(), version)
+	}
+	layer, err := packageLayer(data)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s@%s", p.Source.Name(), version)
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Join(dir, ".tmp"), "oci-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "layer")
+	if err := store.blob(ctx, layer.Digest, file); err != nil {
+		return "", errors.Wrapf(err, "fetching layer %s", layer.Digest)
+	}
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return "", err
+	}
+	if "sha256:"+sum != layer.Digest {
+		return "", fmt.Errorf("digest mismatch for layer of %s@%s: expected %s, got sha256:%s", p.Source.Name(), version, layer.Digest, sum)
+	}
+
+	extracted := filepath.Join(tmpDir, "pkg")
+	if err := extractArchive(file, extracted, 0, strings.Trim(p.Source.Subdir, "/")); err != nil {
+		return "", errors.Wrapf(err, "extracting layer %s", layer.Digest)
+	}
+
+	if err := movePackage(extracted, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// ociResolve records requested tags in the lock, which holds the digest the
+// tag pointed to
+func ociResolve(ctx context.Context, spec deps.Spec, version string) (Resolution, error) {
+	if version == "" {
+		version = "latest"
+	}
+	if deps.IsDigest(version) {
+		return Resolution{Version: version, Pinned: version}, nil
+	}
+	return Resolution{Version: version, Tag: version}, nil
+}
+
+// ociLockSatisfies requires the lock to be of the requested digest or tag
+func ociLockSatisfies(d, l deps.Dependency) bool {
+	if deps.IsDigest(d.Version) {
+		return l.Version == d.Version
+	}
+	return l.Tag == d.Version || (d.Version == "" && l.Tag == "latest")
+}
+
+// ociDescriptor references a blob of an artifact
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an image manifest, or an image index if Manifests is set
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// packageLayer returns the layer of the manifest holding the package: the one
+// of OCILayerMediaType, or the only one if it is a tarball
+func packageLayer(data []byte) (ociDescriptor, error) {
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ociDescriptor{}, errors.Wrap(err, "parsing manifest")
+	}
+
+	switch m.MediaType {
+	case ociIndexMediaType, dockerManifestListMediaType:
+		return ociDescriptor{}, errors.New("image indexes are not supported, the tag must point to a single manifest")
+	}
+
+	for _, l := range m.Layers {
+		if l.MediaType == OCILayerMediaType {
+			return l, nil
+		}
+	}
+	if len(m.Layers) == 1 && strings.Contains(m.Layers[0].MediaType, "tar") {
+		return m.Layers[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("artifact has no layer of type %s", OCILayerMediaType)
+}
+
+// ociStore is where artifacts are pulled from
+type ociStore interface {
+	// manifest returns the manifest of the tag or digest, along with its
+	// digest. The contents were verified against a requested digest.
+	manifest(ctx context.Context, ref string) ([]byte, string, error)
+	// blob writes the blob to file
+	blob(ctx context.Context, digest, file string) error
+}
+
+// digestExp matches the sha256 digests supported for blobs and manifests
+var digestExp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// manifestDigest returns the digest of the manifest. If ref is a digest, it
+// must match.
+func manifestDigest(data []byte, ref string) (string, error) {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if deps.IsDigest(ref) && ref != digest {
+		return "", fmt.Errorf("digest mismatch for manifest: expected %s, got %s", ref, digest)
+	}
+	return digest, nil
+}
+
+// ociRegistry pulls artifacts from a registry using the OCI distribution API
+type ociRegistry struct {
+	scheme, host, repo string
+	// token is the bearer token the registry handed out, if it asked for one
+	token string
+}
+
+// newOCIRegistry returns the registry of the repository, e.g.
+// registry.example.com/jsonnet/foo. Registries on localhost are accessed over
+// plain HTTP, all others over HTTPS.
+func newOCIRegistry(repository string) (*ociRegistry, error) {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid OCI repository '%s', must be <registry>/<repository>", repository)
+	}
+
+	r := &ociRegistry{scheme: "https", host: parts[0], repo: parts[1]}
+	switch strings.Split(r.host, ":")[0] {
+	case "localhost", "127.0.0.1":
+		r.scheme = "http"
+	}
+	return r, nil
+}
+
+func (r *ociRegistry) url(kind, ref string) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", r.scheme, r.host, r.repo, kind, ref)
+}
+
+// get requests the url, authorizing once if the registry asks for a token.
+// Temporary failures are retried.
+func (r *ociRegistry) get(ctx context.Context, u, accept string, fn func(resp *http.Response) error) error {
+	return withRetry(ctx, func() error {
+		for authorized := false; ; authorized = true {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return err
+			}
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			if r.token != "" {
+				req.Header.Set("Authorization", "Bearer "+r.token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return networkError(ctx, err)
+			}
+
+			if resp.StatusCode == http.StatusUnauthorized && !authorized {
+				challenge := resp.Header.Get("WWW-Authenticate")
+				resp.Body.Close()
+				if err := r.authorize(ctx, challenge); err != nil {
+					return err
+				}
+				continue
+			}
+
+			return func() error {
+				defer resp.Body.Close()
+				if !GitQuiet {
+					printf(ctx, color.FgCyan, "GET %s %d", u, resp.StatusCode)
+				}
+				if resp.StatusCode != http.StatusOK {
+					return httpStatusError(resp)
+				}
+				return fn(resp)
+			}()
+		}
+	})
+}
+
+// challengeExp matches the parameters of a WWW-Authenticate header
+var challengeExp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authorize obtains a bearer token, as described by the challenge of the
+// registry. The credentials of the registry, if any, are sent along; without
+// them, the token is anonymous.
+func (r *ociRegistry) authorize(ctx context.Context, challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("registry %s requires authentication", r.host)
+	}
+
+	params := make(map[string]string)
+	for _, m := range challengeExp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("registry %s sent an invalid challenge: %s", r.host, challenge)
+	}
+	if params["scope"] == "" {
+		params["scope"] = fmt.Sprintf("repository:%s:pull", r.repo)
+	}
+
+	q := url.Values{}
+	q.Set("scope", params["scope"])
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var creds *credentials
+	if sendCredentials(req.URL) {
+		// token services only take basic authentication, tokens are sent
+		// the same way as to git
+		if creds = lookupCredentials(ctx, r.host); creds != nil {
+			req.Header.Set("Authorization", creds.gitHeader())
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return networkError(ctx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return authFailed(httpStatusError(resp), r.host, creds)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return networkError(ctx, err)
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry %s handed out no token", r.host)
+	}
+	return nil
+}
+
+func (r *ociRegistry) manifest(ctx context.Context, ref string) ([]byte, string, error) {
+	accept := strings.Join([]string{ociManifestMediaType, dockerManifestMediaType, ociIndexMediaType, dockerManifestListMediaType}, ", ")
+
+	var data []byte
+	err := r.get(ctx, r.url("manifests", ref), accept, func(resp *http.Response) error {
+		var err error
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+		return networkError(ctx, err)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest, err := manifestDigest(data, ref)
+	return data, digest, err
+}
+
+func (r *ociRegistry) blob(ctx context.Context, digest, file string) error {
+	if !digestExp.MatchString(digest) {
+		return fmt.Errorf("unsupported digest '%s'", digest)
+	}
+
+	return r.get(ctx, r.url("blobs", digest), "", func(resp *http.Response) error {
+		out, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, resp.Body)
+		return networkError(ctx, err)
+	})
+}
+
+// ociLayout reads artifacts from an OCI image layout directory. Tags are
+// looked up using the ref.name annotation of the manifests in index.json.
+type ociLayout struct {
+	dir string
+}
+
+func (l ociLayout) path(digest string) (string, error) {
+	if !digestExp.MatchString(digest) {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	return filepath.Join(l.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+func (l ociLayout) manifest(ctx context.Context, ref string) ([]byte, string, error) {
+	digest := ref
+	if !deps.IsDigest(ref) {
+		data, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "reading image layout")
+		}
+		var index ociManifest
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, "", errors.Wrap(err, "parsing index.json")
+		}
+
+		digest = ""
+		for _, m := range index.Manifests {
+			if m.Annotations[ociRefNameAnnotation] == ref {
+				digest = m.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, "", fmt.Errorf("tag %s not found in %s", ref, l.dir)
+		}
+	}
+
+	file, err := l.path(digest)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := manifestDigest(data, digest); err != nil {
+		return nil, "", err
+	}
+	return data, digest, nil
+}
+
+func (l ociLayout) blob(ctx context.Context, digest, file string) error {
+	src, err := l.path(digest)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// writeBlob adds the blob to the image layout and returns its digest
+func writeBlob(t *testing.T, layout string, data []byte) string {
+	t.Helper()
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	require.NoError(t, os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layout, "blobs", "sha256", digest), data, 0644))
+	return "sha256:" + digest
+}
+
+// testLayout creates an OCI image layout holding the package under the tag.
+// It returns the digest of the manifest.
+func testLayout(t *testing.T, layout, tag string, entries []archiveEntry) string {
+	t.Helper()
+
+	layer := makeTar(t, entries, true)
+	config := []byte("{}")
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config":        ociDescriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: writeBlob(t, layout, config), Size: int64(len(config))},
+		"layers":        []ociDescriptor{{MediaType: OCILayerMediaType, Digest: writeBlob(t, layout, layer), Size: int64(len(layer))}},
+	})
+	require.NoError(t, err)
+	digest := writeBlob(t, layout, manifest)
+
+	var index ociManifest
+	if data, err := ioutil.ReadFile(filepath.Join(layout, "index.json")); err == nil {
+		require.NoError(t, json.Unmarshal(data, &index))
+	}
+	index.Manifests = append(index.Manifests, ociDescriptor{
+		MediaType:   ociManifestMediaType,
+		Digest:      digest,
+		Size:        int64(len(manifest)),
+		Annotations: map[string]string{ociRefNameAnnotation: tag},
+	})
+	data, err := json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": index.Manifests})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layout, "index.json"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+
+	return digest
+}
+
+func testPackageEntries(content string) []archiveEntry {
+	return []archiveEntry{
+		{name: "main.libsonnet", content: content},
+		{name: "lib/util.libsonnet", content: "{}"},
+	}
+}
+
+// testRegistry serves the image layout as repository jsonnet/foo, handing out
+// a bearer token first. If auth is set, it is required to get the token.
+func testRegistry(t *testing.T, layout, auth string) string {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal(t, "repository:jsonnet/foo:pull", r.URL.Query().Get("scope"))
+			if auth != "" && r.Header.Get("Authorization") != auth {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		l := ociLayout{dir: layout}
+		switch p := strings.TrimPrefix(r.URL.Path, "/v2/jsonnet/foo/"); {
+		case strings.HasPrefix(p, "manifests/"):
+			data, _, err := l.manifest(r.Context(), strings.TrimPrefix(p, "manifests/"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			w.Write(data)
+		case strings.HasPrefix(p, "blobs/"):
+			file, err := l.path(strings.TrimPrefix(p, "blobs/"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, file)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://") + "/jsonnet/foo"
+}
+
+func installOCI(t *testing.T, o *deps.OCI, version string) (string, string, error) {
+	t.Helper()
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	digest, err := NewOCIPackage(o).Install(context.TODO(), "foo", vendorDir, version)
+	return filepath.Join(vendorDir, "foo"), digest, err
+}
+
+func TestOCILayout(t *testing.T) {
+	layout := t.TempDir()
+	d1 := testLayout(t, layout, "v1.0.0", testPackageEntries(`"v1"`))
+	d2 := testLayout(t, layout, "v2.0.0", testPackageEntries(`"v2"`))
+
+	dir, digest, err := installOCI(t, &deps.OCI{Layout: layout}, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, d1, digest)
+	assert.Equal(t, `"v1"`, readMain(t, dir))
+
+	dir, digest, err = installOCI(t, &deps.OCI{Layout: layout}, d2)
+	require.NoError(t, err)
+	assert.Equal(t, d2, digest)
+	assert.Equal(t, `"v2"`, readMain(t, dir))
+
+	dir, _, err = installOCI(t, &deps.OCI{Layout: layout, Subdir: "lib"}, "v1.0.0")
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "util.libsonnet"))
+	assert.NoError(t, err)
+
+	_, _, err = installOCI(t, &deps.OCI{Layout: layout}, "v3.0.0")
+	assert.Error(t, err)
+
+	// layouts work without network access
+	Offline = true
+	defer func() { Offline = false }()
+	_, _, err = installOCI(t, &deps.OCI{Layout: layout}, "v1.0.0")
+	assert.NoError(t, err)
+}
+
+func TestOCIRegistry(t *testing.T) {
+	layout := t.TempDir()
+	digest := testLayout(t, layout, "v1.0.0", testPackageEntries(`"v1"`))
+	repo := testRegistry(t, layout, "")
+
+	dir, got, err := installOCI(t, &deps.OCI{Repository: repo}, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, digest, got)
+	assert.Equal(t, `"v1"`, readMain(t, dir))
+
+	_, got, err = installOCI(t, &deps.OCI{Repository: repo}, digest)
+	require.NoError(t, err)
+	assert.Equal(t, digest, got)
+
+	_, _, err = installOCI(t, &deps.OCI{Repository: repo}, "v9.9.9")
+	assert.Error(t, err)
+
+	Offline = true
+	defer func() { Offline = false }()
+	_, _, err = installOCI(t, &deps.OCI{Repository: repo}, "v1.0.0")
+	assert.Equal(t, errOffline, err)
+}
+
+func TestOCIRegistryCredentials(t *testing.T) {
+	withCredentials(t)
+	layout := t.TempDir()
+	digest := testLayout(t, layout, "v1.0.0", testPackageEntries(`"v1"`))
+	repo := testRegistry(t, layout, credentials{username: "user", password: "pass"}.basic())
+
+	_, _, err := installOCI(t, &deps.OCI{Repository: repo}, "v1.0.0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "authentication required")
+
+	t.Setenv("JB_AUTH_127_0_0_1", "user:pass")
+	credentialsCache = make(map[string]*credentials)
+	_, got, err := installOCI(t, &deps.OCI{Repository: repo}, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, digest, got)
+}
+
+func TestOCITampered(t *testing.T) {
+	layout := t.TempDir()
+	digest := testLayout(t, layout, "v1.0.0", testPackageEntries(`"v1"`))
+
+	data, _, err := ociLayout{dir: layout}.manifest(context.TODO(), digest)
+	require.NoError(t, err)
+	layer, err := packageLayer(data)
+	require.NoError(t, err)
+
+	file, err := ociLayout{dir: layout}.path(layer.Digest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, makeTar(t, testPackageEntries(`"evil"`), true), 0644))
+
+	dir, _, err := installOCI(t, &deps.OCI{Layout: layout}, "v1.0.0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLockSatisfiesOCI(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	source := deps.Source{OCISource: &deps.OCI{Repository: "registry.example.com/jsonnet/foo"}}
+	l := deps.Dependency{Source: source, Version: digest, Tag: "v1.0.0"}
+
+	assert.True(t, lockSatisfies(deps.Dependency{Source: source, Version: "v1.0.0"}, l))
+	assert.True(t, lockSatisfies(deps.Dependency{Source: source, Version: digest}, l))
+	assert.False(t, lockSatisfies(deps.Dependency{Source: source, Version: "v1.1.0"}, l))
+	assert.False(t, lockSatisfies(deps.Dependency{Source: source, Version: "sha256:" + strings.Repeat("cd", 32)}, l))
+}
+
+func TestEnsureOCI(t *testing.T) {
+	layout := t.TempDir()
+	digest := testLayout(t, layout, "v1.0.0", testPackageEntries(`"v1"`))
+	d := deps.Dependency{Source: deps.Source{OCISource: &deps.OCI{Layout: layout, PackageName: "example.com/foo"}}, Version: "v1.0.0"}
+
+	direct := v1.New()
+	direct.Dependencies.Set(d.Name(), d)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	locks, err := Ensure(context.TODO(), direct, vendorDir, deps.NewOrdered())
+	require.NoError(t, err)
+
+	l, ok := locks.Get("example.com/foo")
+	require.True(t, ok)
+	assert.Equal(t, digest, l.Version)
+	assert.Equal(t, "v1.0.0", l.Tag)
+	assert.Equal(t, `"v1"`, readMain(t, filepath.Join(vendorDir, "example.com/foo")))
+}
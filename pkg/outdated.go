@@ -0,0 +1,139 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// OutdatedPackage compares a locked git package to its upstream
+type OutdatedPackage struct {
+	Name string `json:"name"`
+	// Direct is true if the project itself requires the package
+	Direct bool `json:"direct"`
+	// Version is the requested version. The one of the project takes
+	// precedence over those of nested jsonnetfiles.
+	Version string `json:"version"`
+
+	// Locked is the locked commit
+	Locked string `json:"locked"`
+	// LockedTag is the locked semver tag, if any
+	LockedTag string `json:"lockedTag,omitempty"`
+
+	// Branch is the tracked branch: the requested version if it is a branch,
+	// HEAD otherwise
+	Branch string `json:"branch"`
+	// Head is the current commit of Branch
+	Head string `json:"head,omitempty"`
+	// Latest is the newest semver tag of the upstream
+	Latest string `json:"latest,omitempty"`
+
+	// Update is true if a newer version is available: A newer tag for tagged
+	// packages, a different head for all others.
+	Update bool `json:"update"`
+	// Error is set if the upstream could not be queried
+	Error string `json:"error,omitempty"`
+}
+
+// Outdated queries the upstream of every locked git package, including nested
+// ones, for newer versions. Upstreams that cannot be reached are reported
+// using OutdatedPackage.Error.
+func Outdated(ctx context.Context, direct v1.JsonnetFile, vendorDir string, locks *deps.Ordered) ([]OutdatedPackage, error) {
+	graph, err := LoadGraph(direct, vendorDir, locks)
+	if err != nil {
+		return nil, err
+	}
+
+	// requested versions, the root first
+	requested := make(map[string]string)
+	for _, e := range graph.Edges() {
+		if _, ok := requested[e.To]; !ok {
+			requested[e.To] = e.Version
+		}
+	}
+
+	var list []OutdatedPackage
+	for _, l := range sorted(locks) {
+		u := l.Upstream()
+		if l.Excluded || u.Source.GitSource == nil {
+			continue
+		}
+
+		_, isDirect := direct.Dependencies.Get(l.Name())
+		o := OutdatedPackage{
+			Name:      l.Name(),
+			Direct:    isDirect,
+			Version:   requested[l.Name()],
+			Locked:    l.Version,
+			LockedTag: l.Tag,
+		}
+		if u.Version != "" && l.Replace != nil {
+			o.Version = u.Version
+		}
+
+		if err := o.check(ctx, u.Source.GitSource.Remote()); err != nil {
+			o.Error = err.Error()
+		}
+		list = append(list, o)
+	}
+
+	return list, nil
+}
+
+// check fills in the upstream state of o by listing the refs of remote
+func (o *OutdatedPackage) check(ctx context.Context, remote string) error {
+	refs, err := remoteListRefs(ctx, remote)
+	if err != nil {
+		return err
+	}
+
+	// newest release, prereleases are not considered
+	var latest *semver.Version
+	for ref := range refs {
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		if tag == ref {
+			continue
+		}
+		v, err := semver.Parse(tag)
+		if err != nil || len(v.Prerelease) > 0 {
+			continue
+		}
+		if latest == nil || latest.LessThan(v) {
+			latest = &v
+			o.Latest = tag
+		}
+	}
+
+	o.Branch = "HEAD"
+	if _, ok := refs["refs/heads/"+o.Version]; ok && o.Version != "" {
+		o.Branch = o.Version
+		o.Head = refs["refs/heads/"+o.Version]
+	} else {
+		o.Head = refs["HEAD"]
+	}
+
+	switch {
+	case o.LockedTag != "":
+		o.Update = isHigher(o.Latest, o.LockedTag)
+	case !isTag(o.Version) && !semver.IsConstraint(o.Version):
+		o.Update = o.Head != "" && o.Head != o.Locked
+	}
+	return nil
+}
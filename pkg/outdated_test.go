@@ -0,0 +1,74 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutdatedCheck(t *testing.T) {
+	repo := testRepo(t, "v1.0.0", "a:v1.1.0", "v1.2.0-rc.1")
+	head := revParse(t, repo, "HEAD")
+
+	out, err := exec.Command("git", "-C", repo, "symbolic-ref", "--short", "HEAD").Output()
+	require.NoError(t, err)
+	branch := strings.TrimSpace(string(out))
+
+	tests := []struct {
+		name string
+		in   OutdatedPackage
+		want OutdatedPackage
+	}{
+		{
+			name: "tag",
+			in:   OutdatedPackage{Version: "v1.0.0", Locked: revParse(t, repo, "v1.0.0"), LockedTag: "v1.0.0"},
+			want: OutdatedPackage{Version: "v1.0.0", Locked: revParse(t, repo, "v1.0.0"), LockedTag: "v1.0.0", Branch: "HEAD", Head: head, Latest: "v1.1.0", Update: true},
+		},
+		{
+			name: "latest-tag",
+			in:   OutdatedPackage{Version: "^1.0.0", Locked: revParse(t, repo, "v1.1.0"), LockedTag: "v1.1.0"},
+			want: OutdatedPackage{Version: "^1.0.0", Locked: revParse(t, repo, "v1.1.0"), LockedTag: "v1.1.0", Branch: "HEAD", Head: head, Latest: "v1.1.0"},
+		},
+		{
+			name: "branch",
+			in:   OutdatedPackage{Version: branch, Locked: revParse(t, repo, "v1.0.0")},
+			want: OutdatedPackage{Version: branch, Locked: revParse(t, repo, "v1.0.0"), Branch: branch, Head: head, Latest: "v1.1.0", Update: true},
+		},
+		{
+			name: "branch-current",
+			in:   OutdatedPackage{Version: branch, Locked: head},
+			want: OutdatedPackage{Version: branch, Locked: head, Branch: branch, Head: head, Latest: "v1.1.0"},
+		},
+		{
+			name: "commit",
+			in:   OutdatedPackage{Version: revParse(t, repo, "v1.0.0"), Locked: revParse(t, repo, "v1.0.0")},
+			want: OutdatedPackage{Version: revParse(t, repo, "v1.0.0"), Locked: revParse(t, repo, "v1.0.0"), Branch: "HEAD", Head: head, Latest: "v1.1.0", Update: true},
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			o := c.in
+			require.NoError(t, o.check(context.TODO(), repo))
+			assert.Equal(t, c.want, o)
+		})
+	}
+}
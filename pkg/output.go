@@ -0,0 +1,74 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+type outputKey struct{}
+
+// withOutput returns a context that directs all output of installing a
+// package, including that of git, to w
+func withOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+// output returns where to print progress of installing a package.
+// Defaults to color.Output.
+func output(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		return w
+	}
+	return color.Output
+}
+
+// printf prints a line in the given color to the output of ctx
+func printf(ctx context.Context, c color.Attribute, format string, a ...interface{}) {
+	color.New(c).Fprintf(output(ctx), format+"\n", a...)
+}
+
+// bufferedOutput collects the output of a single package, so that packages
+// installed concurrently don't interleave
+type bufferedOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *bufferedOutput) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// outputMu serializes flushing of buffered outputs
+var outputMu sync.Mutex
+
+// flush writes everything collected so far to color.Output at once
+func (b *bufferedOutput) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	color.Output.Write(b.buf.Bytes())
+	b.buf.Reset()
+}
@@ -22,37 +22,83 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
 
 	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
 	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
 	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+	"github.com/jsonnet-bundler/jsonnet-bundler/tool/imports"
 )
 
 var (
 	VersionMismatch = errors.New("multiple colliding versions specified")
+
+	// errOffline is returned by download if a package cannot be installed
+	// without network access
+	errOffline = errors.New("not available offline")
 )
 
+// Jobs limits how many packages are installed concurrently
+var Jobs = 4
+
+// Offline forbids any network access. Packages must be present in vendor/
+// already, or be available from the package cache.
+var Offline = false
+
+// FetchTimeout limits how long installing a single package may take, including
+// all git and HTTP operations. Zero means no limit.
+var FetchTimeout time.Duration
+
+// OfflineError lists the packages that could not be installed, because they
+// are neither vendored nor cached and Offline is set
+type OfflineError struct {
+	Missing []Request
+}
+
+func (e *OfflineError) Error() string {
+	s := "cannot install the following packages without network access:"
+	for _, r := range e.Missing {
+		s += fmt.Sprintf("\n  - %s@%s, required by %s", r.dep.Name(), r.Version, r.Requester)
+	}
+	return s
+}
+
 // Ensure receives all direct packages, the directory to vendor into and all known locks.
 // It then makes sure all direct and nested dependencies are present in vendor at the correct version:
 //
 // If the package is locked and the files in vendor match the sha256 checksum,
 // nothing needs to be done. Otherwise, the package is retrieved from the
-// upstream source and added into vendor. If previously locked, the sums are
-// checked as well.
-// In case a (nested) package is already present in the lock,
-// the one from the lock takes precedence. This allows the user to set the
-// desired version in case by `jb install`ing it.
+// package cache or the upstream source and added into vendor. If previously
+// locked, the sums are checked as well.
+// If a package is required at several semver tags, the highest of them is
+// installed (minimal version selection). Other disagreements are handled
+// according to the Conflicts policy.
+// In case a (nested) package that is not required at a semver tag is already
+// present in the lock, the one from the lock takes precedence. This allows the
+// user to set the desired version in case by `jb install`ing it.
+//
+// Nested packages matching an exclusion of direct are skipped. A warning is
+// printed if vendored code still imports them.
 //
 // Finally, all unknown files and directories are removed from vendor/
 // The full list of locked depedencies is returned
-func Ensure(direct v1.JsonnetFile, vendorDir string, oldLocks *deps.Ordered) (*deps.Ordered, error) {
+//
+// Cancelling ctx stops all git and HTTP operations in flight. Temporary
+// files in vendor/.tmp are removed in any case.
+func Ensure(ctx context.Context, direct v1.JsonnetFile, vendorDir string, oldLocks *deps.Ordered) (*deps.Ordered, error) {
+	defer os.RemoveAll(filepath.Join(vendorDir, ".tmp"))
+
 	// ensure all required files are in vendor
 	// This is the actual installation
-	locks, err := ensure(direct.Dependencies, vendorDir, "", oldLocks)
+	locks, err := newResolver(vendorDir, oldLocks, Conflicts, direct.Replace, direct.Exclude).resolve(ctx, direct.Dependencies)
 	if err != nil {
 		return nil, err
 	}
@@ -94,10 +140,13 @@ func Ensure(direct v1.JsonnetFile, vendorDir string, oldLocks *deps.Ordered) (*d
 	if err := cleanLegacySymlinks(vendorDir, locks); err != nil {
 		return nil, err
 	}
-	if !direct.LegacyImports {
-		return locks, nil
+	if direct.LegacyImports {
+		if err := linkLegacy(vendorDir, locks); err != nil {
+			return nil, err
+		}
 	}
-	if err := linkLegacy(vendorDir, locks); err != nil {
+
+	if err := warnExcludedImports(vendorDir, locks); err != nil {
 		return nil, err
 	}
 
@@ -118,11 +167,14 @@ func CleanLegacyName(list *deps.Ordered) {
 }
 
 func cleanLegacySymlinks(vendorDir string, locks *deps.Ordered) error {
-	// local packages need to be ignored
+	// local packages need to be ignored, as well as symlinks that are part of
+	// installed packages
 	locals := map[string]bool{}
+	packages := map[string]bool{}
 	for _, k := range locks.Keys() {
 		d, _ := locks.Get(k)
-		if d.Source.LocalSource == nil {
+		if !isLinked(d.Upstream().Source) {
+			packages[filepath.Join(vendorDir, d.Name())] = true
 			continue
 		}
 
@@ -131,9 +183,15 @@ func cleanLegacySymlinks(vendorDir string, locks *deps.Ordered) error {
 
 	// remove all symlinks first
 	return filepath.Walk(vendorDir, func(path string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if locals[path] {
 			return nil
 		}
+		if i.IsDir() && packages[path] {
+			return filepath.SkipDir
+		}
 
 		if i.Mode()&os.ModeSymlink != 0 {
 			if err := os.Remove(path); err != nil {
@@ -149,7 +207,7 @@ func linkLegacy(vendorDir string, locks *deps.Ordered) error {
 	for _, k := range locks.Keys() {
 		d, _ := locks.Get(k)
 		// localSource still uses the relative style
-		if d.Source.LocalSource != nil {
+		if isLinked(d.Source) || d.Excluded {
 			continue
 		}
 
@@ -202,139 +260,187 @@ func checkLegacyNameTaken(legacyName string, pkgName string) (bool, error) {
 	return true, nil
 }
 
+// known returns whether the path p below vendor/ is a package of deps, is inside
+// of one or contains one. Paths are compared by whole components.
 func known(deps *deps.Ordered, p string) bool {
 	p = filepath.ToSlash(p)
 	for _, kd := range deps.Keys() {
 		d, _ := deps.Get(kd)
+		if d.Excluded {
+			continue
+		}
 		k := filepath.ToSlash(d.Name())
-		if strings.HasPrefix(p, k) || strings.HasPrefix(k, p) {
+		if k == p || strings.HasPrefix(p, k+"/") || strings.HasPrefix(k, p+"/") {
 			return true
 		}
 	}
 	return false
 }
 
-func ensure(direct *deps.Ordered, vendorDir, pathToParentModule string, locks *deps.Ordered) (*deps.Ordered, error) {
-	deps := deps.NewOrdered()
+// warnExcludedImports prints a warning for every import of an excluded package
+// found in vendor/. Such imports cannot be resolved, as excluded packages are
+// not installed.
+func warnExcludedImports(vendorDir string, locks *deps.Ordered) error {
+	// import prefix -> name of the excluded package
+	prefixes := make(map[string]string)
+	for _, k := range locks.Keys() {
+		d, _ := locks.Get(k)
+		if !d.Excluded {
+			continue
+		}
+		prefixes[d.Name()] = d.Name()
 
-	for _, k := range direct.Keys() {
-		d, _ := direct.Get(k)
-		l, present := locks.Get(d.Name())
+		// the legacy name only refers to the excluded package if no
+		// installed one claims it
+		if _, err := os.Lstat(filepath.Join(vendorDir, d.LegacyName())); os.IsNotExist(err) {
+			prefixes[d.LegacyName()] = d.Name()
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
 
-		// already locked and the integrity is intact
-		if present {
-			d.Version = l.Version
+	found, err := imports.Find(vendorDir, func(path string) bool {
+		return filepath.Base(path) == ".tmp"
+	})
+	if err != nil {
+		return err
+	}
 
-			if check(l, vendorDir) {
-				deps.Set(d.Name(), l)
-				continue
+	files := make([]string, 0, len(found))
+	for f := range found {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		for _, i := range found[f] {
+			for prefix, name := range prefixes {
+				if i.Path == prefix || strings.HasPrefix(i.Path, prefix+"/") {
+					color.Yellow("WARN: %s:%d imports '%s', but %s is excluded", f, i.Line, i.Path, name)
+					break
+				}
 			}
 		}
-		expectedSum := l.Sum
+	}
+	return nil
+}
 
-		// either not present or not intact: download again
-		dir := filepath.Join(vendorDir, d.Name())
-		os.RemoveAll(dir)
+// download retrieves a package from a remote upstream. The checksum of the
+// files, and their git tree if the Fetcher records it, are generated
+// afterwards.
+func download(ctx context.Context, d deps.Dependency, vendorDir, pathToParentModule string) (*deps.Dependency, error) {
+	// replaced packages are fetched from their replacement
+	u := d.Upstream()
 
-		locked, err := download(d, vendorDir, pathToParentModule)
-		if err != nil {
-			return nil, errors.Wrap(err, "downloading")
-		}
-		if expectedSum != "" && locked.Sum != expectedSum {
-			return nil, fmt.Errorf("checksum mismatch for %s. Expected %s but got %s", d.Name(), expectedSum, locked.Sum)
-		}
-		deps.Set(d.Name(), *locked)
-		// we settled on a new version, add it to the locks for recursion
-		locks.Set(d.Name(), *locked)
+	spec, f, err := fetcherOf(u.Source)
+	if err != nil {
+		return nil, err
+	}
+	p, err := f.New(spec, pathToParentModule)
+	if err != nil {
+		return nil, err
+	}
+	// the locked tree saves fetching it to check host archives
+	if g, ok := p.(*GitPackage); ok {
+		g.Tree = d.Tree
 	}
 
-	for _, k := range deps.Keys() {
-		d, _ := deps.Get(k)
-		if d.Single {
-			// skip dependencies that explicitely don't want nested ones installed
-			continue
+	res := Resolution{Version: u.Version}
+	if f.Resolve != nil {
+		if res, err = f.Resolve(ctx, spec, u.Version); err != nil {
+			return nil, err
 		}
+	}
 
-		f, err := jsonnetfile.Load(filepath.Join(vendorDir, d.Name(), jsonnetfile.File))
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
+	dir := filepath.Join(vendorDir, d.Name())
+
+	// the pinned version might have been fetched before, by any project
+	if sum, ok := cacheLookup(spec, res.Pinned); ok && !f.Linked && cacheRestore(sum, dir) {
+		// upgrade sums cached by older versions of jb
+		if !strings.HasPrefix(sum, sumPrefix) {
+			sum = hashDir(dir)
+			if err := cacheStore(spec, res.Pinned, sum, dir); err != nil {
+				printf(ctx, color.FgYellow, "WARN: failed to cache %s: %s", d.Name(), err)
 			}
-			return nil, err
 		}
 
-		absolutePath, err := filepath.EvalSymlinks(filepath.Join(vendorDir, d.Name()))
-		if err != nil {
+		d.Version = res.Pinned
+		d.Tag = res.Tag
+		d.Sum = sum
+		if d.Tree, err = gitTreeOf(f, dir); err != nil {
 			return nil, err
 		}
+		return &d, nil
+	}
 
-		nested, err := ensure(f.Dependencies, vendorDir, absolutePath, locks)
-		if err != nil {
-			return nil, err
-		}
+	lockVersion, err := p.Install(ctx, d.Name(), vendorDir, res.Version)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, k := range nested.Keys() {
-			d, _ := nested.Get(k)
-			if _, ok := deps.Get(d.Name()); !ok {
-				deps.Set(d.Name(), d)
-			}
+	var sum string
+	if !f.Linked {
+		sum = hashDir(dir)
+		if err := cacheStore(spec, lockVersion, sum, dir); err != nil {
+			printf(ctx, color.FgYellow, "WARN: failed to cache %s: %s", d.Name(), err)
 		}
 	}
 
-	return deps, nil
+	d.Version = lockVersion
+	d.Tag = res.Tag
+	d.Sum = sum
+	if d.Tree, err = gitTreeOf(f, dir); err != nil {
+		return nil, err
+	}
+	return &d, nil
 }
 
-// download retrieves a package from a remote upstream. The checksum of the
-// files is generated afterwards.
-func download(d deps.Dependency, vendorDir, pathToParentModule string) (*deps.Dependency, error) {
-	var p Interface
-	switch {
-	case d.Source.GitSource != nil:
-		p = NewGitPackage(d.Source.GitSource)
-	case d.Source.LocalSource != nil:
-		wd, err := os.Getwd()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get current working directory: %w", err)
-		}
-
-		// Resolve the relative path to the parent module. When a local
-		// dependency tree is resolved recursively, nested local dependencies
-		// with relative paths must be evaluated relative to their referencing
-		// jsonnetfile, rather than relative to the top-level jsonnetfile.
-		modulePath, err := filepath.Rel(wd, filepath.Join(pathToParentModule, d.Source.LocalSource.Directory))
-		if err != nil {
-			modulePath = d.Source.LocalSource.Directory
-		}
-
-		p = NewLocalPackage(&deps.Local{Directory: modulePath})
+// gitTreeOf returns the git tree of the package installed at dir, if the
+// fetcher records one
+func gitTreeOf(f Fetcher, dir string) (string, error) {
+	if !f.GitTree || f.Linked {
+		return "", nil
 	}
+	tree, err := gitTreeHash(dir)
+	return tree, errors.Wrap(err, "computing git tree")
+}
 
-	if p == nil {
-		return nil, errors.New("either git or local source is required")
+// lockSatisfies returns whether the lock l can be used for the requested
+// dependency d. Both must agree on the replacement, if any, and the lock must
+// satisfy the Fetcher of the source, e.g. match a requested semver tag.
+func lockSatisfies(d, l deps.Dependency) bool {
+	if !sameReplacement(d.Replace, l.Replace) {
+		return false
 	}
 
-	version, err := p.Install(context.TODO(), d.Name(), vendorDir, d.Version)
-	if err != nil {
-		return nil, err
+	_, f, err := fetcherOf(d.Upstream().Source)
+	if err != nil || f.LockSatisfies == nil {
+		return true
 	}
+	return f.LockSatisfies(d.Upstream(), l)
+}
 
-	var sum string
-	if d.Source.LocalSource == nil {
-		sum = hashDir(filepath.Join(vendorDir, d.Name()))
+func sameReplacement(a, b *deps.Dependency) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
+	return a.Version == b.Version && reflect.DeepEqual(a.Source, b.Source)
+}
 
-	d.Version = version
-	d.Sum = sum
-	return &d, nil
+// isTag returns whether the version is a semver tag
+func isTag(version string) bool {
+	_, err := semver.Parse(version)
+	return err == nil
 }
 
 // check returns whether the files present at the vendor/ folder match the
-// sha256 sum of the package. local-directory dependencies are not checked as
-// their purpose is to change during development where integrity checking would
-// be a hindrance.
+// sha256 sum and git tree of the package. local-directory dependencies are not
+// checked as their purpose is to change during development where integrity
+// checking would be a hindrance.
 func check(d deps.Dependency, vendorDir string) bool {
 	// assume a local dependency is intact as long as it exists
-	if d.Source.LocalSource != nil {
+	if isLinked(d.Upstream().Source) {
 		x, err := jsonnetfile.Exists(filepath.Join(vendorDir, d.Name()))
 		if err != nil {
 			return false
@@ -348,14 +454,93 @@ func check(d deps.Dependency, vendorDir string) bool {
 	}
 
 	dir := filepath.Join(vendorDir, d.Name())
-	sum := hashDir(dir)
-	return d.Sum == sum
+	if d.Sum != sumLike(dir, d.Sum) {
+		return false
+	}
+
+	// locks written by older versions of jb have no tree
+	if d.Tree != "" {
+		tree, err := gitTreeHash(dir)
+		return err == nil && tree == d.Tree
+	}
+	return true
 }
 
-// hashDir computes the checksum of a directory by concatenating all files and
-// hashing this data using sha256. This can be memory heavy with lots of data,
-// but jsonnet files should be fairly small
+// sumPrefix marks sums computed by hashDir. Locks written by older versions of
+// jb hold sums without it, computed by hashDirLegacy.
+const sumPrefix = "h1:"
+
+// hashDir computes the checksum of a directory: the sha256 of a manifest
+// listing every file and symlink, sorted by path, along with its mode and the
+// sha256 of its contents or link target. Renaming a file, moving content
+// between files, changing the executable bit or adding an empty file all
+// change the sum.
 func hashDir(dir string) string {
+	var manifest []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = strconv.Quote(filepath.ToSlash(rel))
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			manifest = append(manifest, fmt.Sprintf("%s symlink %x", rel, sha256.Sum256([]byte(filepath.ToSlash(target)))))
+		case info.Mode().IsRegular():
+			// only the executable bit is kept by git and archives
+			mode := "644"
+			if info.Mode()&0111 != 0 {
+				mode = "755"
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+			manifest = append(manifest, fmt.Sprintf("%s file %s %x", rel, mode, h.Sum(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	sort.Strings(manifest)
+	hasher := sha256.New()
+	for _, line := range manifest {
+		io.WriteString(hasher, line+"\n")
+	}
+	return sumPrefix + base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// sumLike computes the checksum of the directory in the format of sum, which
+// may have been recorded by an older version of jb
+func sumLike(dir, sum string) string {
+	if sum != "" && !strings.HasPrefix(sum, sumPrefix) {
+		return hashDirLegacy(dir)
+	}
+	return hashDir(dir)
+}
+
+// hashDirLegacy computes the checksum of a directory by concatenating all
+// files and hashing this data using sha256. This can be memory heavy with lots
+// of data, but jsonnet files should be fairly small
+func hashDirLegacy(dir string) string {
 	hasher := sha256.New()
 
 	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
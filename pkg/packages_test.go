@@ -15,8 +15,17 @@
 package pkg
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
 )
 
@@ -94,3 +103,148 @@ func TestCleanLegacyName(t *testing.T) {
 		}
 	}
 }
+
+func TestLockSatisfies(t *testing.T) {
+	lock := func(tag string) deps.Dependency {
+		d := gitDep("grafonnet-lib", "54865853ebc1f901964e25a2e7a0e4d2cb6b9648")
+		d.Tag = tag
+		return d
+	}
+
+	cases := []struct {
+		name string
+		d, l deps.Dependency
+		want bool
+	}{
+		{name: "branch", d: gitDep("grafonnet-lib", "master"), l: lock(""), want: true},
+		{name: "constraint", d: gitDep("grafonnet-lib", "^1.0.0"), l: lock("v1.2.0"), want: true},
+		{name: "constraint-outdated", d: gitDep("grafonnet-lib", "^2.0.0"), l: lock("v1.2.0"), want: false},
+		{name: "constraint-legacy", d: gitDep("grafonnet-lib", "^1.0.0"), l: lock(""), want: true},
+		{name: "tag", d: gitDep("grafonnet-lib", "v1.2.0"), l: lock("v1.2.0"), want: true},
+		{name: "tag-outdated", d: gitDep("grafonnet-lib", "v1.3.0"), l: lock("v1.2.0"), want: false},
+		{name: "tag-legacy", d: gitDep("grafonnet-lib", "v1.3.0"), l: lock(""), want: true},
+		{name: "local", d: deps.Dependency{Source: deps.Source{LocalSource: &deps.Local{Directory: "foo"}}}, l: lock("v1.2.0"), want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := lockSatisfies(c.d, c.l); got != c.want {
+				t.Fatalf("expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestHashDir(t *testing.T) {
+	write := func(dir, name, content string, mode os.FileMode) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), mode))
+	}
+	pkg := func(changes ...func(dir string)) string {
+		t.Helper()
+		dir := t.TempDir()
+		write(dir, "main.libsonnet", "foo", 0644)
+		write(dir, "lib/util.libsonnet", "bar", 0644)
+		require.NoError(t, os.Symlink("main.libsonnet", filepath.Join(dir, "link.libsonnet")))
+		for _, change := range changes {
+			change(dir)
+		}
+		return hashDir(dir)
+	}
+
+	sum := pkg()
+	assert.True(t, strings.HasPrefix(sum, sumPrefix), sum)
+	assert.Equal(t, sum, pkg(), "sums are reproducible")
+
+	changes := map[string]func(dir string){
+		"rename": func(dir string) {
+			require.NoError(t, os.Rename(filepath.Join(dir, "lib/util.libsonnet"), filepath.Join(dir, "lib/other.libsonnet")))
+		},
+		"move content": func(dir string) {
+			write(dir, "main.libsonnet", "foob", 0644)
+			write(dir, "lib/util.libsonnet", "ar", 0644)
+		},
+		"executable": func(dir string) {
+			require.NoError(t, os.Chmod(filepath.Join(dir, "main.libsonnet"), 0755))
+		},
+		"empty file": func(dir string) {
+			write(dir, "empty.libsonnet", "", 0644)
+		},
+		"symlink target": func(dir string) {
+			require.NoError(t, os.Remove(filepath.Join(dir, "link.libsonnet")))
+			require.NoError(t, os.Symlink("lib/util.libsonnet", filepath.Join(dir, "link.libsonnet")))
+		},
+	}
+	for name, change := range changes {
+		assert.NotEqual(t, sum, pkg(change), name)
+	}
+
+	// only the executable bit counts, and empty directories not at all
+	assert.Equal(t, sum, pkg(func(dir string) {
+		require.NoError(t, os.Chmod(filepath.Join(dir, "main.libsonnet"), 0600))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), os.ModePerm))
+	}))
+}
+
+// TestLegacySum checks that sums of older versions of jb are accepted, and
+// upgraded once the package is downloaded again
+func TestLegacySum(t *testing.T) {
+	withCache(t)
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	l := vendorPackage(t, vendorDir, grafonnet, "v1.0.0")
+	dir := filepath.Join(vendorDir, grafonnet.Name())
+	sum := l.Sum
+	l.Sum = hashDirLegacy(dir)
+	require.False(t, strings.HasPrefix(l.Sum, sumPrefix))
+
+	assert.True(t, check(l, vendorDir))
+	assert.Equal(t, l.Sum, sumLike(dir, l.Sum))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.libsonnet"), []byte("modified"), 0644))
+	assert.False(t, check(l, vendorDir))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.libsonnet"), []byte(`"`+grafonnet.Name()+`"`), 0644))
+
+	// an entry cached by an older version of jb
+	require.NoError(t, cacheStore(grafonnet.Source.GitSource, l.Version, l.Sum, dir))
+	require.NoError(t, os.RemoveAll(dir))
+
+	grafonnet.Version = l.Version
+	got, err := download(context.TODO(), grafonnet, vendorDir, "")
+	require.NoError(t, err)
+	assert.Equal(t, sum, got.Sum)
+
+	cached, ok := cacheLookup(grafonnet.Source.GitSource, l.Version)
+	require.True(t, ok)
+	assert.Equal(t, sum, cached)
+}
+
+func TestDownloadGitTree(t *testing.T) {
+	withCache(t)
+	remote, repo := testUpstream(t, "v1.0.0")
+	out, err := exec.Command("git", "-C", repo, "rev-parse", "v1.0.0^{tree}").Output()
+	require.NoError(t, err)
+	tree := strings.TrimSpace(string(out))
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	d := deps.Parse("", remote)
+	d.Version = "v1.0.0"
+
+	got, err := download(context.TODO(), *d, vendorDir, "")
+	require.NoError(t, err)
+	assert.Equal(t, tree, got.Tree)
+
+	// restored from the cache
+	require.NoError(t, os.RemoveAll(filepath.Join(vendorDir, d.Name())))
+	got, err = download(context.TODO(), *d, vendorDir, "")
+	require.NoError(t, err)
+	assert.Equal(t, tree, got.Tree)
+
+	// other sources record no tree
+	local := deps.Parse("", t.TempDir())
+	got, err = download(context.TODO(), *local, vendorDir, "")
+	require.NoError(t, err)
+	assert.Empty(t, got.Tree)
+}
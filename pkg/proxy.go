@@ -0,0 +1,312 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// Proxy is a comma separated list of package proxies to fetch git packages
+// from, tried in order. The keyword "direct" stands for the upstream git
+// repository, "off" forbids fetching packages at all. An empty Proxy is the
+// same as "direct".
+//
+// A proxy serves repositories under their path, e.g.
+// github.com/grafana/jsonnet-libs for
+// https://github.com/grafana/jsonnet-libs.git, using the following endpoints:
+//
+//	GET <proxy>/<repo>/@v/list
+//	  The refs of the repository, one "<commit> <ref>" per line, like
+//	  `git ls-remote` prints them. Includes HEAD, branches as refs/heads/<name>
+//	  and tags as refs/tags/<name>, peeled to the commit they point to.
+//
+//	GET <proxy>/<repo>/@v/<ref>.info
+//	  The commit of a branch, tag or commit as JSON: {"ref": "v1.0.0", "commit": "<sha>"}.
+//	  <ref> is path escaped, as branches may contain slashes.
+//
+//	GET <proxy>/<repo>/@v/<commit>.tar.gz?subdir=<subdir>
+//	  A gzipped tarball of the repository at the commit. It holds a single
+//	  top-level directory with the contents of subdir, or of the whole
+//	  repository if subdir is empty.
+//
+// Unknown repositories and refs are answered with 404 Not Found or 410 Gone.
+var Proxy string
+
+const (
+	proxyDirect = "direct"
+	proxyOff    = "off"
+)
+
+// errProxyOff is returned if Proxy forbids fetching a package
+var errProxyOff = errors.New("fetching packages is disabled by JB_PROXY=off")
+
+// proxies returns the entries of Proxy
+func proxies() []string {
+	var list []string
+	for _, p := range strings.Split(Proxy, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	if len(list) == 0 {
+		return []string{proxyDirect}
+	}
+	return list
+}
+
+// ProxyInfo is the response of the info endpoint
+type ProxyInfo struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// ProxyRepoPath returns the path a proxy serves the repository of the git
+// remote under, such as github.com/grafana/jsonnet-libs. ok is false for
+// remotes that are no URLs, such as local paths.
+func ProxyRepoPath(remote string) (p string, ok bool) {
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	switch u.Scheme {
+	case "http", "https", "ssh", "git":
+	default:
+		return "", false
+	}
+
+	p = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if p == "" {
+		return "", false
+	}
+	return path.Join(u.Hostname(), p), true
+}
+
+// errProxyNotFound is returned if a proxy does not know a repository or ref
+var errProxyNotFound = errors.New("not found on proxy")
+
+// proxyClient fetches packages from the proxy at base
+type proxyClient struct {
+	base string
+}
+
+func (c proxyClient) url(repo, file string, query url.Values) string {
+	u := strings.TrimSuffix(c.base, "/") + "/" + repo + "/@v/" + file
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// get returns the body of the url, retrying temporary failures
+func (c proxyClient) get(ctx context.Context, u string) ([]byte, error) {
+	var body []byte
+	err := withRetry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return networkError(ctx, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return proxyStatusError(resp)
+		}
+
+		body, err = ioutil.ReadAll(resp.Body)
+		return networkError(ctx, err)
+	})
+	return body, err
+}
+
+// proxyStatusError is httpStatusError, but reports unknown repositories and
+// refs as errProxyNotFound
+func proxyStatusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errors.Wrap(errProxyNotFound, resp.Request.URL.String())
+	}
+	return httpStatusError(resp)
+}
+
+// listRefs returns the refs of the repository, like remoteListRefs
+func (c proxyClient) listRefs(ctx context.Context, remote string) (map[string]string, error) {
+	repo, ok := ProxyRepoPath(remote)
+	if !ok {
+		return nil, errProxyNotFound
+	}
+
+	body, err := c.get(ctx, c.url(repo, "list", nil))
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(body), nil
+}
+
+// resolve returns the commit of the ref
+func (c proxyClient) resolve(ctx context.Context, remote, ref string) (string, error) {
+	repo, ok := ProxyRepoPath(remote)
+	if !ok {
+		return "", errProxyNotFound
+	}
+
+	body, err := c.get(ctx, c.url(repo, url.PathEscape(ref)+".info", nil))
+	if err != nil {
+		return "", err
+	}
+
+	var info ProxyInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", errors.Wrap(err, "parsing info")
+	}
+	if !isCommit(info.Commit) {
+		return "", fmt.Errorf("proxy returned invalid commit '%s' for %s", info.Commit, ref)
+	}
+	return info.Commit, nil
+}
+
+// install downloads the package at version into dir/name and returns the
+// installed commit
+func (c proxyClient) install(ctx context.Context, source *deps.Git, dir, name, version string) (string, error) {
+	repo, ok := ProxyRepoPath(source.Remote())
+	if !ok {
+		return "", errProxyNotFound
+	}
+
+	commit := version
+	if !isCommit(version) {
+		var err error
+		if commit, err = c.resolve(ctx, source.Remote(), version); err != nil {
+			return "", err
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Join(dir, ".tmp"), "proxy-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create tmp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	query := url.Values{}
+	if subdir := strings.Trim(source.Subdir, "/"); subdir != "" {
+		query.Set("subdir", subdir)
+	}
+
+	archive := tmpDir + ".tar.gz"
+	defer os.Remove(archive)
+	err = withRetry(ctx, func() error {
+		return downloadArchive(ctx, archive, c.url(repo, commit+".tar.gz", query))
+	})
+	if err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusGone) {
+			return "", errors.Wrap(errProxyNotFound, httpErr.URL)
+		}
+		return "", err
+	}
+
+	// the tarball holds the package below a single directory
+	extracted := filepath.Join(tmpDir, "pkg")
+	if err := extractArchive(archive, extracted, 1, ""); err != nil {
+		return "", errors.Wrap(err, "extracting archive")
+	}
+
+	if err := movePackage(extracted, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// viaProxies calls fn for every entry of Proxy until one succeeds. direct is
+// called for the "direct" entry. Failing proxies are skipped, printing a
+// warning unless they just don't know the package.
+func viaProxies(ctx context.Context, direct func() error, fn func(proxyClient) error) error {
+	err := errProxyOff
+	for _, p := range proxies() {
+		switch p {
+		case proxyDirect:
+			return direct()
+		case proxyOff:
+			return errProxyOff
+		}
+
+		err = fn(proxyClient{base: p})
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, errProxyNotFound) {
+			printf(ctx, color.FgYellow, "WARN: proxy %s failed: %s", p, err)
+		}
+	}
+	return err
+}
+
+// formatRefs returns the refs in the format of `git ls-remote`, sorted by ref
+func formatRefs(refs map[string]string) []byte {
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, ref := range names {
+		fmt.Fprintf(&b, "%s %s\n", refs[ref], ref)
+	}
+	return b.Bytes()
+}
+
+// parseRefs parses the output of `git ls-remote`. Annotated tags are peeled
+// to their commit.
+func parseRefs(data []byte) map[string]string {
+	refs := make(map[string]string)
+	peeled := make(map[string]string)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) != 2 {
+			continue
+		}
+		sha, ref := fields[0], fields[1]
+
+		if strings.HasSuffix(ref, "^{}") {
+			peeled[strings.TrimSuffix(ref, "^{}")] = sha
+			continue
+		}
+		refs[ref] = sha
+	}
+
+	for ref, sha := range peeled {
+		refs[ref] = sha
+	}
+
+	return refs
+}
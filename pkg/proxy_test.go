@@ -0,0 +1,215 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+const (
+	proxyCommit1 = "1111111111111111111111111111111111111111"
+	proxyCommit2 = "2222222222222222222222222222222222222222"
+)
+
+// testProxy serves github.com/foo/bar with the tags v1.0.0 and v1.1.0. The
+// tarballs contain a single file, telling the commit and subdir requested.
+func testProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	refs := map[string]string{
+		"HEAD":             proxyCommit2,
+		"refs/heads/main":  proxyCommit2,
+		"refs/tags/v1.0.0": proxyCommit1,
+		"refs/tags/v1.1.0": proxyCommit2,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, "/github.com/foo/bar/@v/")
+		if file == r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case file == "list":
+			for ref, commit := range refs {
+				fmt.Fprintf(w, "%s %s\n", commit, ref)
+			}
+		case strings.HasSuffix(file, ".info"):
+			ref, _ := url.PathUnescape(strings.TrimSuffix(file, ".info"))
+			commit, ok := refs["refs/tags/"+ref]
+			if !ok {
+				commit, ok = refs["refs/heads/"+ref]
+			}
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(ProxyInfo{Ref: ref, Commit: commit})
+		case strings.HasSuffix(file, ".tar.gz"):
+			commit := strings.TrimSuffix(file, ".tar.gz")
+			gz := gzip.NewWriter(w)
+			tw := tar.NewWriter(gz)
+			content := commit + " " + r.URL.Query().Get("subdir")
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bar/", Typeflag: tar.TypeDir, Mode: 0755}))
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bar/main.libsonnet", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+			tw.Write([]byte(content))
+			tw.Close()
+			gz.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func withProxy(t *testing.T, proxy string) {
+	old := Proxy
+	Proxy = proxy
+	t.Cleanup(func() { Proxy = old })
+}
+
+func TestProxyRepoPath(t *testing.T) {
+	tests := []struct {
+		remote string
+		path   string
+		ok     bool
+	}{
+		{"https://github.com/foo/bar.git", "github.com/foo/bar", true},
+		{"ssh://git@github.com/foo/bar.git", "github.com/foo/bar", true},
+		{"https://gitlab.com/group/sub/bar", "gitlab.com/group/sub/bar", true},
+		{"/tmp/repo", "", false},
+		{"file:///tmp/repo", "", false},
+	}
+
+	for _, c := range tests {
+		p, ok := ProxyRepoPath(c.remote)
+		assert.Equal(t, c.ok, ok, c.remote)
+		assert.Equal(t, c.path, p, c.remote)
+	}
+}
+
+func TestProxyInstall(t *testing.T) {
+	srv := testProxy(t)
+	withProxy(t, srv.URL)
+
+	d := deps.Parse("", "github.com/foo/bar/lib@v1.0.0")
+	require.NotNil(t, d)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	commit, err := NewGitPackage(d.Source.GitSource).Install(context.TODO(), d.Name(), vendorDir, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, proxyCommit1, commit)
+
+	data, err := ioutil.ReadFile(filepath.Join(vendorDir, d.Name(), "main.libsonnet"))
+	require.NoError(t, err)
+	assert.Equal(t, proxyCommit1+" lib", string(data))
+
+	// commits are fetched without asking for info
+	commit, err = NewGitPackage(d.Source.GitSource).Install(context.TODO(), d.Name(), vendorDir, proxyCommit2)
+	require.NoError(t, err)
+	assert.Equal(t, proxyCommit2, commit)
+}
+
+func TestProxyTreeMismatch(t *testing.T) {
+	srv := testProxy(t)
+	withProxy(t, srv.URL)
+
+	d := deps.Parse("", "github.com/foo/bar/lib@v1.0.0")
+	require.NotNil(t, d)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	// the proxy serves other files than those locked
+	l := *d
+	l.Version = proxyCommit1
+	l.Tag = "v1.0.0"
+	l.Tree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	locks := deps.NewOrdered()
+	locks.Set(d.Name(), l)
+
+	direct := deps.NewOrdered()
+	direct.Set(d.Name(), *d)
+	_, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "git tree mismatch")
+}
+
+func TestProxyResolveConstraint(t *testing.T) {
+	srv := testProxy(t)
+	withProxy(t, srv.URL)
+
+	tag, commit, err := remoteResolveConstraint(context.TODO(), "https://github.com/foo/bar.git", "^1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+	assert.Equal(t, proxyCommit2, commit)
+}
+
+func TestProxyFallback(t *testing.T) {
+	withFastRetries(t)
+	srv := testProxy(t)
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+
+	remote := "https://github.com/foo/bar.git"
+
+	withProxy(t, strings.Join([]string{broken.URL, empty.URL, srv.URL}, ","))
+	refs, err := remoteListRefs(context.TODO(), remote)
+	require.NoError(t, err)
+	assert.Equal(t, proxyCommit1, refs["refs/tags/v1.0.0"])
+
+	withProxy(t, empty.URL)
+	_, err = remoteListRefs(context.TODO(), remote)
+	assert.True(t, errors.Is(err, errProxyNotFound), err)
+
+	withProxy(t, empty.URL+",off")
+	_, err = remoteListRefs(context.TODO(), remote)
+	assert.Equal(t, errProxyOff, err)
+
+	// repositories that cannot be proxied go to the next entry
+	repo := testRepo(t, "v1.0.0")
+	withProxy(t, srv.URL+",direct")
+	refs, err = remoteListRefs(context.TODO(), repo)
+	require.NoError(t, err)
+	assert.Equal(t, revParse(t, repo, "v1.0.0"), refs["refs/tags/v1.0.0"])
+}
@@ -0,0 +1,581 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// resolver installs the dependency tree into vendorDir.
+//
+// The tree is walked level by level, starting at the direct dependencies.
+// Before a level is installed, the requirements of all packages of the
+// previous level are collected, so the outcome does not depend on the order
+// in which dependencies are declared.
+//
+// Once the whole tree is known, a version is selected for every package:
+// If all requested versions are semver tags, the highest of them wins
+// (minimal version selection, as done by Go modules). Constraints are
+// intersected, so compatible ones do not conflict. Any other disagreement
+// is handled by the ConflictPolicy. If a selection differs from what was
+// installed, the tree is walked again, until nothing changes anymore.
+//
+// Nested requirements matching an Exclusion are dropped before any of this
+// happens. Excluded packages that are not required otherwise are recorded in
+// the locks, marked as Excluded.
+//
+// Selections only depend on the requirements found in the tree. Locks are
+// merely used to avoid downloading versions that are replaced later on, so
+// that different lock histories still converge on the same result.
+type resolver struct {
+	vendorDir string
+	// locks are shared by concurrent installs, guarded by mu
+	locks   *deps.Ordered
+	mu      sync.Mutex
+	policy  ConflictPolicy
+	replace []deps.Replacement
+	exclude []deps.Exclusion
+
+	// names of the packages that were locked before resolving started
+	locked map[string]bool
+	// requests of the current round
+	requests requests
+	// versions selected in previous rounds
+	choices map[string]Request
+	// packages of the current round that could not be installed offline
+	missing []Request
+}
+
+func newResolver(vendorDir string, locks *deps.Ordered, policy ConflictPolicy, replace []deps.Replacement, exclude []deps.Exclusion) *resolver {
+	locked := make(map[string]bool)
+	for _, k := range locks.Keys() {
+		locked[k] = true
+	}
+
+	return &resolver{
+		vendorDir: vendorDir,
+		locks:     locks,
+		policy:    policy,
+		replace:   replace,
+		exclude:   exclude,
+		locked:    locked,
+		choices:   make(map[string]Request),
+	}
+}
+
+// resolve installs direct and all nested dependencies and returns the locks
+// of all installed packages, sorted by name
+func (r *resolver) resolve(ctx context.Context, direct *deps.Ordered) (*deps.Ordered, error) {
+	for round := 0; ; round++ {
+		if round == maxRounds {
+			return nil, fmt.Errorf("dependency versions did not settle after %d rounds", maxRounds)
+		}
+
+		installed, locks, err := r.walk(ctx, direct)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := r.choose(installed)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			if len(r.missing) > 0 {
+				return nil, &OfflineError{Missing: r.missing}
+			}
+			return locks, nil
+		}
+	}
+}
+
+// maxRounds limits how often the tree is walked again because of changed
+// selections. Packages that raise each other's versions in a cycle could
+// otherwise keep the resolver busy forever.
+const maxRounds = 10
+
+// node is a package whose dependencies still need to be walked
+type node struct {
+	name string
+	deps *deps.Ordered
+	// absolute path to the package, used to resolve nested local
+	// dependencies
+	path string
+}
+
+// walk installs the tree using the current selections. It returns the request
+// that was installed for each package, along with the resulting locks.
+func (r *resolver) walk(ctx context.Context, direct *deps.Ordered) (map[string]Request, *deps.Ordered, error) {
+	r.requests = make(requests)
+	r.missing = nil
+	installed := make(map[string]Request)
+	locks := make(map[string]deps.Dependency)
+	excluded := make(map[string]deps.Dependency)
+
+	level := []node{{name: RootRequester, deps: direct}}
+	for len(level) > 0 {
+		// collect the requirements of the whole level first
+		var names []string
+		for _, n := range level {
+			for _, d := range sorted(n.deps) {
+				if n.name != RootRequester && r.excluded(d) {
+					if _, ok := excluded[d.Name()]; !ok {
+						excluded[d.Name()] = d
+					}
+					continue
+				}
+
+				if _, ok := r.requests[d.Name()]; !ok {
+					names = append(names, d.Name())
+				}
+				r.requests.add(n.name, n.path, d)
+			}
+		}
+		sort.Strings(names)
+
+		// select all versions of the level first, then install them
+		// concurrently
+		var todo []Request
+		for _, name := range names {
+			if _, ok := installed[name]; ok {
+				continue
+			}
+
+			req := r.selection(name)
+			installed[name] = req
+			todo = append(todo, req)
+		}
+		results := r.installAll(ctx, todo)
+
+		// results are processed in order, so the outcome is deterministic
+		var next []node
+		for i, req := range todo {
+			name := req.dep.Name()
+			l, err := results[i].lock, results[i].err
+			if errors.Is(err, errOffline) {
+				// collect them all, to report them at once
+				r.missing = append(r.missing, req)
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			locks[name] = *l
+
+			if l.Single {
+				// skip dependencies that explicitely don't want nested ones installed
+				continue
+			}
+
+			f, err := jsonnetfile.Load(filepath.Join(r.vendorDir, name, jsonnetfile.File))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, nil, err
+			}
+
+			absolutePath, err := filepath.EvalSymlinks(filepath.Join(r.vendorDir, name))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			next = append(next, node{name: name, deps: f.Dependencies, path: absolutePath})
+		}
+		level = next
+	}
+
+	// record exclusions that actually kept a package out
+	for name, d := range excluded {
+		if _, ok := locks[name]; ok {
+			continue
+		}
+		locks[name] = deps.Dependency{Source: d.Source, Version: d.Version, Excluded: true}
+	}
+
+	ordered := deps.NewOrdered()
+	names := make([]string, 0, len(locks))
+	for name := range locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ordered.Set(name, locks[name])
+	}
+
+	return installed, ordered, nil
+}
+
+// excluded returns whether the dependency matches any exclusion
+func (r *resolver) excluded(d deps.Dependency) bool {
+	for _, e := range r.exclude {
+		if e.Matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaced applies the first matching replacement to the request. Replacements
+// of a specific version take precedence over those of all versions.
+func (r *resolver) replaced(req Request) Request {
+	var with *deps.Dependency
+	for _, rep := range r.replace {
+		if !rep.Matches(req.dep) {
+			continue
+		}
+		if with == nil || rep.Version != "" {
+			w := rep.With
+			with = &w
+		}
+		if rep.Version != "" {
+			break
+		}
+	}
+
+	if with == nil {
+		return req
+	}
+
+	// keep the requested version if only the source is replaced
+	if with.Source.GitSource != nil && with.Version == "" {
+		with.Version = req.dep.Version
+	}
+
+	req.dep.Replace = with
+	// local replacements are relative to the project
+	req.parent = ""
+	return req
+}
+
+type installResult struct {
+	lock *deps.Dependency
+	err  error
+}
+
+// installAll installs the requests using up to Jobs workers. The output of
+// each package is printed at once, when it is done. Each install is limited to
+// FetchTimeout, if set. Once ctx is done, no further installs are started.
+func (r *resolver) installAll(ctx context.Context, reqs []Request) []installResult {
+	jobs := Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	results := make([]installResult, len(reqs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, req Request) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := ctx.Err(); err != nil {
+				results[i] = installResult{err: err}
+				return
+			}
+
+			ictx := ctx
+			if FetchTimeout > 0 {
+				var cancel context.CancelFunc
+				ictx, cancel = context.WithTimeout(ctx, FetchTimeout)
+				defer cancel()
+			}
+
+			out := &bufferedOutput{}
+			defer out.flush()
+
+			l, err := r.install(withOutput(ictx, out), r.replaced(req))
+			// killed git processes and aborted downloads fail with rather
+			// confusing errors, report why they were stopped instead
+			if err != nil && ictx.Err() != nil {
+				err = errors.Wrap(ictx.Err(), req.dep.Name())
+			}
+			results[i] = installResult{lock: l, err: err}
+		}(i, req)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// install makes sure the requested package is present in vendor/, either by
+// verifying an existing lock or by downloading it. It is safe for concurrent
+// use with requests of different packages.
+func (r *resolver) install(ctx context.Context, req Request) (*deps.Dependency, error) {
+	d := req.dep
+
+	r.mu.Lock()
+	l, present := r.locks.Get(d.Name())
+
+	// a lock of a different tag or replacement is outdated, as is one of a
+	// package that used to be excluded
+	if present && (l.Excluded || !lockSatisfies(d, l)) {
+		r.locks.Delete(d.Name())
+		l, present = r.locks.Get(d.Name())
+	}
+	r.mu.Unlock()
+
+	// already locked and the integrity is intact
+	if present {
+		d = pin(d, l.Version)
+		d.Tree = l.Tree
+
+		if check(l, r.vendorDir) {
+			return &l, nil
+		}
+	}
+	expectedSum := l.Sum
+
+	// either not present or not intact: restore from the cache or download
+	// again
+	dir := filepath.Join(r.vendorDir, d.Name())
+	os.RemoveAll(dir)
+
+	if present && !isLinked(d.Upstream().Source) && cacheRestore(expectedSum, dir) {
+		return &l, nil
+	}
+
+	locked, err := download(ctx, d, r.vendorDir, req.parent)
+	if err != nil {
+		return nil, errors.Wrap(err, "downloading")
+	}
+	// the lock may hold a sum of an older format, which is upgraded
+	if expectedSum != "" && locked.Sum != expectedSum && sumLike(dir, expectedSum) != expectedSum {
+		return nil, fmt.Errorf("checksum mismatch for %s. Expected %s but got %s", d.Name(), expectedSum, locked.Sum)
+	}
+	// e.g. a proxy serving other files than the repository holds
+	if l.Tree != "" && locked.Tree != l.Tree {
+		return nil, fmt.Errorf("git tree mismatch for %s. Expected %s but got %s", d.Name(), l.Tree, locked.Tree)
+	}
+	if locked.Tag == "" {
+		locked.Tag = l.Tag
+	}
+	// record the replacement as configured, not the pinned version
+	locked.Replace = req.dep.Replace
+
+	// we settled on a new version, add it to the locks for the next round
+	r.mu.Lock()
+	r.locks.Set(d.Name(), *locked)
+	r.mu.Unlock()
+
+	return locked, nil
+}
+
+// pin sets the version to fetch to the one from the lock
+func pin(d deps.Dependency, version string) deps.Dependency {
+	if d.Replace == nil {
+		d.Version = version
+		return d
+	}
+
+	rep := *d.Replace
+	rep.Version = version
+	d.Replace = &rep
+	return d
+}
+
+// selection returns the request to install for the package. Unless a version
+// was selected in a previous round, it is selected from the requests known so
+// far.
+func (r *resolver) selection(name string) Request {
+	if c, ok := r.choices[name]; ok {
+		return c
+	}
+
+	c := Conflict{Name: name, Requests: r.requests[name]}
+	chosen, ok := r.selectVersion(c)
+	if !ok {
+		// unresolvable, will be reported by choose()
+		return c.Requests[0]
+	}
+
+	return r.preferLocked(c, chosen)
+}
+
+// preferLocked returns the tag of the lock instead of chosen, if it is higher
+// but still satisfies all requests known so far. It was most likely required by
+// a package further down the tree, so installing chosen would only mean
+// replacing it again in the next round.
+func (r *resolver) preferLocked(c Conflict, chosen Request) Request {
+	l, ok := r.locks.Get(c.Name)
+	if !ok || !isHigher(l.Tag, chosen.Version) {
+		return chosen
+	}
+
+	locked := chosen
+	locked.Version = l.Tag
+	locked.dep.Version = l.Tag
+
+	reqs := append(append([]Request{}, c.Requests...), locked)
+	if v, ok := mvs(reqs); !ok || v.Version != l.Tag {
+		return chosen
+	}
+	return locked
+}
+
+// selectVersion picks a version out of the requests of a package. ok is false
+// if the requests conflict and the policy cannot decide.
+func (r *resolver) selectVersion(c Conflict) (chosen Request, ok bool) {
+	if !c.conflicting() {
+		return c.Requests[0], true
+	}
+
+	if chosen, ok := mvs(c.Requests); ok {
+		return chosen, true
+	}
+
+	return r.policy.resolve(c)
+}
+
+// choose selects a version for every package of the current round. It returns
+// whether any selection differs from what was installed.
+func (r *resolver) choose(installed map[string]Request) (changed bool, err error) {
+	var (
+		unresolved []Conflict
+		warnings   []string
+	)
+
+	names := make([]string, 0, len(r.requests))
+	for name := range r.requests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := Conflict{Name: name, Requests: r.requests[name]}
+		chosen, ok := r.selectVersion(c)
+		if !ok {
+			unresolved = append(unresolved, c)
+			continue
+		}
+
+		r.choices[name] = chosen
+
+		if c.conflicting() && r.policy == ConflictFirst {
+			if _, ok := mvs(c.Requests); !ok {
+				warnings = append(warnings, fmt.Sprintf("WARN: multiple versions requested for %s\nusing %s", c, chosen.Version))
+			}
+		}
+
+		if chosen.Version == installed[name].Version {
+			continue
+		}
+		changed = true
+
+		// versions settled during this run are not binding
+		if !r.locked[name] {
+			r.locks.Delete(name)
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return false, &MismatchError{Conflicts: unresolved}
+	}
+
+	if !changed {
+		for _, w := range warnings {
+			color.Yellow(w)
+		}
+	}
+	return changed, nil
+}
+
+// mvs implements minimal version selection: if every request is a semver tag
+// or constraint, the highest requested tag is selected, provided it satisfies
+// all constraints. Without any tag, the intersection of the constraints is
+// selected, which resolves to the highest tag satisfying all of them.
+func mvs(reqs []Request) (chosen Request, ok bool) {
+	var (
+		highest     *semver.Version
+		constraints []semver.Constraint
+	)
+
+	for _, r := range reqs {
+		if semver.IsConstraint(r.Version) {
+			c, err := semver.ParseConstraint(r.Version)
+			if err != nil {
+				return Request{}, false
+			}
+			constraints = append(constraints, c)
+			continue
+		}
+
+		v, err := semver.Parse(r.Version)
+		if err != nil {
+			return Request{}, false
+		}
+		if highest == nil || highest.LessThan(v) {
+			highest, chosen = &v, r
+		}
+	}
+
+	if highest == nil {
+		if len(constraints) == 0 {
+			return Request{}, false
+		}
+
+		c := constraints[0]
+		for _, o := range constraints[1:] {
+			c = c.Intersect(o)
+		}
+		if !c.Satisfiable() {
+			return Request{}, false
+		}
+
+		chosen = reqs[0]
+		chosen.Version = c.String()
+		chosen.dep.Version = c.String()
+		return chosen, true
+	}
+
+	for _, c := range constraints {
+		if !c.Check(*highest) {
+			return Request{}, false
+		}
+	}
+
+	return chosen, true
+}
+
+// sorted returns the dependencies sorted by name
+func sorted(o *deps.Ordered) []deps.Dependency {
+	list := make([]deps.Dependency, 0, o.Len())
+	for _, k := range o.Keys() {
+		d, _ := o.Get(k)
+		list = append(list, d)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list
+}
@@ -0,0 +1,391 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/jsonnetfile"
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+func TestMVS(t *testing.T) {
+	reqs := func(versions ...string) []Request {
+		var rs []Request
+		for _, v := range versions {
+			rs = append(rs, Request{Version: v})
+		}
+		return rs
+	}
+
+	tests := []struct {
+		name     string
+		versions []string
+		want     string
+		ok       bool
+	}{
+		{name: "tags", versions: []string{"v1.2.0", "v1.10.0", "v1.9.3"}, want: "v1.10.0", ok: true},
+		{name: "constraint", versions: []string{"^1.2.0", "v1.4.0"}, want: "v1.4.0", ok: true},
+		{name: "unsatisfied", versions: []string{"~1.2.0", "v1.4.0"}, ok: false},
+		{name: "constraints-only", versions: []string{"^1.2.0", "^1.3.0"}, want: ">=1.2.0 <2.0.0 >=1.3.0 <2.0.0", ok: true},
+		{name: "disjoint constraints", versions: []string{"^1.2.0", "^2.0.0"}, ok: false},
+		{name: "branch", versions: []string{"v1.2.0", "master"}, ok: false},
+	}
+
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := mvs(reqs(c.versions...))
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.want, got.Version)
+		})
+	}
+}
+
+// vendorPackage creates a package in vendorDir that depends on the given
+// dependencies and returns its lock
+func vendorPackage(t *testing.T, vendorDir string, d deps.Dependency, tag string, nested ...deps.Dependency) deps.Dependency {
+	t.Helper()
+
+	dir := filepath.Join(vendorDir, d.Name())
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.libsonnet"), []byte(`"`+d.Name()+`"`), 0644))
+
+	if len(nested) > 0 {
+		jf := v1.New()
+		for _, n := range nested {
+			jf.Dependencies.Set(n.Name(), n)
+		}
+		data, err := json.Marshal(jf)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "jsonnetfile.json"), data, 0644))
+	}
+
+	d.Version = "0123456789abcdef0123456789abcdef01234567"
+	d.Tag = tag
+	d.Sum = hashDir(dir)
+	return d
+}
+
+func TestResolverMVS(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "v2.0.0")
+
+	// both builder and loki require grafonnet at a higher version than the root
+	locks := deps.NewOrdered()
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "v1.1.0")))
+	locks.Set(loki.Name(), vendorPackage(t, vendorDir, loki, "v2.0.0", gitDep("grafonnet-lib", "v1.2.0"), gitDep("jsonnet-libs", "v1.0.0")))
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.2.0"))
+
+	// the result must not depend on the order of declaration
+	orders := [][]deps.Dependency{
+		{grafonnet, builder, loki},
+		{loki, builder, grafonnet},
+	}
+
+	for _, order := range orders {
+		direct := deps.NewOrdered()
+		for _, d := range order {
+			direct.Set(d.Name(), d)
+		}
+
+		got, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+		require.NoError(t, err)
+		assert.Equal(t, []string{grafonnet.Name(), builder.Name(), loki.Name()}, got.Keys())
+
+		l, _ := got.Get(grafonnet.Name())
+		assert.Equal(t, "v1.2.0", l.Tag)
+	}
+}
+
+func TestResolverConstraints(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "^1.2.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+
+	// compatible constraints are no conflict, the lock satisfies both
+	locks := deps.NewOrdered()
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "^1.3.0")))
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.3.1"))
+
+	direct := deps.NewOrdered()
+	direct.Set(grafonnet.Name(), grafonnet)
+	direct.Set(builder.Name(), builder)
+
+	got, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	l, _ := got.Get(grafonnet.Name())
+	assert.Equal(t, "v1.3.1", l.Tag)
+}
+
+func TestResolverLegacyLock(t *testing.T) {
+	Offline = true
+	defer func() { Offline = false }()
+
+	vendorDir := t.TempDir()
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	tempo := gitDep("tempo", "^1.0.0")
+
+	// locks written before tags were recorded, with content-only sums
+	var sums []interface{}
+	for _, d := range []deps.Dependency{grafonnet, tempo} {
+		vendorPackage(t, vendorDir, d, "")
+		sums = append(sums, d.Source.GitSource.Remote(), hashDirLegacy(filepath.Join(vendorDir, d.Name())))
+	}
+	lockFile, err := jsonnetfile.Unmarshal([]byte(fmt.Sprintf(`{
+  "version": 1,
+  "dependencies": [
+    {
+      "source": {"git": {"remote": "%s", "subdir": ""}},
+      "version": "0123456789abcdef0123456789abcdef01234567",
+      "sum": "%s"
+    },
+    {
+      "source": {"git": {"remote": "%s", "subdir": ""}},
+      "version": "0123456789abcdef0123456789abcdef01234567",
+      "sum": "%s"
+    }
+  ],
+  "legacyImports": false
+}`, sums...)))
+	require.NoError(t, err)
+
+	direct := deps.NewOrdered()
+	direct.Set(grafonnet.Name(), grafonnet)
+	direct.Set(tempo.Name(), tempo)
+
+	// the vendored packages are kept, without network access
+	got, err := newResolver(vendorDir, lockFile.Dependencies, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	for _, d := range []deps.Dependency{grafonnet, tempo} {
+		want, _ := lockFile.Dependencies.Get(d.Name())
+		l, ok := got.Get(d.Name())
+		require.True(t, ok, d.Name())
+		assert.Equal(t, want.Version, l.Version)
+		assert.Equal(t, want.Sum, l.Sum)
+	}
+}
+
+func TestResolverConflict(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "master")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+
+	locks := deps.NewOrdered()
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "main")))
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, ""))
+
+	direct := deps.NewOrdered()
+	direct.Set(grafonnet.Name(), grafonnet)
+	direct.Set(builder.Name(), builder)
+
+	_, err := newResolver(vendorDir, locks, ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, VersionMismatch))
+
+	var mismatch *MismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Len(t, mismatch.Conflicts, 1)
+	assert.Equal(t, []Request{
+		{Requester: RootRequester, Version: "master", dep: grafonnet},
+		{Requester: builder.Name(), Version: "main", dep: gitDep("grafonnet-lib", "main"), parent: filepath.Join(vendorDir, builder.Name())},
+	}, mismatch.Conflicts[0].Requests)
+
+	// root wins: the locked package is kept
+	got, err := newResolver(vendorDir, locks, ConflictRoot, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	assert.Equal(t, []string{grafonnet.Name(), builder.Name()}, got.Keys())
+}
+
+func TestResolverReplace(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	vendorDir := t.TempDir()
+	fork := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(fork, "main.libsonnet"), []byte(`"fork"`), 0644))
+
+	forkDir, err := filepath.Rel(cwd, fork)
+	require.NoError(t, err)
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+
+	// grafonnet is only required transitively
+	locks := deps.NewOrdered()
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "v1.1.0")))
+
+	direct := deps.NewOrdered()
+	direct.Set(builder.Name(), builder)
+
+	with := deps.Dependency{Source: deps.Source{LocalSource: &deps.Local{Directory: forkDir}}}
+	replace := []deps.Replacement{
+		{Name: "github.com/grafana/grafonnet-lib", Version: "v1.0.0", With: gitDep("other", "v1.0.0")},
+		{Name: "github.com/grafana/grafonnet-lib", With: with},
+	}
+
+	got, err := newResolver(vendorDir, locks, ConflictFail, replace, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+
+	l, ok := got.Get(grafonnet.Name())
+	require.True(t, ok)
+	assert.Equal(t, grafonnet.Source, l.Source)
+	assert.Equal(t, &with, l.Replace)
+
+	// vendored under the original name
+	data, err := ioutil.ReadFile(filepath.Join(vendorDir, grafonnet.Name(), "main.libsonnet"))
+	require.NoError(t, err)
+	assert.Equal(t, `"fork"`, string(data))
+
+	// the lock is used as long as the replacement does not change
+	assert.True(t, check(l, vendorDir))
+	assert.True(t, lockSatisfies(deps.Dependency{Source: grafonnet.Source, Version: "v1.1.0", Replace: &with}, l))
+	assert.False(t, lockSatisfies(gitDep("grafonnet-lib", "v1.1.0"), l))
+}
+
+func TestResolverExclude(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "v2.0.0")
+
+	locks := deps.NewOrdered()
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "v1.1.0"), loki))
+	locks.Set(loki.Name(), vendorPackage(t, vendorDir, loki, "v2.0.0"))
+
+	direct := deps.NewOrdered()
+	direct.Set(builder.Name(), builder)
+
+	exclude := []deps.Exclusion{
+		{Name: "github.com/grafana/grafonnet-lib"},
+		// different version, does not apply
+		{Name: loki.Name(), Version: "v1.0.0"},
+		// direct dependencies are never excluded
+		{Name: builder.Name()},
+	}
+
+	got, err := newResolver(vendorDir, locks, ConflictFail, nil, exclude).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"github.com/grafana/grafonnet-lib", builder.Name(), loki.Name()}, got.Keys())
+
+	l, _ := got.Get("github.com/grafana/grafonnet-lib")
+	assert.Equal(t, deps.Dependency{Source: gitDep("grafonnet-lib", "").Source, Version: "v1.1.0", Excluded: true}, l)
+	assert.False(t, known(got, "github.com/grafana/grafonnet-lib"))
+
+	for _, name := range []string{builder.Name(), loki.Name()} {
+		l, _ := got.Get(name)
+		assert.False(t, l.Excluded, name)
+	}
+}
+
+func TestResolverReplaced(t *testing.T) {
+	replace := []deps.Replacement{
+		{Name: "github.com/grafana/grafonnet-lib", With: gitDep("fork", "")},
+		{Name: "github.com/grafana/grafonnet-lib", Version: "v1.0.0", With: gitDep("fork", "v1.0.0-patched")},
+	}
+	r := newResolver("vendor", deps.NewOrdered(), ConflictFail, replace, nil)
+
+	got := r.replaced(Request{Version: "v1.0.0", dep: gitDep("grafonnet-lib", "v1.0.0"), parent: "/vendor/foo"})
+	require.NotNil(t, got.dep.Replace)
+	assert.Equal(t, "v1.0.0-patched", got.dep.Replace.Version)
+	assert.Equal(t, "", got.parent)
+
+	// the requested version is kept
+	got = r.replaced(Request{Version: "v1.1.0", dep: gitDep("grafonnet-lib", "v1.1.0")})
+	require.NotNil(t, got.dep.Replace)
+	assert.Equal(t, gitDep("fork", "v1.1.0"), *got.dep.Replace)
+
+	got = r.replaced(Request{Version: "v1.0.0", dep: gitDep("jsonnet-libs", "v1.0.0")})
+	assert.Nil(t, got.dep.Replace)
+}
+
+func TestResolverParallel(t *testing.T) {
+	old := Jobs
+	Jobs = 3
+	defer func() { Jobs = old }()
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	vendorDir := t.TempDir()
+	src := t.TempDir()
+
+	direct := deps.NewOrdered()
+	var names []string
+	for i := 9; i >= 0; i-- {
+		dir := filepath.Join(src, fmt.Sprintf("lib%d", i))
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.libsonnet"), []byte(`{}`), 0644))
+
+		rel, err := filepath.Rel(cwd, dir)
+		require.NoError(t, err)
+		d := deps.Dependency{Source: deps.Source{LocalSource: &deps.Local{Directory: rel}}}
+		direct.Set(d.Name(), d)
+		names = append([]string{d.Name()}, names...)
+	}
+
+	got, err := newResolver(vendorDir, deps.NewOrdered(), ConflictFail, nil, nil).resolve(context.TODO(), direct)
+	require.NoError(t, err)
+	assert.Equal(t, names, got.Keys())
+
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(vendorDir, name, "main.libsonnet"))
+		assert.NoError(t, err)
+	}
+}
+
+func TestEnsureCanceled(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	dir := filepath.Join(t.TempDir(), "lib")
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	rel, err := filepath.Rel(cwd, dir)
+	require.NoError(t, err)
+
+	d := deps.Dependency{Source: deps.Source{LocalSource: &deps.Local{Directory: rel}}}
+	direct := v1.New()
+	direct.Dependencies.Set(d.Name(), d)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Ensure(ctx, direct, vendorDir, deps.NewOrdered())
+	assert.True(t, errors.Is(err, context.Canceled), err)
+
+	// nothing installed, nothing left behind
+	_, err = os.Stat(filepath.Join(vendorDir, d.Name()))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(vendorDir, ".tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
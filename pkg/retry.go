@@ -0,0 +1,216 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+// Retries is how often a failed download or git fetch is attempted again,
+// if the failure looks temporary
+var Retries = 3
+
+// RetryDelay is the delay before the first retry. It doubles with every
+// further attempt, up to maxRetryDelay, and is randomized to spread out
+// retries of concurrent installs.
+var RetryDelay = time.Second
+
+const maxRetryDelay = 30 * time.Second
+
+// temporaryError marks a failure that may go away when trying again, such as
+// a 502 or a reset connection
+type temporaryError struct {
+	err error
+	// after is the minimum delay requested by the server using Retry-After.
+	// Delays beyond maxRetryDelay are not waited for.
+	after time.Duration
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+// withRetry calls fn until it succeeds, fails permanently or Retries are
+// exhausted. Only errors wrapped in a temporaryError are retried, unless the
+// server asks to wait longer than maxRetryDelay.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+
+		var tmp *temporaryError
+		if err == nil || attempt >= Retries || !errors.As(err, &tmp) || ctx.Err() != nil {
+			return err
+		}
+
+		// don't block for hours because the server asks for it
+		if tmp.after > maxRetryDelay {
+			return err
+		}
+
+		wait := jitter(delay)
+		if tmp.after > wait {
+			wait = tmp.after
+		}
+		printf(ctx, color.FgYellow, "%s, retrying in %s (%d/%d)", err, wait.Round(time.Millisecond), attempt+1, Retries)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// HTTPError is returned for unexpected HTTP status codes
+type HTTPError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("GET %s: unexpected status code %d", e.URL, e.StatusCode)
+}
+
+// httpStatusError returns the error for an unsuccessful response. Server
+// errors and 429 Too Many Requests are temporary, all others are permanent.
+func httpStatusError(resp *http.Response) error {
+	err := &HTTPError{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return err
+	}
+	return &temporaryError{err: err, after: retryAfter(resp.Header.Get("Retry-After"))}
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date
+func retryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(value); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// networkError marks errors of the connection itself as temporary. Errors
+// caused by ctx, such as timeouts set by the user, are not.
+func networkError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return &temporaryError{err: err}
+	}
+	return err
+}
+
+var (
+	// failures of git that won't go away by trying again. Checked first, as
+	// some also match gitTemporary.
+	gitPermanent = regexp.MustCompile(`(?i)authentication failed|permission denied|could not read (username|password)|terminal prompts disabled|repository not found|returned error: (401|403|404)`)
+	// failures of git caused by the network or an overloaded server
+	gitTemporary = regexp.MustCompile(`(?i)returned error: (5\d\d|429)|HTTP (5\d\d|429)|connection reset|connection timed out|operation timed out|connection refused|early EOF|unexpected disconnect|remote end hung up unexpectedly|could not resolve host|temporary failure in name resolution|gnutls|SSL_ERROR_SYSCALL`)
+	// failures of git because credentials are missing or wrong
+	gitAuth = regexp.MustCompile(`(?i)authentication failed|could not read (username|password)|terminal prompts disabled|returned error: (401|403)`)
+)
+
+// runGit runs the command returned by newCmd, which must create a new one on
+// every call, retrying temporary failures. These are told apart by the
+// messages git prints to stderr.
+func runGit(ctx context.Context, newCmd func() *exec.Cmd) error {
+	return withRetry(ctx, func() error {
+		cmd := newCmd()
+		stderr := &bytes.Buffer{}
+		if cmd.Stderr != nil {
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+		} else {
+			cmd.Stderr = stderr
+		}
+
+		err := cmd.Run()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		return gitError(err, stderr.String())
+	})
+}
+
+// gitError marks err as temporary if the stderr of git suggests so. Failed
+// authentication is explained.
+func gitError(err error, stderr string) error {
+	if gitAuth.MatchString(stderr) {
+		return fmt.Errorf("%w: %s: %s", err, lastLine(stderr), authHint)
+	}
+	if gitPermanent.MatchString(stderr) || !gitTemporary.MatchString(stderr) {
+		return err
+	}
+	return &temporaryError{err: fmt.Errorf("%w: %s", err, lastLine(stderr))}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
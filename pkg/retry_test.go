@@ -0,0 +1,133 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withFastRetries(t *testing.T) {
+	oldRetries, oldDelay := Retries, RetryDelay
+	Retries, RetryDelay = 3, time.Millisecond
+	t.Cleanup(func() { Retries, RetryDelay = oldRetries, oldDelay })
+}
+
+func TestRetryArchiveDownload(t *testing.T) {
+	withFastRetries(t)
+
+	tests := []struct {
+		name     string
+		statuses []int
+		header   http.Header
+		attempts int
+		err      bool
+	}{
+		{name: "ok", statuses: []int{200}, attempts: 1},
+		{name: "502", statuses: []int{502, 502, 200}, attempts: 3},
+		{name: "429", statuses: []int{429, 200}, header: http.Header{"Retry-After": {"0"}}, attempts: 2},
+		{name: "429 too long", statuses: []int{429, 200}, header: http.Header{"Retry-After": {"86400"}}, attempts: 1, err: true},
+		{name: "exhausted", statuses: []int{503, 503, 503, 503, 200}, attempts: 4, err: true},
+		{name: "404", statuses: []int{404, 200}, attempts: 1, err: true},
+		{name: "401", statuses: []int{401, 200}, attempts: 1, err: true},
+	}
+
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range c.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(c.statuses[attempts])
+				attempts++
+				w.Write([]byte("archive"))
+			}))
+			defer srv.Close()
+
+			dest := filepath.Join(t.TempDir(), "archive.tar.gz")
+			err := withRetry(context.TODO(), func() error {
+				return downloadArchive(context.TODO(), dest, srv.URL)
+			})
+			assert.Equal(t, c.attempts, attempts)
+
+			if c.err {
+				var httpErr *HTTPError
+				require.True(t, errors.As(err, &httpErr), err)
+				assert.Equal(t, c.statuses[attempts-1], httpErr.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			data, err := ioutil.ReadFile(dest)
+			require.NoError(t, err)
+			assert.Equal(t, "archive", string(data))
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	withFastRetries(t)
+	RetryDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := withRetry(ctx, func() error {
+		attempts++
+		cancel()
+		return &temporaryError{err: errors.New("502")}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, 2*time.Second, retryAfter("2"))
+	assert.Equal(t, time.Duration(0), retryAfter("soon"))
+
+	d := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, d > 50*time.Second && d <= time.Minute, d)
+}
+
+func TestGitError(t *testing.T) {
+	tests := []struct {
+		stderr    string
+		temporary bool
+	}{
+		{"fatal: unable to access 'https://github.com/foo/bar/': The requested URL returned error: 502", true},
+		{"error: RPC failed; HTTP 429 curl 22 The requested URL returned error: 429", true},
+		{"fatal: read error: Connection reset by peer\nfatal: early EOF", true},
+		{"fatal: remote error: upload-pack: not our ref", false},
+		{"remote: Repository not found.\nfatal: repository 'https://github.com/foo/bar/' not found", false},
+		{"fatal: Authentication failed for 'https://github.com/foo/bar/'", false},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", false},
+		{"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", false},
+	}
+
+	for _, c := range tests {
+		err := gitError(errors.New("exit status 128"), c.stderr)
+		var tmp *temporaryError
+		assert.Equal(t, c.temporary, errors.As(err, &tmp), c.stderr)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package semver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint is a set of version ranges. A version satisfies the constraint if
+// it is contained in at least one of the ranges.
+//
+// Supported syntax:
+//   - comparisons: `=1.2.3`, `!=1.2.3`, `>1.2`, `>=1.2.3`, `<2`, `<=1.4`
+//   - tilde ranges: `~1.2.3` (>=1.2.3 <1.3.0), `~1.2` (>=1.2.0 <1.3.0)
+//   - caret ranges: `^1.2.3` (>=1.2.3 <2.0.0), `^0.2.3` (>=0.2.3 <0.3.0)
+//   - wildcards: `1.2.x`, `1.*`, `*`
+//   - conjunctions, separated by spaces or commas: `>=2.0 <3.0`
+//   - disjunctions: `^1.0 || ^2.0`
+//
+// Prerelease versions only satisfy a constraint if one of its comparators
+// explicitly mentions a prerelease of the same MAJOR.MINOR.PATCH.
+type Constraint struct {
+	ranges   [][]comparator
+	original string
+}
+
+type comparator struct {
+	op string
+	v  Version
+}
+
+// IsConstraint reports whether s is a version constraint rather than a
+// literal git ref (branch, tag or commit). Plain versions like `v1.2.0` are
+// literal refs, as they name exactly one tag.
+func IsConstraint(s string) bool {
+	if !strings.ContainsAny(s, "^~<>=!*| ,") && !hasWildcard(s) {
+		return false
+	}
+	_, err := ParseConstraint(s)
+	return err == nil
+}
+
+func hasWildcard(s string) bool {
+	for _, p := range strings.Split(strings.TrimPrefix(s, "v"), ".") {
+		if p == "x" || p == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseConstraint parses a constraint string. See Constraint for the syntax.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{original: s}
+
+	for _, or := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(or, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+		if len(fields) == 0 {
+			return c, fmt.Errorf("invalid constraint `%s`: empty range", s)
+		}
+
+		var rng []comparator
+		for i := 0; i < len(fields); i++ {
+			f := fields[i]
+
+			// allow whitespace between operator and version: `>= 1.2`
+			if isOperator(f) && i+1 < len(fields) {
+				i++
+				f += fields[i]
+			}
+
+			cmps, err := parseComparator(f)
+			if err != nil {
+				return c, fmt.Errorf("invalid constraint `%s`: %w", s, err)
+			}
+			rng = append(rng, cmps...)
+		}
+		c.ranges = append(c.ranges, rng)
+	}
+
+	return c, nil
+}
+
+func (c Constraint) String() string {
+	return c.original
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+func isOperator(s string) bool {
+	for _, o := range operators {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+// parseComparator expands a single comparator into its primitive comparisons
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, o := range operators {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+	vs := strings.TrimPrefix(s, op)
+
+	// `*` and `x` match everything
+	if vs == "*" || vs == "x" || vs == "X" {
+		if op != "" && op != "=" && op != ">=" {
+			return nil, fmt.Errorf("operator `%s` cannot be used with a wildcard", op)
+		}
+		return []comparator{{op: ">=", v: Version{}}}, nil
+	}
+
+	v, n, err := parse(vs, true)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("invalid version `%s`", vs)
+	}
+	full := n == 3
+
+	switch op {
+	case "", "=":
+		if full {
+			return []comparator{{op: "=", v: v}}, nil
+		}
+		// partial versions are ranges: `1.2` is >=1.2.0 <1.3.0
+		return []comparator{{op: ">=", v: v}, {op: "<", v: bump(v, n)}}, nil
+	case "!=":
+		if !full {
+			return nil, fmt.Errorf("`!=` requires a full version, got `%s`", vs)
+		}
+		return []comparator{{op: "!=", v: v}}, nil
+	case ">":
+		if full {
+			return []comparator{{op: ">", v: v}}, nil
+		}
+		// `>1.2` excludes all of 1.2.x
+		return []comparator{{op: ">=", v: bump(v, n)}}, nil
+	case ">=":
+		return []comparator{{op: ">=", v: v}}, nil
+	case "<":
+		return []comparator{{op: "<", v: v}}, nil
+	case "<=":
+		if full {
+			return []comparator{{op: "<=", v: v}}, nil
+		}
+		// `<=1.2` includes all of 1.2.x
+		return []comparator{{op: "<", v: bump(v, n)}}, nil
+	case "~":
+		// `~1` is >=1.0.0 <2.0.0, everything else allows patch changes only
+		pos := 2
+		if n == 1 {
+			pos = 1
+		}
+		return []comparator{{op: ">=", v: v}, {op: "<", v: bump(v, pos)}}, nil
+	case "^":
+		// allow changes that do not modify the left-most non-zero component
+		pos := 1
+		switch {
+		case v.Major != 0 || n == 1:
+			pos = 1
+		case v.Minor != 0 || n == 2:
+			pos = 2
+		default:
+			pos = 3
+		}
+		return []comparator{{op: ">=", v: v}, {op: "<", v: bump(v, pos)}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator `%s`", op)
+}
+
+// bump returns the lowest version that is greater than all versions with the
+// same first n components as v.
+func bump(v Version, n int) Version {
+	switch n {
+	case 1:
+		return Version{Major: v.Major + 1}
+	case 2:
+		return Version{Major: v.Major, Minor: v.Minor + 1}
+	default:
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+}
+
+// Check reports whether v satisfies the constraint
+func (c Constraint) Check(v Version) bool {
+	for _, rng := range c.ranges {
+		if checkRange(rng, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRange(rng []comparator, v Version) bool {
+	for _, cmp := range rng {
+		if !cmp.check(v) {
+			return false
+		}
+	}
+
+	if len(v.Prerelease) == 0 {
+		return true
+	}
+
+	// prereleases need to be explicitly asked for
+	for _, cmp := range rng {
+		if len(cmp.v.Prerelease) > 0 &&
+			cmp.v.Major == v.Major && cmp.v.Minor == v.Minor && cmp.v.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c comparator) check(v Version) bool {
+	cmp := v.Compare(c.v)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Intersect returns the constraint satisfied by the versions that satisfy
+// both c and o. A prerelease satisfies it if a comparator of either mentions
+// it.
+func (c Constraint) Intersect(o Constraint) Constraint {
+	var r Constraint
+	var ors []string
+	for _, a := range c.ranges {
+		for _, b := range o.ranges {
+			rng := append(append([]comparator{}, a...), b...)
+			if emptyRange(rng) {
+				continue
+			}
+			r.ranges = append(r.ranges, rng)
+
+			var ands []string
+			for _, cmp := range rng {
+				ands = append(ands, cmp.op+cmp.v.String())
+			}
+			ors = append(ors, strings.Join(ands, " "))
+		}
+	}
+	r.original = strings.Join(ors, " || ")
+	return r
+}
+
+// Satisfiable reports whether any version lies within one of the ranges of
+// the constraint
+func (c Constraint) Satisfiable() bool {
+	for _, rng := range c.ranges {
+		if !emptyRange(rng) {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyRange reports whether no version satisfies all comparators of rng
+func emptyRange(rng []comparator) bool {
+	type bound struct {
+		v         Version
+		inclusive bool
+		set       bool
+	}
+
+	var lo, hi bound
+	for _, cmp := range rng {
+		if cmp.op == ">" || cmp.op == ">=" || cmp.op == "=" {
+			b := bound{v: cmp.v, inclusive: cmp.op != ">", set: true}
+			if d := b.v.Compare(lo.v); !lo.set || d > 0 || (d == 0 && !b.inclusive) {
+				lo = b
+			}
+		}
+		if cmp.op == "<" || cmp.op == "<=" || cmp.op == "=" {
+			b := bound{v: cmp.v, inclusive: cmp.op != "<", set: true}
+			if d := b.v.Compare(hi.v); !hi.set || d < 0 || (d == 0 && !b.inclusive) {
+				hi = b
+			}
+		}
+	}
+	if !lo.set || !hi.set {
+		return false
+	}
+
+	switch d := lo.v.Compare(hi.v); {
+	case d > 0:
+		return true
+	case d < 0:
+		return false
+	}
+
+	// a single version, unless excluded
+	if !lo.inclusive || !hi.inclusive {
+		return true
+	}
+	for _, cmp := range rng {
+		if cmp.op == "!=" && cmp.v.Compare(lo.v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Highest returns the highest of the given versions that satisfies the
+// constraint. Strings that are not valid versions are ignored. ok is false if
+// no version matched.
+func (c Constraint) Highest(versions []string) (highest string, ok bool) {
+	var matching []Version
+	for _, s := range versions {
+		v, err := Parse(s)
+		if err != nil {
+			continue
+		}
+		if c.Check(v) {
+			matching = append(matching, v)
+		}
+	}
+
+	if len(matching) == 0 {
+		return "", false
+	}
+
+	Sort(matching)
+	return matching[len(matching)-1].Original, true
+}
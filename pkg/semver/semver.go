@@ -0,0 +1,185 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package semver implements parsing and comparison of semantic versions
+// (https://semver.org) as used by git tags, as well as version constraints like
+// `^1.4.0`, `~0.9` or `>=2.0 <3.0` that can be resolved against them.
+package semver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version. Missing minor and patch components
+// are treated as zero, so `v1.2` equals `v1.2.0`.
+type Version struct {
+	Major, Minor, Patch uint64
+	Prerelease          []string
+	Build               string
+
+	// Original is the string the version was parsed from, e.g. `v1.2.0`
+	Original string
+}
+
+// Parse parses a version of the form `[v]MAJOR[.MINOR[.PATCH]][-PRE][+BUILD]`
+func Parse(s string) (Version, error) {
+	v, _, err := parse(s, false)
+	return v, err
+}
+
+// parse parses s into a Version. It also returns how many of the numeric
+// components were given. If wildcards is set, `x`, `X` and `*` are accepted
+// in place of numbers and stop the parsing of further components.
+func parse(s string, wildcards bool) (Version, int, error) {
+	v := Version{Original: s}
+	str := strings.TrimPrefix(s, "v")
+	if str == "" {
+		return v, 0, fmt.Errorf("invalid version `%s`: empty", s)
+	}
+
+	if i := strings.Index(str, "+"); i >= 0 {
+		v.Build = str[i+1:]
+		str = str[:i]
+		if v.Build == "" {
+			return v, 0, fmt.Errorf("invalid version `%s`: empty build metadata", s)
+		}
+	}
+
+	if i := strings.Index(str, "-"); i >= 0 {
+		pre := str[i+1:]
+		str = str[:i]
+		if pre == "" {
+			return v, 0, fmt.Errorf("invalid version `%s`: empty prerelease", s)
+		}
+		v.Prerelease = strings.Split(pre, ".")
+		for _, p := range v.Prerelease {
+			if p == "" {
+				return v, 0, fmt.Errorf("invalid version `%s`: empty prerelease identifier", s)
+			}
+		}
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("invalid version `%s`: too many components", s)
+	}
+
+	nums := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		if wildcards && (p == "x" || p == "X" || p == "*") {
+			if i != len(parts)-1 || v.Prerelease != nil {
+				return v, 0, fmt.Errorf("invalid version `%s`: misplaced wildcard", s)
+			}
+			return v, i, nil
+		}
+
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, 0, fmt.Errorf("invalid version `%s`: component `%s` is not a number", s, p)
+		}
+		*nums[i] = n
+	}
+
+	return v, len(parts), nil
+}
+
+// String returns the canonical form of the version, without a `v` prefix
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal or greater than o following
+// semver precedence rules. Build metadata is ignored.
+func (v Version) Compare(o Version) int {
+	if c := cmpUint(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := cmpUint(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := cmpUint(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// a version without prerelease has higher precedence
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], o.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpUint(uint64(len(v.Prerelease)), uint64(len(o.Prerelease)))
+}
+
+// LessThan reports whether v has lower precedence than o
+func (v Version) LessThan(o Version) bool {
+	return v.Compare(o) < 0
+}
+
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return cmpUint(an, bn)
+	// numeric identifiers always have lower precedence
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func cmpUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Sort sorts the versions in ascending order. Versions of equal precedence
+// are ordered by their original string to keep the result deterministic.
+func Sort(vs []Version) {
+	sort.SliceStable(vs, func(i, j int) bool {
+		if c := vs[i].Compare(vs[j]); c != 0 {
+			return c < 0
+		}
+		return vs[i].Original < vs[j].Original
+	})
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package semver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "v1.2.3", want: "1.2.3"},
+		{in: "1.2.3", want: "1.2.3"},
+		{in: "v1.2", want: "1.2.0"},
+		{in: "v1", want: "1.0.0"},
+		{in: "v1.2.3-rc.1+build.5", want: "1.2.3-rc.1+build.5"},
+		{in: "master", err: true},
+		{in: "v1.2.3.4", err: true},
+		{in: "v1.2.x", err: true},
+		{in: "v1.2.3-", err: true},
+		{in: "", err: true},
+	}
+
+	for _, c := range tests {
+		t.Run(c.in, func(t *testing.T) {
+			v, err := Parse(c.in)
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, v.String())
+			assert.Equal(t, c.in, v.Original)
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// ascending order
+	versions := []string{
+		"0.9.0",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	for i := range versions {
+		for j := range versions {
+			a, b := mustParse(t, versions[i]), mustParse(t, versions[j])
+			want := cmpUint(uint64(i), uint64(j))
+			assert.Equalf(t, want, a.Compare(b), "%s <=> %s", versions[i], versions[j])
+		}
+	}
+}
+
+func TestIsConstraint(t *testing.T) {
+	cases := map[string]bool{
+		"^1.4.0":      true,
+		"~0.9":        true,
+		">=2.0 <3.0":  true,
+		"1.2.x":       true,
+		"*":           true,
+		"^1 || ^2":    true,
+		"v1.4.0":      false,
+		"1.4":         false,
+		"master":      false,
+		"release-1.x": false,
+		"54865853ebc1f901964e25a2e7a0e4d2cb6b9648": false,
+	}
+
+	for s, want := range cases {
+		assert.Equalf(t, want, IsConstraint(s), "IsConstraint(%q)", s)
+	}
+}
+
+func TestConstraintCheck(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{
+			constraint: "^1.4.0",
+			match:      []string{"1.4.0", "v1.4.1", "1.9.9"},
+			noMatch:    []string{"1.3.9", "2.0.0", "1.5.0-rc.1"},
+		},
+		{
+			constraint: "^0.2.3",
+			match:      []string{"0.2.3", "0.2.9"},
+			noMatch:    []string{"0.3.0", "0.2.2"},
+		},
+		{
+			constraint: "^0.0.3",
+			match:      []string{"0.0.3"},
+			noMatch:    []string{"0.0.4"},
+		},
+		{
+			constraint: "~0.9",
+			match:      []string{"0.9.0", "0.9.12"},
+			noMatch:    []string{"0.10.0", "0.8.9"},
+		},
+		{
+			constraint: "~1",
+			match:      []string{"1.0.0", "1.9.0"},
+			noMatch:    []string{"2.0.0"},
+		},
+		{
+			constraint: ">=2.0 <3.0",
+			match:      []string{"2.0.0", "2.99.1"},
+			noMatch:    []string{"1.9.9", "3.0.0", "3.0.0-rc.1"},
+		},
+		{
+			constraint: ">= 2.0, < 3.0",
+			match:      []string{"2.5.0"},
+			noMatch:    []string{"3.0.0"},
+		},
+		{
+			constraint: ">1.2",
+			match:      []string{"1.3.0"},
+			noMatch:    []string{"1.2.9"},
+		},
+		{
+			constraint: "<=1.2",
+			match:      []string{"1.2.9"},
+			noMatch:    []string{"1.3.0"},
+		},
+		{
+			constraint: "1.2.x",
+			match:      []string{"1.2.0", "1.2.7"},
+			noMatch:    []string{"1.3.0"},
+		},
+		{
+			constraint: "^1.0 || ^3.0",
+			match:      []string{"1.1.0", "3.2.0"},
+			noMatch:    []string{"2.0.0"},
+		},
+		{
+			constraint: ">=1.0.0 !=1.2.0",
+			match:      []string{"1.1.0", "1.2.1"},
+			noMatch:    []string{"1.2.0"},
+		},
+		{
+			constraint: ">=1.0.0-rc.1 <1.1",
+			match:      []string{"1.0.0-rc.2", "1.0.5"},
+			noMatch:    []string{"1.0.1-rc.1"},
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.constraint, func(t *testing.T) {
+			con := mustParseConstraint(t, c.constraint)
+
+			for _, v := range c.match {
+				assert.Truef(t, con.Check(mustParse(t, v)), "%s should match %s", c.constraint, v)
+			}
+			for _, v := range c.noMatch {
+				assert.Falsef(t, con.Check(mustParse(t, v)), "%s should not match %s", c.constraint, v)
+			}
+		})
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, s := range []string{"", "^", ">=foo", "1.2 ||", "!=1.2", "<*"} {
+		_, err := ParseConstraint(s)
+		assert.Errorf(t, err, "expected %q to be invalid", s)
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		a, b        string
+		want        string
+		satisfiable bool
+		match       []string
+		noMatch     []string
+	}{
+		{
+			a: "^1.2.0", b: "^1.3.0",
+			want: ">=1.2.0 <2.0.0 >=1.3.0 <2.0.0", satisfiable: true,
+			match: []string{"1.3.0", "1.9.0"}, noMatch: []string{"1.2.5", "2.0.0"},
+		},
+		{
+			a: "^1.0 || ^3.0", b: ">=1.5",
+			want: ">=1.0.0 <2.0.0 >=1.5.0 || >=3.0.0 <4.0.0 >=1.5.0", satisfiable: true,
+			match: []string{"1.5.0", "3.1.0"}, noMatch: []string{"1.4.0", "2.0.0"},
+		},
+		{a: "^1.2.0", b: "^2.0.0"},
+		{a: ">=1.2.0", b: "<1.2.0"},
+		{a: "<=1.2.0", b: ">=1.2.0 !=1.2.0"},
+		{a: "<=1.2.0", b: ">=1.2.0", want: "<=1.2.0 >=1.2.0", satisfiable: true, match: []string{"1.2.0"}},
+	}
+
+	for _, c := range tests {
+		got := mustParseConstraint(t, c.a).Intersect(mustParseConstraint(t, c.b))
+		assert.Equal(t, c.want, got.String(), c.a+" "+c.b)
+		assert.Equal(t, c.satisfiable, got.Satisfiable(), c.a+" "+c.b)
+		for _, v := range c.match {
+			assert.True(t, got.Check(mustParse(t, v)), v)
+		}
+		for _, v := range c.noMatch {
+			assert.False(t, got.Check(mustParse(t, v)), v)
+		}
+		if c.satisfiable {
+			_, err := ParseConstraint(got.String())
+			assert.NoError(t, err, "the intersection can be parsed again")
+		}
+	}
+}
+
+func TestHighest(t *testing.T) {
+	tags := []string{"v1.3.0", "v1.4.0", "v1.4.2", "v2.0.0", "v1.5.0-rc.1", "latest", "v1.4.10"}
+
+	got, ok := mustParseConstraint(t, "^1.4.0").Highest(tags)
+	assert.True(t, ok)
+	assert.Equal(t, "v1.4.10", got)
+
+	got, ok = mustParseConstraint(t, "~1.3").Highest(tags)
+	assert.True(t, ok)
+	assert.Equal(t, "v1.3.0", got)
+
+	_, ok = mustParseConstraint(t, "^3").Highest(tags)
+	assert.False(t, ok)
+}
+
+func mustParse(t *testing.T, s string) Version {
+	t.Helper()
+	v, err := Parse(s)
+	require.NoError(t, err)
+	return v
+}
+
+func mustParseConstraint(t *testing.T, s string) Constraint {
+	t.Helper()
+	c, err := ParseConstraint(s)
+	require.NoError(t, err)
+	return c
+}
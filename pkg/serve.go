@@ -0,0 +1,370 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/pkg/semver"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// ProxyServer serves the package cache in CacheDir using the protocol
+// described at Proxy. Packages that are not cached yet are fetched from
+// upstream, through Proxy, unless Offline is set.
+type ProxyServer struct{}
+
+// NewProxyServer returns a ProxyServer. CacheDir must be set.
+func NewProxyServer() (*ProxyServer, error) {
+	if CacheDir == "" {
+		return nil, errors.New("serving packages requires a cache directory")
+	}
+	return &ProxyServer{}, nil
+}
+
+func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repo, file, ok := parseProxyPath(r.URL.EscapedPath())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	remote := "https://" + repo + ".git"
+
+	var err error
+	switch {
+	case file == "list":
+		err = s.list(w, r, remote)
+	case strings.HasSuffix(file, ".info"):
+		err = s.info(w, r, remote, strings.TrimSuffix(file, ".info"))
+	case strings.HasSuffix(file, ".tar.gz"):
+		err = s.tarball(w, r, repo, strings.TrimSuffix(file, ".tar.gz"), r.URL.Query().Get("subdir"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusBadGateway
+		var tmp *temporaryError
+		switch {
+		case errors.Is(err, errProxyNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errOffline):
+			status = http.StatusNotFound
+		case errors.As(err, &tmp):
+			status = http.StatusServiceUnavailable
+		}
+		printf(r.Context(), color.FgYellow, "%s %s: %s", r.Method, r.URL, err)
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// parseProxyPath splits an escaped request path into repository and file
+func parseProxyPath(p string) (repo, file string, ok bool) {
+	i := strings.Index(p, "/@v/")
+	if i < 0 {
+		return "", "", false
+	}
+
+	repo, err := url.PathUnescape(strings.Trim(p[:i], "/"))
+	if err != nil {
+		return "", "", false
+	}
+	file, err = url.PathUnescape(p[i+len("/@v/"):])
+	if err != nil {
+		return "", "", false
+	}
+
+	if repo == "" || path.Clean(repo) != repo || strings.HasPrefix(repo, ".") || !strings.Contains(repo, "/") {
+		return "", "", false
+	}
+	return repo, file, true
+}
+
+// refs returns the refs of the remote: from upstream if possible, the cached
+// ones otherwise
+func (s *ProxyServer) refs(ctx context.Context, remote string) (map[string]string, error) {
+	if Offline {
+		if refs, ok := cacheLoadRefs(remote); ok {
+			return refs, nil
+		}
+		return nil, errOffline
+	}
+
+	refs, err := remoteListRefs(ctx, remote)
+	if err == nil {
+		return refs, nil
+	}
+	if cached, ok := cacheLoadRefs(remote); ok {
+		printf(ctx, color.FgYellow, "WARN: serving cached refs of %s: %s", remote, err)
+		return cached, nil
+	}
+
+	var tmp *temporaryError
+	if errors.As(err, &tmp) || ctx.Err() != nil {
+		return nil, err
+	}
+	return nil, errors.Wrap(errProxyNotFound, err.Error())
+}
+
+func (s *ProxyServer) list(w http.ResponseWriter, r *http.Request, remote string) error {
+	refs, err := s.refs(r.Context(), remote)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write(formatRefs(refs))
+	return err
+}
+
+func (s *ProxyServer) info(w http.ResponseWriter, r *http.Request, remote, ref string) error {
+	commit := ref
+	if !isCommit(ref) {
+		refs, err := s.refs(r.Context(), remote)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		for _, name := range []string{"refs/tags/" + ref, "refs/heads/" + ref, ref} {
+			if commit, ok = refs[name]; ok {
+				break
+			}
+		}
+		if !ok {
+			return errors.Wrapf(errProxyNotFound, "unknown ref %s", ref)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(ProxyInfo{Ref: ref, Commit: commit})
+}
+
+func (s *ProxyServer) tarball(w http.ResponseWriter, r *http.Request, repo, commit, subdir string) error {
+	if !isCommit(commit) {
+		return errors.Wrapf(errProxyNotFound, "tarballs are only served for commits, not %s", commit)
+	}
+
+	subdir = strings.Trim(path.Clean("/"+subdir), "/")
+	source := gitSourceOf(repo, subdir)
+
+	sum, err := s.fetch(r.Context(), source, commit)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	return writeTarball(w, cacheSumDir(sum), path.Base(repo))
+}
+
+// fetch makes sure the commit of the source is cached and returns its sum
+func (s *ProxyServer) fetch(ctx context.Context, source *deps.Git, commit string) (string, error) {
+	if sum, ok := cacheLookup(source, commit); ok {
+		// the cached contents may have been tampered with
+		if sumLike(cacheSumDir(sum), sum) == sum {
+			return sum, nil
+		}
+		os.RemoveAll(cacheSumDir(sum))
+	}
+
+	if Offline {
+		return "", errOffline
+	}
+
+	return fetchToCache(ctx, source, commit)
+}
+
+// fetchToCache installs the version of the source into a temporary directory
+// and adds it to the cache. It returns the sum of the package.
+func fetchToCache(ctx context.Context, source *deps.Git, version string) (string, error) {
+	dir, err := ioutil.TempDir("", "jb-fetch-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, ".tmp"), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	commit, err := NewGitPackage(source).Install(ctx, "pkg", dir, version)
+	if err != nil {
+		return "", err
+	}
+
+	sum := hashDir(filepath.Join(dir, "pkg"))
+	if err := cacheStore(source, commit, sum, filepath.Join(dir, "pkg")); err != nil {
+		return "", errors.Wrap(err, "caching package")
+	}
+	return sum, nil
+}
+
+// gitSourceOf returns the git source of the subdir of a repository served by
+// a proxy, such as github.com/grafana/jsonnet-libs
+func gitSourceOf(repo, subdir string) *deps.Git {
+	parts := strings.Split(repo, "/")
+	g := &deps.Git{
+		Scheme: deps.GitSchemeHTTPS,
+		Host:   parts[0],
+		User:   strings.Join(parts[1:len(parts)-1], "/"),
+		Repo:   parts[len(parts)-1],
+	}
+	if subdir != "" {
+		g.Subdir = "/" + subdir
+	}
+	return g
+}
+
+// writeTarball writes the contents of dir as a gzipped tarball to w. All
+// entries are placed below a single top-level directory called name.
+func writeTarball(w io.Writer, dir, name string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Prefetch adds the packages to the cache, along with the refs of their
+// repositories, so they can be installed or served without network access.
+// Local packages are skipped. Failures are reported per package, the number of
+// failed packages is returned as an error.
+func Prefetch(ctx context.Context, list []deps.Dependency) error {
+	if CacheDir == "" {
+		return errors.New("prefetching packages requires a cache directory")
+	}
+
+	failed := 0
+	listed := make(map[string]bool)
+	for _, d := range list {
+		u := d.Upstream()
+		if u.Source.GitSource == nil || d.Excluded {
+			continue
+		}
+		source := u.Source.GitSource
+
+		err := func() error {
+			if !listed[source.Remote()] {
+				listed[source.Remote()] = true
+				if _, err := remoteListRefs(ctx, source.Remote()); err != nil {
+					return errors.Wrap(err, "listing refs")
+				}
+			}
+
+			// locks record the installed commit
+			version := u.Version
+			if isCommit(d.Version) {
+				version = d.Version
+			}
+			if semver.IsConstraint(version) {
+				_, commit, err := remoteResolveConstraint(ctx, source.Remote(), version)
+				if err != nil {
+					return err
+				}
+				version = commit
+			}
+			if _, ok := cacheLookup(source, version); ok {
+				printf(ctx, color.FgGreen, "CACHED %s@%s", d.Name(), version)
+				return nil
+			}
+
+			_, err := fetchToCache(ctx, source, version)
+			if err == nil {
+				printf(ctx, color.FgGreen, "FETCHED %s@%s", d.Name(), version)
+			}
+			return err
+		}()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			printf(ctx, color.FgRed, "FAILED %s: %s", d.Name(), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to fetch %d packages", failed)
+	}
+	return nil
+}
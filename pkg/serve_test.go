@@ -0,0 +1,140 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// testUpstream makes the tags available as https://example.com/foo/bar.git,
+// by having git rewrite that URL to a local bare repository
+func testUpstream(t *testing.T, tags ...string) (remote, repo string) {
+	t.Helper()
+
+	repo = testRepo(t, tags...)
+	root := t.TempDir()
+	out, err := exec.Command("git", "clone", "--quiet", "--bare", repo, filepath.Join(root, "foo", "bar.git")).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "url."+root+"/.insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", "https://example.com/")
+
+	return "https://example.com/foo/bar.git", repo
+}
+
+func testProxyServer(t *testing.T) proxyClient {
+	t.Helper()
+
+	s, err := NewProxyServer()
+	require.NoError(t, err)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return proxyClient{base: srv.URL}
+}
+
+func readMain(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "main.libsonnet"))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestProxyServer(t *testing.T) {
+	withCache(t)
+	remote, repo := testUpstream(t, "v1.0.0", "a:v1.1.0")
+	c := testProxyServer(t)
+	ctx := context.TODO()
+
+	refs, err := c.listRefs(ctx, remote)
+	require.NoError(t, err)
+	assert.Equal(t, revParse(t, repo, "v1.0.0"), refs["refs/tags/v1.0.0"])
+	assert.Equal(t, revParse(t, repo, "v1.1.0"), refs["refs/tags/v1.1.0"])
+
+	commit, err := c.resolve(ctx, remote, "v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, revParse(t, repo, "v1.0.0"), commit)
+
+	_, err = c.resolve(ctx, remote, "v9.9.9")
+	assert.True(t, errors.Is(err, errProxyNotFound), err)
+
+	_, err = c.listRefs(ctx, "https://example.com/foo/unknown.git")
+	assert.True(t, errors.Is(err, errProxyNotFound), err)
+
+	source := deps.Parse("", "example.com/foo/bar@v1.1.0").Source.GitSource
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+
+	commit, err = c.install(ctx, source, vendorDir, "bar", "v1.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, revParse(t, repo, "v1.1.0"), commit)
+	assert.Equal(t, `"a:v1.1.0"`, readMain(t, filepath.Join(vendorDir, "bar")))
+
+	// fetched packages are served from the cache, without upstream
+	Offline = true
+	defer func() { Offline = false }()
+
+	refs, err = c.listRefs(ctx, remote)
+	require.NoError(t, err)
+	assert.Equal(t, revParse(t, repo, "v1.0.0"), refs["refs/tags/v1.0.0"])
+
+	require.NoError(t, os.RemoveAll(filepath.Join(vendorDir, "bar")))
+	_, err = c.install(ctx, source, vendorDir, "bar", "v1.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, `"a:v1.1.0"`, readMain(t, filepath.Join(vendorDir, "bar")))
+
+	_, err = c.install(ctx, source, vendorDir, "bar", "v1.0.0")
+	assert.True(t, errors.Is(err, errProxyNotFound), err)
+}
+
+func TestPrefetch(t *testing.T) {
+	withCache(t)
+	remote, repo := testUpstream(t, "v1.0.0", "v1.1.0")
+
+	d := *deps.Parse("", "example.com/foo/bar@v1.0.0")
+	locked := *deps.Parse("", "example.com/foo/bar@"+revParse(t, repo, "v1.1.0"))
+	constraint := *deps.Parse("", "example.com/foo/bar@^1.0.0")
+	require.NoError(t, Prefetch(context.TODO(), []deps.Dependency{d, locked, constraint}))
+
+	err := Prefetch(context.TODO(), []deps.Dependency{*deps.Parse("", "example.com/foo/unknown@v1.0.0")})
+	assert.Error(t, err)
+
+	Offline = true
+	defer func() { Offline = false }()
+	c := testProxyServer(t)
+
+	_, err = c.listRefs(context.TODO(), remote)
+	require.NoError(t, err)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		_, err := c.install(context.TODO(), d.Source.GitSource, vendorDir, tag, tag)
+		require.NoError(t, err)
+		assert.Equal(t, `"`+tag+`"`, readMain(t, filepath.Join(vendorDir, tag)))
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// Fetcher installs the packages of a kind of source (see deps.Kind)
+type Fetcher struct {
+	// New returns the package described by spec. Relative paths are based on
+	// parentDir, the directory of the jsonnetfile requiring the package.
+	New func(spec deps.Spec, parentDir string) (Interface, error)
+
+	// Resolve decides which version to install for the requested one, e.g.
+	// the tag matching a semver constraint. Optional.
+	Resolve func(ctx context.Context, spec deps.Spec, version string) (Resolution, error)
+
+	// LockSatisfies reports whether the lock l can be used for the requested
+	// dependency d, e.g. because it was installed from the requested tag.
+	// Defaults to true, meaning the lock pins any requested version.
+	LockSatisfies func(d, l deps.Dependency) bool
+
+	// Linked packages are symlinked into vendor/ instead of being copied, like
+	// local ones. They have no sum, so they are neither verified nor cached,
+	// and not linked under their legacy name.
+	Linked bool
+
+	// GitTree records the git tree of installed packages in the lock, see
+	// deps.Dependency.Tree
+	GitTree bool
+}
+
+// Resolution is the version of a package to install
+type Resolution struct {
+	// Version to pass to Install
+	Version string
+	// Tag to record in the lock, if any
+	Tag string
+	// Pinned is the version the package will be locked at, if already known,
+	// like the commit of a git tag. A cached package of it is used instead of
+	// calling Install.
+	Pinned string
+}
+
+// fetchers are the fetchers of all kinds of sources, by name
+var fetchers = map[string]Fetcher{
+	"git": {
+		New: func(spec deps.Spec, parentDir string) (Interface, error) {
+			return NewGitPackage(spec.(*deps.Git)), nil
+		},
+		Resolve:       gitResolve,
+		LockSatisfies: gitLockSatisfies,
+		GitTree:       true,
+	},
+	"local": {
+		New:    newLocal,
+		Linked: true,
+	},
+	"archive": {
+		New: func(spec deps.Spec, parentDir string) (Interface, error) {
+			return NewArchivePackage(spec.(*deps.Archive)), nil
+		},
+		Resolve:       archiveResolve,
+		LockSatisfies: archiveLockSatisfies,
+	},
+	"oci": {
+		New: func(spec deps.Spec, parentDir string) (Interface, error) {
+			return NewOCIPackage(spec.(*deps.OCI)), nil
+		},
+		Resolve:       ociResolve,
+		LockSatisfies: ociLockSatisfies,
+	},
+}
+
+// RegisterFetcher makes packages of a kind of source installable, which must
+// be registered using deps.Register as well. RegisterFetcher panics if the kind
+// already has a fetcher.
+//
+// RegisterFetcher is not safe for concurrent use and should be called from
+// init.
+func RegisterFetcher(kind string, f Fetcher) {
+	if _, ok := fetchers[kind]; ok {
+		panic(fmt.Sprintf("source kind %s already has a fetcher", kind))
+	}
+	if f.New == nil {
+		panic(fmt.Sprintf("fetcher of source kind %s needs New", kind))
+	}
+	fetchers[kind] = f
+}
+
+// fetcherOf returns the spec of the source and the fetcher of its kind
+func fetcherOf(s deps.Source) (deps.Spec, Fetcher, error) {
+	spec, kind, ok := s.Spec()
+	if !ok {
+		return nil, Fetcher{}, errors.New("a source is required")
+	}
+
+	f, ok := fetchers[kind.Name]
+	if !ok {
+		return nil, Fetcher{}, fmt.Errorf("no fetcher for source kind '%s'", kind.Name)
+	}
+	return spec, f, nil
+}
+
+// isLinked returns whether packages of the source are symlinked into vendor/
+func isLinked(s deps.Source) bool {
+	_, f, err := fetcherOf(s)
+	return err == nil && f.Linked
+}
+
+// newLocal returns the package of a local directory. Nested local
+// dependencies with relative paths are evaluated relative to their
+// referencing jsonnetfile, rather than relative to the top-level jsonnetfile.
+func newLocal(spec deps.Spec, parentDir string) (Interface, error) {
+	local := spec.(*deps.Local)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current working directory: %w", err)
+	}
+
+	modulePath, err := filepath.Rel(wd, filepath.Join(parentDir, local.Directory))
+	if err != nil {
+		modulePath = local.Directory
+	}
+
+	return NewLocalPackage(&deps.Local{Directory: modulePath}), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// memorySpec is a source kind registered by the tests, holding the contents
+// of main.libsonnet per version
+type memorySpec struct {
+	Path string `json:"path"`
+}
+
+func (m *memorySpec) Name() string       { return m.Path }
+func (m *memorySpec) LegacyName() string { return path.Base(m.Path) }
+
+var memoryPackages = map[string]string{
+	"v1": `"memory v1"`,
+	"v2": `"memory v2"`,
+}
+
+type memoryPackage struct{}
+
+func (memoryPackage) Install(ctx context.Context, name, dir, version string) (string, error) {
+	content, ok := memoryPackages[version]
+	if !ok {
+		return "", fmt.Errorf("unknown version %s", version)
+	}
+
+	dest := filepath.Join(dir, name)
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return "", err
+	}
+	return "memory-" + version, ioutil.WriteFile(filepath.Join(dest, "main.libsonnet"), []byte(content), 0644)
+}
+
+func init() {
+	deps.Register(deps.Kind{
+		Name: "memory",
+		New:  func() deps.Spec { return &memorySpec{} },
+		Parse: func(dir, uri string) *deps.Dependency {
+			if !strings.HasPrefix(uri, "memory://") {
+				return nil
+			}
+			p := strings.SplitN(strings.TrimPrefix(uri, "memory://"), "@", 2)
+			return &deps.Dependency{Source: deps.Source{Other: &memorySpec{Path: p[0]}}, Version: p[1]}
+		},
+	})
+
+	RegisterFetcher("memory", Fetcher{
+		New: func(spec deps.Spec, parentDir string) (Interface, error) {
+			return memoryPackage{}, nil
+		},
+		LockSatisfies: func(d, l deps.Dependency) bool {
+			return l.Version == "memory-"+d.Version
+		},
+	})
+}
+
+func TestRegisteredSource(t *testing.T) {
+	direct := v1.New()
+	d := deps.Parse("", "memory://example.com/foo@v1")
+	require.NotNil(t, d)
+	direct.Dependencies.Set(d.Name(), *d)
+
+	vendorDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp"), os.ModePerm))
+	locks, err := Ensure(context.TODO(), direct, vendorDir, deps.NewOrdered())
+	require.NoError(t, err)
+
+	l, ok := locks.Get("example.com/foo")
+	require.True(t, ok)
+	assert.Equal(t, "memory-v1", l.Version)
+	assert.Equal(t, hashDir(filepath.Join(vendorDir, "example.com/foo")), l.Sum)
+	assert.Equal(t, `"memory v1"`, readMain(t, filepath.Join(vendorDir, "example.com/foo")))
+
+	// the lock of v1 does not satisfy v2
+	d = deps.Parse("", "memory://example.com/foo@v2")
+	direct.Dependencies.Set(d.Name(), *d)
+	locks, err = Ensure(context.TODO(), direct, vendorDir, locks)
+	require.NoError(t, err)
+	l, _ = locks.Get("example.com/foo")
+	assert.Equal(t, "memory-v2", l.Version)
+	assert.Equal(t, `"memory v2"`, readMain(t, filepath.Join(vendorDir, "example.com/foo")))
+}
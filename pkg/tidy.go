@@ -0,0 +1,239 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+	"github.com/jsonnet-bundler/jsonnet-bundler/tool/imports"
+)
+
+// TidyReport lists how the direct dependencies of a project differ from what
+// its Jsonnet files actually import
+type TidyReport struct {
+	// Unused are direct dependencies that nothing imports
+	Unused []deps.Dependency
+	// Missing are packages the project imports, but only requires
+	// transitively. They are returned at the version the first requester
+	// asks for.
+	Missing []deps.Dependency
+	// Unresolved are imports of the project that are neither local files
+	// nor belong to any locked package
+	Unresolved []UnresolvedImport
+}
+
+// UnresolvedImport is an import that could not be mapped to a package
+type UnresolvedImport struct {
+	File string
+	imports.Import
+}
+
+// Tidy compares the imports of all Jsonnet files in dir to the dependencies
+// declared in direct. Files in vendorDir are only considered to find out which
+// packages are still imported by other packages.
+func Tidy(dir string, direct v1.JsonnetFile, vendorDir string, locks *deps.Ordered) (*TidyReport, error) {
+	m := newImportMapper(direct, vendorDir, locks)
+
+	absVendor, err := filepath.Abs(vendorDir)
+	if err != nil {
+		return nil, err
+	}
+
+	project, err := imports.Find(dir, func(path string) bool {
+		abs, err := filepath.Abs(path)
+		return (err == nil && abs == absVendor) || strings.HasPrefix(filepath.Base(path), ".")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vendored, err := imports.Find(vendorDir, func(path string) bool {
+		return filepath.Base(path) == ".tmp"
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	report := &TidyReport{}
+	used := make(map[string]bool)
+
+	for _, file := range sortedFiles(project) {
+		for _, i := range project[file] {
+			if name, ok := m.resolve(dir, file, i.Path); ok {
+				if name != "" {
+					used[name] = true
+				}
+				continue
+			}
+			report.Unresolved = append(report.Unresolved, UnresolvedImport{File: file, Import: i})
+		}
+	}
+
+	// imported by the project itself
+	imported := make(map[string]bool, len(used))
+	for name := range used {
+		imported[name] = true
+	}
+
+	for _, file := range sortedFiles(vendored) {
+		owner := m.owner(file)
+		for _, i := range vendored[file] {
+			if name, ok := m.resolve(dir, file, i.Path); ok && name != "" && name != owner {
+				used[name] = true
+			}
+		}
+	}
+
+	for _, d := range sorted(direct.Dependencies) {
+		if !used[d.Name()] {
+			report.Unused = append(report.Unused, d)
+		}
+	}
+
+	graph, err := LoadGraph(direct, vendorDir, locks)
+	if err != nil {
+		return nil, err
+	}
+
+	// edges are sorted by requester, so the first one wins
+	for _, e := range graph.Edges() {
+		if !imported[e.To] {
+			continue
+		}
+		imported[e.To] = false
+
+		if _, ok := direct.Dependencies.Get(e.To); ok {
+			continue
+		}
+		l, _ := locks.Get(e.To)
+		report.Missing = append(report.Missing, deps.Dependency{Source: l.Source, Version: e.Version, Single: l.Single})
+	}
+	sort.SliceStable(report.Missing, func(i, j int) bool {
+		return report.Missing[i].Name() < report.Missing[j].Name()
+	})
+
+	return report, nil
+}
+
+// importMapper maps import paths to locked packages
+type importMapper struct {
+	vendorDir string
+	// import prefix -> package name
+	prefixes map[string]string
+	names    []string
+}
+
+func newImportMapper(direct v1.JsonnetFile, vendorDir string, locks *deps.Ordered) *importMapper {
+	m := &importMapper{vendorDir: vendorDir, prefixes: make(map[string]string)}
+	for _, l := range sorted(locks) {
+		if l.Excluded {
+			continue
+		}
+		m.prefixes[l.Name()] = l.Name()
+		m.names = append(m.names, l.Name())
+	}
+
+	if direct.LegacyImports {
+		for _, l := range sorted(locks) {
+			if _, taken := m.prefixes[l.LegacyName()]; !taken && !l.Excluded {
+				m.prefixes[l.LegacyName()] = l.Name()
+			}
+		}
+	}
+
+	return m
+}
+
+// resolve returns the package the import of file belongs to. name is empty if
+// the import refers to a file of the project. ok is false if the import cannot
+// be resolved at all.
+func (m *importMapper) resolve(dir, file, path string) (name string, ok bool) {
+	if filepath.IsAbs(path) {
+		return "", true
+	}
+
+	// jsonnet tries the directory of the importing file first
+	if exists(filepath.Join(filepath.Dir(file), path)) {
+		if rel, err := filepath.Rel(m.vendorDir, filepath.Join(filepath.Dir(file), path)); err == nil && !strings.HasPrefix(rel, "..") {
+			return m.match(filepath.ToSlash(rel)), true
+		}
+		return "", true
+	}
+
+	// imports of vendor/ itself, if the project directory is a library path
+	p := filepath.ToSlash(path)
+	if rel, err := filepath.Rel(dir, m.vendorDir); err == nil {
+		p = strings.TrimPrefix(p, filepath.ToSlash(rel)+"/")
+	}
+
+	if name := m.match(p); name != "" {
+		return name, true
+	}
+
+	// other library paths commonly used, such as Tanka's lib/
+	for _, lib := range []string{dir, filepath.Join(dir, "lib")} {
+		if exists(filepath.Join(lib, path)) {
+			return "", true
+		}
+	}
+
+	return "", false
+}
+
+// match returns the package of the longest prefix of the import path
+func (m *importMapper) match(p string) string {
+	var best string
+	for prefix := range m.prefixes {
+		if (p == prefix || strings.HasPrefix(p, prefix+"/")) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	return m.prefixes[best]
+}
+
+// owner returns the name of the vendored package containing file
+func (m *importMapper) owner(file string) string {
+	rel, err := filepath.Rel(m.vendorDir, file)
+	if err != nil {
+		return ""
+	}
+
+	var owner string
+	for _, name := range m.names {
+		if strings.HasPrefix(filepath.ToSlash(rel), name+"/") && len(name) > len(owner) {
+			owner = name
+		}
+	}
+	return owner
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func sortedFiles(found map[string][]imports.Import) []string {
+	files := make([]string, 0, len(found))
+	for f := range found {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/jsonnet-bundler/jsonnet-bundler/spec/v1"
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+	"github.com/jsonnet-bundler/jsonnet-bundler/tool/imports"
+)
+
+func TestTidy(t *testing.T) {
+	dir := t.TempDir()
+	vendorDir := filepath.Join(dir, "vendor")
+
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "v2.0.0")
+	tempo := gitDep("tempo", "main")
+
+	// loki uses builder, which requires grafonnet
+	write("vendor/github.com/grafana/loki/dashboards.libsonnet", `
+(import 'main.libsonnet') + (import 'github.com/grafana/jsonnet-libs/main.libsonnet')
+`)
+
+	locks := deps.NewOrdered()
+	locks.Set(loki.Name(), vendorPackage(t, vendorDir, loki, "v2.0.0", builder))
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0", gitDep("grafonnet-lib", "v1.1.0")))
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.1.0"))
+	locks.Set(tempo.Name(), vendorPackage(t, vendorDir, tempo, ""))
+
+	direct := v1.New()
+	for _, d := range []deps.Dependency{loki, builder, tempo} {
+		direct.Dependencies.Set(d.Name(), d)
+	}
+
+	write("lib/util.libsonnet", `{}`)
+	write("environments/default/main.jsonnet", `
+local loki = import 'github.com/grafana/loki/dashboards.libsonnet';
+local grafana = import 'grafonnet-lib/main.libsonnet';
+local util = import 'util.libsonnet';
+local lib = import 'lib/util.libsonnet';
+local unknown = importstr 'github.com/example/unknown/file.txt';
+{}
+`)
+	write("environments/default/util.libsonnet", `{}`)
+	write(".hidden/main.jsonnet", `import 'github.com/grafana/tempo/main.libsonnet'`)
+
+	report, err := Tidy(dir, direct, vendorDir, locks)
+	require.NoError(t, err)
+
+	assert.Equal(t, []deps.Dependency{tempo}, report.Unused)
+	assert.Equal(t, []deps.Dependency{{Source: grafonnet.Source, Version: "v1.1.0"}}, report.Missing)
+	assert.Equal(t, []UnresolvedImport{{
+		File:   filepath.Join(dir, "environments/default/main.jsonnet"),
+		Import: imports.Import{Keyword: "importstr", Path: "github.com/example/unknown/file.txt", Line: 6},
+	}}, report.Unresolved)
+
+	// legacy names only count if enabled
+	direct.LegacyImports = false
+	report, err = Tidy(dir, direct, vendorDir, locks)
+	require.NoError(t, err)
+	assert.Empty(t, report.Missing)
+	assert.Len(t, report.Unresolved, 2)
+}
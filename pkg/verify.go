@@ -0,0 +1,144 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+// Kinds of problems found by Verify
+const (
+	// VerifyMissing means a locked package is not present in vendor/
+	VerifyMissing = "missing"
+	// VerifyMismatch means the contents of a package don't match its sum or
+	// git tree
+	VerifyMismatch = "mismatch"
+	// VerifyUnknown means a file or directory of vendor/ belongs to no locked
+	// package
+	VerifyUnknown = "unknown"
+)
+
+// VerifyProblem is a difference between vendor/ and the locks
+type VerifyProblem struct {
+	Kind string
+	// Name of the package, or path of the unknown entry relative to vendor/
+	Name string
+	// Expected and Actual sums, or git trees, of mismatching packages
+	Expected, Actual string
+}
+
+// Verify compares the contents of vendorDir to the locks, without changing
+// anything or accessing the network. Unlike Ensure, local packages are only
+// checked for existence, as they are not locked by sum.
+func Verify(vendorDir string, locks *deps.Ordered) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+
+	for _, d := range sorted(locks) {
+		if d.Excluded {
+			continue
+		}
+
+		dir := filepath.Join(vendorDir, d.Name())
+		if _, err := os.Stat(dir); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			problems = append(problems, VerifyProblem{Kind: VerifyMissing, Name: d.Name()})
+			continue
+		}
+
+		if isLinked(d.Upstream().Source) {
+			continue
+		}
+
+		if sum := sumLike(dir, d.Sum); sum != d.Sum {
+			problems = append(problems, VerifyProblem{Kind: VerifyMismatch, Name: d.Name(), Expected: d.Sum, Actual: sum})
+			continue
+		}
+
+		if d.Tree == "" {
+			continue
+		}
+		tree, err := gitTreeHash(dir)
+		if err != nil {
+			return nil, err
+		}
+		if tree != d.Tree {
+			problems = append(problems, VerifyProblem{Kind: VerifyMismatch, Name: d.Name(), Expected: d.Tree, Actual: tree})
+		}
+	}
+
+	// entries of vendor/ placed by jb: packages and their legacy symlinks
+	packages := make(map[string]bool)
+	legacy := make(map[string]string)
+	for _, d := range sorted(locks) {
+		if d.Excluded {
+			continue
+		}
+		packages[d.Name()] = true
+		if !isLinked(d.Source) {
+			legacy[d.LegacyName()] = d.Name()
+		}
+	}
+
+	err := filepath.Walk(vendorDir, func(path string, i os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == vendorDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if path == vendorDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(vendorDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		switch {
+		case name == ".tmp":
+			return filepath.SkipDir
+		case packages[name]:
+			if i.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case i.Mode()&os.ModeSymlink != 0 && legacy[name] != "":
+			if link, err := os.Readlink(path); err == nil && filepath.ToSlash(link) == legacy[name] {
+				return nil
+			}
+		case i.IsDir() && known(locks, name):
+			// contains packages
+			return nil
+		}
+
+		problems = append(problems, VerifyProblem{Kind: VerifyUnknown, Name: name})
+		if i.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jsonnet-bundler/jsonnet-bundler/spec/v1/deps"
+)
+
+func TestVerify(t *testing.T) {
+	vendorDir := t.TempDir()
+
+	grafonnet := gitDep("grafonnet-lib", "v1.0.0")
+	builder := gitDep("jsonnet-libs", "v1.0.0")
+	loki := gitDep("loki", "v2.0.0")
+	tempo := gitDep("tempo", "main")
+
+	locks := deps.NewOrdered()
+	locks.Set(grafonnet.Name(), vendorPackage(t, vendorDir, grafonnet, "v1.0.0"))
+	locks.Set(builder.Name(), vendorPackage(t, vendorDir, builder, "v1.0.0"))
+
+	problems, err := Verify(vendorDir, locks)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// hand-edited
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vendorDir, builder.Name(), "main.libsonnet"), []byte(`"edited"`), 0644))
+	// never installed
+	locks.Set(loki.Name(), deps.Dependency{Source: loki.Source, Version: "abc", Sum: "c3Vt"})
+	// excluded packages must not be present
+	locks.Set(tempo.Name(), deps.Dependency{Source: tempo.Source, Version: "main", Excluded: true})
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, tempo.Name()), os.ModePerm))
+	// leftovers of an interrupted download are ignored
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, ".tmp", "foo"), os.ModePerm))
+	// legacy symlinks are part of vendor/
+	require.NoError(t, os.Symlink(grafonnet.Name(), filepath.Join(vendorDir, grafonnet.LegacyName())))
+	// anything else is not, be it files, symlinks or directories named like
+	// a package
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vendorDir, "evil.libsonnet"), []byte("{}"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vendorDir, "github.com", "x.libsonnet"), []byte("{}"), 0644))
+	require.NoError(t, os.Symlink(os.TempDir(), filepath.Join(vendorDir, "link")))
+	require.NoError(t, os.MkdirAll(filepath.Join(vendorDir, builder.Name()+"-evil"), os.ModePerm))
+
+	problems, err = Verify(vendorDir, locks)
+	require.NoError(t, err)
+
+	l, _ := locks.Get(builder.Name())
+	assert.Equal(t, []VerifyProblem{
+		{Kind: VerifyMismatch, Name: builder.Name(), Expected: l.Sum, Actual: hashDir(filepath.Join(vendorDir, builder.Name()))},
+		{Kind: VerifyMissing, Name: loki.Name()},
+		{Kind: VerifyUnknown, Name: "evil.libsonnet"},
+		{Kind: VerifyUnknown, Name: builder.Name() + "-evil"},
+		{Kind: VerifyUnknown, Name: tempo.Name()},
+		{Kind: VerifyUnknown, Name: "github.com/x.libsonnet"},
+		{Kind: VerifyUnknown, Name: "link"},
+	}, problems)
+
+	// the sum matches, but the git tree does not
+	l, _ = locks.Get(grafonnet.Name())
+	tree, err := gitTreeHash(filepath.Join(vendorDir, grafonnet.Name()))
+	require.NoError(t, err)
+	l.Tree = tree
+	assert.True(t, check(l, vendorDir))
+	l.Tree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	assert.False(t, check(l, vendorDir))
+
+	only := deps.NewOrdered()
+	only.Set(grafonnet.Name(), l)
+	problems, err = Verify(vendorDir, only)
+	require.NoError(t, err)
+	assert.Contains(t, problems, VerifyProblem{Kind: VerifyMismatch, Name: grafonnet.Name(), Expected: l.Tree, Actual: tree})
+}
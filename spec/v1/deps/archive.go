@@ -0,0 +1,97 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Archive holds all required information for installing a package from a
+// .tar.gz, .tar or .zip file
+type Archive struct {
+	// URL of the archive, either https://, http:// or file://
+	URL string `json:"url"`
+	// SHA256 is the hex encoded checksum of the archive file. Archives not
+	// matching it are rejected before extraction.
+	SHA256 string `json:"sha256"`
+	// StripComponents removes that many leading path components from all
+	// entries of the archive, like `tar --strip-components` does
+	StripComponents int `json:"stripComponents,omitempty"`
+	// Subdir of the archive to install, after stripping components
+	Subdir string `json:"subdir,omitempty"`
+
+	// Name the package is vendored under. Defaults to the URL without scheme
+	// and file extension, e.g. example.com/releases/foo for
+	// https://example.com/releases/foo.tar.gz
+	PackageName string `json:"name,omitempty"`
+}
+
+// archiveExts are the supported archive formats, longest first
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// Name returns the directory the archive is vendored to
+func (a *Archive) Name() string {
+	name := a.PackageName
+	if name == "" {
+		u, err := url.Parse(a.URL)
+		if err != nil {
+			return ""
+		}
+
+		p := strings.Trim(u.Path, "/")
+		for _, ext := range archiveExts {
+			if strings.HasSuffix(p, ext) {
+				p = strings.TrimSuffix(p, ext)
+				break
+			}
+		}
+
+		// local files have no meaningful location
+		if u.Scheme == "file" {
+			name = path.Base(p)
+		} else {
+			name = path.Join(u.Hostname(), p)
+		}
+	}
+
+	if a.Subdir != "" {
+		name = path.Join(name, a.Subdir)
+	}
+	return name
+}
+
+// LegacyName returns the last element of Name
+func (a *Archive) LegacyName() string {
+	return path.Base(a.Name())
+}
+
+// matches http(s):// and file:// URLs of archives, with an optional sha256
+// fragment, e.g. https://example.com/foo.tar.gz#sha256=abc...
+var archiveExp = regexp.MustCompile(`^(https?|file)://.+(\.tar\.gz|\.tgz|\.tar|\.zip)(#sha256=(?P<sha256>[0-9a-f]{64}))?$`)
+
+func parseArchive(uri string) *Dependency {
+	m := archiveExp.FindStringSubmatch(uri)
+	if m == nil {
+		return nil
+	}
+
+	a := &Archive{URL: strings.SplitN(uri, "#", 2)[0]}
+	a.SHA256 = m[archiveExp.SubexpIndex("sha256")]
+
+	return &Dependency{Source: Source{ArchiveSource: a}}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArchive(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		uri  string
+		want *Archive
+		name string
+	}{
+		{
+			uri:  "https://example.com/releases/foo.tar.gz",
+			want: &Archive{URL: "https://example.com/releases/foo.tar.gz"},
+			name: "example.com/releases/foo",
+		},
+		{
+			uri:  "https://example.com/foo.zip#sha256=" + sum,
+			want: &Archive{URL: "https://example.com/foo.zip", SHA256: sum},
+			name: "example.com/foo",
+		},
+		{
+			uri:  "file:///tmp/dist/foo.tgz",
+			want: &Archive{URL: "file:///tmp/dist/foo.tgz"},
+			name: "foo",
+		},
+		{
+			// a git repository
+			uri: "https://github.com/foo/bar",
+		},
+	}
+
+	for _, c := range tests {
+		d := Parse("", c.uri)
+		if c.want == nil {
+			require.NotNil(t, d, c.uri)
+			assert.Nil(t, d.Source.ArchiveSource, c.uri)
+			continue
+		}
+
+		require.NotNil(t, d, c.uri)
+		assert.Equal(t, c.want, d.Source.ArchiveSource, c.uri)
+		assert.Equal(t, c.name, d.Name(), c.uri)
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	a := Archive{URL: "https://example.com/foo-1.0.tar.gz", Subdir: "lib/foo"}
+	assert.Equal(t, "example.com/foo-1.0/lib/foo", a.Name())
+	assert.Equal(t, "foo", a.LegacyName())
+
+	a.PackageName = "example.com/foo"
+	assert.Equal(t, "example.com/foo/lib/foo", a.Name())
+}
+
+func TestArchiveJSON(t *testing.T) {
+	data := []byte(`{"source":{"archive":{"url":"https://example.com/foo.tar.gz","sha256":"abc","stripComponents":1,"subdir":"lib"}},"version":""}`)
+
+	var d Dependency
+	require.NoError(t, json.Unmarshal(data, &d))
+	assert.Equal(t, &Archive{URL: "https://example.com/foo.tar.gz", SHA256: "abc", StripComponents: 1, Subdir: "lib"}, d.Source.ArchiveSource)
+
+	out, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(data), string(out))
+}
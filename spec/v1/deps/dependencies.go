@@ -26,6 +26,25 @@ type Dependency struct {
 	Sum     string `json:"sum,omitempty"`
 	Single  bool   `json:"single,omitempty"`
 
+	// Tag is the git tag that was installed, if Version is a semver tag or
+	// constraint. Only used in the lockfile, where Version holds the commit
+	// of that tag.
+	Tag string `json:"tag,omitempty"`
+
+	// Tree is the sha git computes for the tree of the installed files, for
+	// git packages. Unlike Sum, it can be compared to the tree of the commit.
+	// Only used in the lockfile.
+	Tree string `json:"tree,omitempty"`
+
+	// Replace is the package that was installed instead of this one, as
+	// configured by a Replacement. Only used in the lockfile.
+	Replace *Dependency `json:"replace,omitempty"`
+
+	// Excluded marks a package that was required, but not installed because
+	// of an Exclusion. Only used in the lockfile, where Version holds the
+	// version that was requested.
+	Excluded bool `json:"excluded,omitempty"`
+
 	// older schema used to have `name`. We still need that data for
 	// `LegacyName`
 	LegacyNameCompat string `json:"name,omitempty"`
@@ -36,11 +55,12 @@ func Parse(dir, uri string) *Dependency {
 		return nil
 	}
 
-	if d := parseGit(uri); d != nil {
-		return d
+	for _, k := range kinds {
+		if d := k.Parse(dir, uri); d != nil {
+			return d
+		}
 	}
-
-	return parseLocal(dir, uri)
+	return nil
 }
 
 func (d Dependency) Name() string {
@@ -54,47 +74,75 @@ func (d Dependency) LegacyName() string {
 	return d.Source.LegacyName()
 }
 
-type Ordered = orderedmap.OrderedMap[string, Dependency]
+// Upstream returns the dependency that is actually fetched: The replacement if
+// there is one, d itself otherwise
+func (d Dependency) Upstream() Dependency {
+	if d.Replace != nil {
+		return *d.Replace
+	}
+	return d
+}
 
-func NewOrdered() *Ordered {
-	return orderedmap.NewOrderedMap[string, Dependency]()
+// Replacement redirects a package to a different source or version, much like
+// `replace` directives of go.mod. The package is still vendored under its
+// original name, so imports keep working.
+type Replacement struct {
+	// Name of the package to replace, e.g.
+	// github.com/grafana/grafonnet-lib/grafonnet
+	Name string `json:"name"`
+	// Version restricts the replacement to this requested version. If empty,
+	// all versions are replaced.
+	Version string `json:"version,omitempty"`
+	// With is the package to install instead. A git source without a version
+	// is installed at the version that was requested originally.
+	With Dependency `json:"with"`
 }
 
-type Source struct {
-	GitSource   *Git   `json:"git,omitempty"`
-	LocalSource *Local `json:"local,omitempty"`
+// Matches returns whether the replacement applies to d
+func (r Replacement) Matches(d Dependency) bool {
+	return r.Name == d.Name() && (r.Version == "" || r.Version == d.Version)
 }
 
-func (s Source) Name() string {
-	switch {
-	case s.GitSource != nil:
-		return s.GitSource.Name()
-	case s.LocalSource != nil:
-		return s.LegacyName()
-	default:
-		return ""
-	}
+// Exclusion prevents a nested package from being installed, much like
+// `exclude` directives of go.mod. Packages required by the project itself are
+// never excluded.
+type Exclusion struct {
+	// Name of the package to exclude
+	Name string `json:"name"`
+	// Version restricts the exclusion to this requested version. If empty,
+	// all versions are excluded.
+	Version string `json:"version,omitempty"`
 }
 
-func (s Source) LegacyName() string {
-	switch {
-	case s.GitSource != nil:
-		return s.GitSource.LegacyName()
-	case s.LocalSource != nil:
-		p, err := filepath.Abs(s.LocalSource.Directory)
-		if err != nil {
-			panic("unable to create absolute path from local source directory: " + err.Error())
-		}
-		return filepath.Base(p)
-	default:
-		return ""
-	}
+// Matches returns whether the exclusion applies to d
+func (e Exclusion) Matches(d Dependency) bool {
+	return e.Name == d.Name() && (e.Version == "" || e.Version == d.Version)
+}
+
+type Ordered = orderedmap.OrderedMap[string, Dependency]
+
+func NewOrdered() *Ordered {
+	return orderedmap.NewOrderedMap[string, Dependency]()
 }
 
 type Local struct {
 	Directory string `json:"directory"`
 }
 
+// Name returns the name of the directory
+func (l *Local) Name() string {
+	return l.LegacyName()
+}
+
+// LegacyName returns the name of the directory
+func (l *Local) LegacyName() string {
+	p, err := filepath.Abs(l.Directory)
+	if err != nil {
+		panic("unable to create absolute path from local source directory: " + err.Error())
+	}
+	return filepath.Base(p)
+}
+
 func parseLocal(dir, p string) *Dependency {
 	clean := filepath.Clean(p)
 	abs := filepath.Join(dir, clean)
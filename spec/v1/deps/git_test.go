@@ -169,6 +169,23 @@ func TestParseGit(t *testing.T) {
 			},
 			wantRemote: "https://example.com/foo/bar.git",
 		},
+		{
+			name: "ValidGitConstraint",
+			uri:  "example.com/foo/bar/baz@^1.4.0",
+			want: &Dependency{
+				Version: "^1.4.0",
+				Source: Source{
+					GitSource: &Git{
+						Scheme: GitSchemeHTTPS,
+						Host:   "example.com",
+						User:   "foo",
+						Repo:   "bar",
+						Subdir: "/baz",
+					},
+				},
+			},
+			wantRemote: "https://example.com/foo/bar.git",
+		},
 		{
 			name: "ValidGitSubdomain",
 			uri:  "git.example.com/foo/bar",
@@ -0,0 +1,86 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// OCI holds all required information for installing a package stored as an
+// OCI artifact. The tag or digest to pull is the Version of the Dependency.
+type OCI struct {
+	// Repository of the artifact, including the registry, e.g.
+	// registry.example.com/jsonnet/foo
+	Repository string `json:"repository"`
+	// Layout is a local OCI image layout directory to read the artifact from
+	// instead of the registry, e.g. as created by `oras copy --to-oci-layout`
+	Layout string `json:"layout,omitempty"`
+	// Subdir of the artifact to install
+	Subdir string `json:"subdir,omitempty"`
+
+	// Name the package is vendored under. Defaults to Repository.
+	PackageName string `json:"name,omitempty"`
+}
+
+// Name returns the directory the artifact is vendored to
+func (o *OCI) Name() string {
+	name := o.PackageName
+	switch {
+	case name != "":
+	case o.Repository != "":
+		name = o.Repository
+	default:
+		name = filepath.Base(filepath.Clean(o.Layout))
+	}
+
+	if o.Subdir != "" {
+		name = path.Join(name, o.Subdir)
+	}
+	return name
+}
+
+// LegacyName returns the last element of Name
+func (o *OCI) LegacyName() string {
+	return path.Base(o.Name())
+}
+
+// IsDigest returns whether the version is a digest, as opposed to a tag
+func IsDigest(version string) bool {
+	return strings.Contains(version, ":")
+}
+
+// matches oci://<registry>/<repository>[@<tag|digest>]. The tag defaults to
+// latest.
+var ociExp = regexp.MustCompile(`^oci://(?P<repo>[a-zA-Z0-9.\-:]+(/[a-z0-9._\-]+)+)(@(?P<version>[a-zA-Z0-9_][a-zA-Z0-9._\-]{0,127}|sha256:[0-9a-f]{64}))?$`)
+
+func parseOCI(uri string) *Dependency {
+	m := ociExp.FindStringSubmatch(uri)
+	if m == nil {
+		return nil
+	}
+
+	version := m[ociExp.SubexpIndex("version")]
+	if version == "" {
+		version = "latest"
+	}
+
+	return &Dependency{
+		Source:  Source{OCISource: &OCI{Repository: m[ociExp.SubexpIndex("repo")]}},
+		Version: version,
+	}
+}
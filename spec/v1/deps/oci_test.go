@@ -0,0 +1,65 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOCI(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		uri     string
+		repo    string
+		version string
+	}{
+		{uri: "oci://registry.example.com/jsonnet/foo@v1.0.0", repo: "registry.example.com/jsonnet/foo", version: "v1.0.0"},
+		{uri: "oci://localhost:5000/foo@" + digest, repo: "localhost:5000/foo", version: digest},
+		{uri: "oci://registry.example.com/jsonnet/foo", repo: "registry.example.com/jsonnet/foo", version: "latest"},
+		{uri: "oci://registry.example.com"},
+		{uri: "oci://registry.example.com/foo@sha256:abc"},
+	}
+
+	for _, c := range tests {
+		d := Parse("", c.uri)
+		if c.repo == "" {
+			assert.Nil(t, d, c.uri)
+			continue
+		}
+
+		require.NotNil(t, d, c.uri)
+		require.NotNil(t, d.Source.OCISource, c.uri)
+		assert.Equal(t, c.repo, d.Source.OCISource.Repository, c.uri)
+		assert.Equal(t, c.repo, d.Name(), c.uri)
+		assert.Equal(t, c.version, d.Version, c.uri)
+	}
+}
+
+func TestOCIName(t *testing.T) {
+	o := OCI{Repository: "registry.example.com/jsonnet/foo", Subdir: "lib"}
+	assert.Equal(t, "registry.example.com/jsonnet/foo/lib", o.Name())
+	assert.Equal(t, "lib", o.LegacyName())
+
+	o = OCI{Layout: "/srv/oci/foo/"}
+	assert.Equal(t, "foo", o.Name())
+
+	o.PackageName = "example.com/foo"
+	assert.Equal(t, "example.com/foo", o.Name())
+}
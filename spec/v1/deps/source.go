@@ -0,0 +1,217 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Spec describes where a package comes from, e.g. a git repository. Specs
+// are of one of the kinds added using Register.
+type Spec interface {
+	// Name returns the path the package is vendored under
+	Name() string
+	// LegacyName returns the name of the package for legacy imports
+	LegacyName() string
+}
+
+// Kind is a kind of source, such as git or local
+type Kind struct {
+	// Name of the kind, which is also the key of its specs in the source
+	// object of jsonnetfile.json, e.g. "git"
+	Name string
+	// New returns an empty spec of this kind, to unmarshal into. It must be a
+	// pointer.
+	New func() Spec
+	// Parse returns the dependency the uri refers to, or nil if it is not of
+	// this kind. Relative paths are based on dir.
+	Parse func(dir, uri string) *Dependency
+
+	// get and set access the field of Source holding specs of this kind. Kinds
+	// added using Register use Source.Other.
+	get func(s Source) Spec
+	set func(s *Source, spec Spec)
+}
+
+// kinds are all known kinds of sources, in the order package URIs are parsed
+var kinds = []Kind{
+	{
+		Name:  "archive",
+		New:   func() Spec { return &Archive{} },
+		Parse: func(dir, uri string) *Dependency { return parseArchive(uri) },
+		get: func(s Source) Spec {
+			if s.ArchiveSource == nil {
+				return nil
+			}
+			return s.ArchiveSource
+		},
+		set: func(s *Source, spec Spec) { s.ArchiveSource = spec.(*Archive) },
+	},
+	{
+		Name:  "oci",
+		New:   func() Spec { return &OCI{} },
+		Parse: func(dir, uri string) *Dependency { return parseOCI(uri) },
+		get: func(s Source) Spec {
+			if s.OCISource == nil {
+				return nil
+			}
+			return s.OCISource
+		},
+		set: func(s *Source, spec Spec) { s.OCISource = spec.(*OCI) },
+	},
+	{
+		Name:  "git",
+		New:   func() Spec { return &Git{} },
+		Parse: func(dir, uri string) *Dependency { return parseGit(uri) },
+		get: func(s Source) Spec {
+			if s.GitSource == nil {
+				return nil
+			}
+			return s.GitSource
+		},
+		set: func(s *Source, spec Spec) { s.GitSource = spec.(*Git) },
+	},
+	// local comes last, as about anything could be a directory
+	{
+		Name:  "local",
+		New:   func() Spec { return &Local{} },
+		Parse: parseLocal,
+		get: func(s Source) Spec {
+			if s.LocalSource == nil {
+				return nil
+			}
+			return s.LocalSource
+		},
+		set: func(s *Source, spec Spec) { s.LocalSource = spec.(*Local) },
+	},
+}
+
+// registered is the number of kinds added using Register
+var registered = 0
+
+// Register adds a kind of source, e.g. from a program embedding jb. URIs are
+// parsed by the registered kinds first, in the order they were registered,
+// before falling back to the built-in ones. Specs of the kind are held by
+// Source.Other. Register panics if the name is taken.
+//
+// Register is not safe for concurrent use and should be called from init.
+func Register(k Kind) {
+	if _, ok := KindByName(k.Name); ok {
+		panic(fmt.Sprintf("source kind %s is already registered", k.Name))
+	}
+	if k.New == nil || k.Parse == nil {
+		panic(fmt.Sprintf("source kind %s needs New and Parse", k.Name))
+	}
+
+	typ := reflect.TypeOf(k.New())
+	k.get = func(s Source) Spec {
+		if s.Other == nil || reflect.TypeOf(s.Other) != typ {
+			return nil
+		}
+		return s.Other
+	}
+	k.set = func(s *Source, spec Spec) { s.Other = spec }
+
+	kinds = append(kinds[:registered], append([]Kind{k}, kinds[registered:]...)...)
+	registered++
+}
+
+// KindByName returns the kind of source called name
+func KindByName(name string) (Kind, bool) {
+	for _, k := range kinds {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return Kind{}, false
+}
+
+// Source is where a package comes from. Only one of its specs is set.
+type Source struct {
+	GitSource     *Git     `json:"git,omitempty"`
+	LocalSource   *Local   `json:"local,omitempty"`
+	ArchiveSource *Archive `json:"archive,omitempty"`
+	OCISource     *OCI     `json:"oci,omitempty"`
+
+	// Other holds the spec of a kind added using Register
+	Other Spec `json:"-"`
+}
+
+// Spec returns the spec of the source and its kind. ok is false if no spec is
+// set.
+func (s Source) Spec() (spec Spec, kind Kind, ok bool) {
+	for _, k := range kinds {
+		if spec := k.get(s); spec != nil {
+			return spec, k, true
+		}
+	}
+	return nil, Kind{}, false
+}
+
+func (s Source) Name() string {
+	spec, _, ok := s.Spec()
+	if !ok {
+		return ""
+	}
+	return spec.Name()
+}
+
+func (s Source) LegacyName() string {
+	spec, _, ok := s.Spec()
+	if !ok {
+		return ""
+	}
+	return spec.LegacyName()
+}
+
+// MarshalJSON writes the spec under the name of its kind
+func (s Source) MarshalJSON() ([]byte, error) {
+	specs := make(map[string]Spec)
+	for _, k := range kinds {
+		if spec := k.get(s); spec != nil {
+			specs[k.Name] = spec
+		}
+	}
+	return json.Marshal(specs)
+}
+
+// UnmarshalJSON reads the spec of any known kind
+func (s *Source) UnmarshalJSON(data []byte) error {
+	var specs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return err
+	}
+
+	*s = Source{}
+	for name, raw := range specs {
+		if string(raw) == "null" {
+			continue
+		}
+
+		k, ok := KindByName(name)
+		if !ok {
+			return fmt.Errorf("unknown source kind '%s'", name)
+		}
+
+		spec := k.New()
+		if err := json.Unmarshal(raw, spec); err != nil {
+			return err
+		}
+		k.set(s, spec)
+	}
+	return nil
+}
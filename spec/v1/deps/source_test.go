@@ -0,0 +1,95 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deps
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bucket is a source kind that is not built in
+type bucket struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func (b *bucket) Name() string       { return path.Join(b.Bucket, b.Key) }
+func (b *bucket) LegacyName() string { return path.Base(b.Key) }
+
+func init() {
+	Register(Kind{
+		Name: "bucket",
+		New:  func() Spec { return &bucket{} },
+		Parse: func(dir, uri string) *Dependency {
+			if !strings.HasPrefix(uri, "bucket://") {
+				return nil
+			}
+			parts := strings.SplitN(strings.TrimPrefix(uri, "bucket://"), "/", 2)
+			return &Dependency{Source: Source{Other: &bucket{Bucket: parts[0], Key: parts[1]}}}
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	d := Parse("", "bucket://jsonnet/libs/foo")
+	require.NotNil(t, d)
+	assert.Equal(t, &bucket{Bucket: "jsonnet", Key: "libs/foo"}, d.Source.Other)
+	assert.Equal(t, "jsonnet/libs/foo", d.Name())
+	assert.Equal(t, "foo", d.LegacyName())
+
+	_, kind, ok := d.Source.Spec()
+	require.True(t, ok)
+	assert.Equal(t, "bucket", kind.Name)
+
+	// built-in kinds still work
+	d = Parse("", "github.com/grafana/jsonnet-libs/grafana-builder")
+	require.NotNil(t, d)
+	_, kind, _ = d.Source.Spec()
+	assert.Equal(t, "git", kind.Name)
+
+	assert.Panics(t, func() {
+		Register(Kind{Name: "git", New: func() Spec { return &Git{} }, Parse: parseLocal})
+	})
+}
+
+func TestSourceJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "git", json: `{"git":{"remote":"https://github.com/foo/bar.git","subdir":"lib"}}`},
+		{name: "local", json: `{"local":{"directory":"foo"}}`},
+		{name: "registered", json: `{"bucket":{"bucket":"jsonnet","key":"libs/foo"}}`},
+	}
+
+	for _, c := range tests {
+		var s Source
+		require.NoError(t, json.Unmarshal([]byte(c.json), &s), c.name)
+		_, _, ok := s.Spec()
+		assert.True(t, ok, c.name)
+
+		data, err := json.Marshal(s)
+		require.NoError(t, err, c.name)
+		assert.JSONEq(t, c.json, string(data), c.name)
+	}
+
+	var s Source
+	assert.EqualError(t, json.Unmarshal([]byte(`{"svn":{"url":"foo"}}`), &s), "unknown source kind 'svn'")
+}
@@ -31,6 +31,14 @@ type JsonnetFile struct {
 
 	// Symlink files to old location
 	LegacyImports bool
+
+	// Packages to install from a different source or version. Only used in
+	// the jsonnetFile of the project itself.
+	Replace []deps.Replacement
+
+	// Nested packages not to install. Only used in the jsonnetFile of the
+	// project itself.
+	Exclude []deps.Exclusion
 }
 
 // New returns a new JsonnetFile with the dependencies map initialized
@@ -44,9 +52,11 @@ func New() JsonnetFile {
 // jsonFile is the json representation of a JsonnetFile, which is different for
 // compatibility reasons.
 type jsonFile struct {
-	Version       uint              `json:"version"`
-	Dependencies  []deps.Dependency `json:"dependencies"`
-	LegacyImports bool              `json:"legacyImports"`
+	Version       uint               `json:"version"`
+	Dependencies  []deps.Dependency  `json:"dependencies"`
+	LegacyImports bool               `json:"legacyImports"`
+	Replace       []deps.Replacement `json:"replace,omitempty"`
+	Exclude       []deps.Exclusion   `json:"exclude,omitempty"`
 }
 
 // UnmarshalJSON unmarshals a `jsonFile`'s json into a JsonnetFile
@@ -64,6 +74,8 @@ func (jf *JsonnetFile) UnmarshalJSON(data []byte) error {
 	}
 
 	jf.LegacyImports = s.LegacyImports
+	jf.Replace = s.Replace
+	jf.Exclude = s.Exclude
 
 	return nil
 }
@@ -74,6 +86,8 @@ func (jf JsonnetFile) MarshalJSON() ([]byte, error) {
 
 	s.Version = Version
 	s.LegacyImports = jf.LegacyImports
+	s.Replace = jf.Replace
+	s.Exclude = jf.Exclude
 
 	for _, k := range jf.Dependencies.Keys() {
 		d, _ := jf.Dependencies.Get(k)
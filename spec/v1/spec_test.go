@@ -116,3 +116,82 @@ func TestRemarshal(t *testing.T) {
 
 	assert.Equal(t, jf, dst)
 }
+
+const jsonReplaceJF = `{
+  "version": 1,
+  "dependencies": [],
+  "legacyImports": false,
+  "replace": [
+    {
+      "name": "github.com/grafana/grafonnet-lib/grafonnet",
+      "version": "v1.0.0",
+      "with": {
+        "source": {
+          "git": {
+            "remote": "https://github.com/example/grafonnet-lib.git",
+            "subdir": "grafonnet"
+          }
+        },
+        "version": "v1.0.0-patched"
+      }
+    },
+    {
+      "name": "github.com/grafana/jsonnet-libs/grafana-builder",
+      "with": {
+        "source": {
+          "local": {
+            "directory": "../grafana-builder"
+          }
+        },
+        "version": ""
+      }
+    }
+  ]
+}`
+
+// TestReplace checks that replacements survive a roundtrip
+func TestReplace(t *testing.T) {
+	var dst JsonnetFile
+	err := json.Unmarshal([]byte(jsonReplaceJF), &dst)
+	require.NoError(t, err)
+
+	require.Len(t, dst.Replace, 2)
+	assert.Equal(t, "github.com/grafana/grafonnet-lib/grafonnet", dst.Replace[0].Name)
+	assert.Equal(t, "github.com/example/grafonnet-lib/grafonnet", dst.Replace[0].With.Name())
+	assert.Equal(t, "../grafana-builder", dst.Replace[1].With.Source.LocalSource.Directory)
+
+	data, err := json.Marshal(dst)
+	require.NoError(t, err)
+	assert.JSONEq(t, jsonReplaceJF, string(data))
+}
+
+const jsonExcludeJF = `{
+  "version": 1,
+  "dependencies": [],
+  "legacyImports": false,
+  "exclude": [
+    {
+      "name": "github.com/grafana/grafonnet-lib/grafonnet"
+    },
+    {
+      "name": "github.com/ksonnet/ksonnet-lib/ksonnet.beta.3",
+      "version": "master"
+    }
+  ]
+}`
+
+// TestExclude checks that exclusions survive a roundtrip
+func TestExclude(t *testing.T) {
+	var dst JsonnetFile
+	err := json.Unmarshal([]byte(jsonExcludeJF), &dst)
+	require.NoError(t, err)
+
+	require.Len(t, dst.Exclude, 2)
+	assert.Equal(t, "github.com/grafana/grafonnet-lib/grafonnet", dst.Exclude[0].Name)
+	assert.Equal(t, "", dst.Exclude[0].Version)
+	assert.Equal(t, "master", dst.Exclude[1].Version)
+
+	data, err := json.Marshal(dst)
+	require.NoError(t, err)
+	assert.JSONEq(t, jsonExcludeJF, string(data))
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package imports finds the `import`, `importstr` and `importbin` statements
+// of Jsonnet files
+package imports
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Import is a single import statement
+type Import struct {
+	// Keyword is one of `import`, `importstr` or `importbin`
+	Keyword string
+	// Path is the imported path, as written in the file
+	Path string
+	// Line the import is located at, starting at 1
+	Line int
+}
+
+var keywords = map[string]bool{
+	"import":    true,
+	"importstr": true,
+	"importbin": true,
+}
+
+// Parse returns all imports of the Jsonnet source. Comments and the contents
+// of strings are skipped, so only actual import statements are returned.
+func Parse(src []byte) []Import {
+	s := &scanner{src: string(src), line: 1}
+	var imports []Import
+
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; {
+		case s.skipSpaceAndComments():
+		case c == '\'' || c == '"' || c == '@' || strings.HasPrefix(s.src[s.pos:], "|||"):
+			s.string()
+		case isIdentStart(c):
+			ident := s.ident()
+			if !keywords[ident] {
+				continue
+			}
+
+			line := s.line
+			for s.skipSpaceAndComments() {
+			}
+			if path, ok := s.string(); ok {
+				imports = append(imports, Import{Keyword: ident, Path: path, Line: line})
+			}
+		default:
+			s.pos++
+		}
+	}
+
+	return imports
+}
+
+// ParseFile returns all imports of the Jsonnet file
+func ParseFile(name string) ([]Import, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data), nil
+}
+
+// Find parses all .jsonnet and .libsonnet files below dir and returns their
+// imports by file path. Directories for which skip returns true are not
+// descended into. Symlinks are not followed.
+func Find(dir string, skip func(path string) bool) (map[string][]Import, error) {
+	found := make(map[string][]Import)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != dir && skip != nil && skip(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if ext := filepath.Ext(path); ext != ".jsonnet" && ext != ".libsonnet" {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		imports, err := ParseFile(path)
+		if err != nil {
+			return err
+		}
+		found[path] = imports
+		return nil
+	})
+
+	return found, err
+}
+
+type scanner struct {
+	src  string
+	pos  int
+	line int
+}
+
+// skipSpaceAndComments advances over whitespace and a comment, if any. It
+// returns whether anything was skipped.
+func (s *scanner) skipSpaceAndComments() bool {
+	if s.pos >= len(s.src) {
+		return false
+	}
+
+	rest := s.src[s.pos:]
+	switch {
+	case rest[0] == '\n':
+		s.line++
+		s.pos++
+	case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r':
+		s.pos++
+	case rest[0] == '#' || strings.HasPrefix(rest, "//"):
+		end := strings.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest)
+		}
+		s.pos += end
+	case strings.HasPrefix(rest, "/*"):
+		end := strings.Index(rest[2:], "*/")
+		if end < 0 {
+			end = len(rest)
+		} else {
+			end += 4
+		}
+		s.advance(end)
+	default:
+		return false
+	}
+	return true
+}
+
+// advance moves n bytes forward, counting lines
+func (s *scanner) advance(n int) {
+	s.line += strings.Count(s.src[s.pos:s.pos+n], "\n")
+	s.pos += n
+}
+
+func (s *scanner) ident() string {
+	start := s.pos
+	for s.pos < len(s.src) && isIdentChar(s.src[s.pos]) {
+		s.pos++
+	}
+	return s.src[start:s.pos]
+}
+
+// string consumes a string literal and returns its value. ok is false if no
+// string literal starts at the current position.
+func (s *scanner) string() (value string, ok bool) {
+	rest := s.src[s.pos:]
+	if len(rest) == 0 {
+		return "", false
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "|||"):
+		// text block: ends at the first line that starts with |||
+		end := strings.Index(rest[3:], "\n")
+		for end >= 0 {
+			next := 3 + end + 1
+			trimmed := strings.TrimLeft(rest[next:], " \t")
+			if strings.HasPrefix(trimmed, "|||") {
+				s.advance(len(rest) - len(trimmed) + 3)
+				return "", true
+			}
+			end = strings.Index(rest[next:], "\n")
+			if end >= 0 {
+				end += next - 3
+			}
+		}
+		s.advance(len(rest))
+		return "", true
+
+	case strings.HasPrefix(rest, "@'") || strings.HasPrefix(rest, `@"`):
+		// verbatim string: quotes are escaped by doubling them
+		q := rest[1]
+		var b strings.Builder
+		for i := 2; i < len(rest); i++ {
+			if rest[i] != q {
+				b.WriteByte(rest[i])
+				continue
+			}
+			if i+1 < len(rest) && rest[i+1] == q {
+				b.WriteByte(q)
+				i++
+				continue
+			}
+			s.advance(i + 1)
+			return b.String(), true
+		}
+		s.advance(len(rest))
+		return b.String(), true
+
+	case rest[0] == '\'' || rest[0] == '"':
+		q := rest[0]
+		var b strings.Builder
+		for i := 1; i < len(rest); i++ {
+			switch rest[i] {
+			case q:
+				s.advance(i + 1)
+				return b.String(), true
+			case '\\':
+				if i+1 < len(rest) {
+					i++
+					b.WriteString(unescape(rest[i]))
+				}
+			default:
+				b.WriteByte(rest[i])
+			}
+		}
+		s.advance(len(rest))
+		return b.String(), true
+	}
+
+	if rest[0] == '@' {
+		s.pos++
+	}
+	return "", false
+}
+
+func unescape(c byte) string {
+	switch c {
+	case 'n':
+		return "\n"
+	case 't':
+		return "\t"
+	case 'r':
+		return "\r"
+	case 'b':
+		return "\b"
+	case 'f':
+		return "\f"
+	default:
+		return string(c)
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
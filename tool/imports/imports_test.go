@@ -0,0 +1,82 @@
+// Copyright 2018 jsonnet-bundler authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package imports
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sample = `
+local k = import "github.com/ksonnet/ksonnet-lib/ksonnet.beta.4/k.libsonnet";
+local dash = importstr 'dashboards/node.json';
+local logo = importbin @'img\logo.png';
+local g = import /* comment */ "grafonnet/grafana.libsonnet";
+
+// import "commented.libsonnet"
+# import "hashed.libsonnet"
+/* import "block.libsonnet"
+   import "block2.libsonnet" */
+{
+  doc: 'import "quoted.libsonnet"',
+  text: |||
+    import "text.libsonnet"
+  |||,
+  important: import "escaped\"quote.libsonnet",
+}
+`
+
+func TestParse(t *testing.T) {
+	got := Parse([]byte(sample))
+	assert.Equal(t, []Import{
+		{Keyword: "import", Path: "github.com/ksonnet/ksonnet-lib/ksonnet.beta.4/k.libsonnet", Line: 2},
+		{Keyword: "importstr", Path: "dashboards/node.json", Line: 3},
+		{Keyword: "importbin", Path: `img\logo.png`, Line: 4},
+		{Keyword: "import", Path: "grafonnet/grafana.libsonnet", Line: 5},
+		{Keyword: "import", Path: `escaped"quote.libsonnet`, Line: 16},
+	}, got)
+
+	// sources ending right after the keyword, e.g. while being edited
+	for _, keyword := range []string{"import", "importstr", "importbin"} {
+		assert.Empty(t, Parse([]byte("{a: 1} + "+keyword)), keyword)
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	write("main.jsonnet", `import "a.libsonnet"`)
+	write("lib/a.libsonnet", `importstr "a.txt"`)
+	write("lib/a.txt", `import "ignored.libsonnet"`)
+	write("vendor/b.libsonnet", `import "skipped.libsonnet"`)
+
+	got, err := Find(dir, func(path string) bool {
+		return filepath.Base(path) == "vendor"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Import{
+		filepath.Join(dir, "main.jsonnet"):    {{Keyword: "import", Path: "a.libsonnet", Line: 1}},
+		filepath.Join(dir, "lib/a.libsonnet"): {{Keyword: "importstr", Path: "a.txt", Line: 1}},
+	}, got)
+}